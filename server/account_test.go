@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// deleteAccount posts to /delete-account with the given password, as a
+// session of user, or with the access token if it is not empty.
+func deleteAccount(t *testing.T, user User, token, password string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/delete-account", strings.NewReader(`{"password":"`+password+`"}`))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		rec := httptest.NewRecorder()
+		if err := startSession(rec, user); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range rec.Result().Cookies() {
+			r.AddCookie(c)
+		}
+	}
+	w := httptest.NewRecorder()
+	authMiddleware(DeleteAccount)(w, r)
+	return w
+}
+
+func accountExists(t *testing.T, id uint) bool {
+	t.Helper()
+	var n int64
+	db.Model(&User{}).Where("id = ?", id).Count(&n)
+	return n > 0
+}
+
+func newPasswordUser(t *testing.T, username, password string) (User, Node) {
+	t.Helper()
+	hash, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := createAccount(User{Username: username, Password: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, return_root(user.ID)
+}
+
+func TestDeleteAccountWithPassword(t *testing.T) {
+	newTestDB(t)
+	user, root := newPasswordUser(t, "alice", "alice-secret")
+	uploadTestFile(t, "a.txt", "content", root.ID, user.ID)
+	if w := deleteAccount(t, user, "", "wrong"); w.Code != http.StatusUnauthorized || !accountExists(t, user.ID) {
+		t.Fatalf("wrong password: %d", w.Code)
+	}
+	if w := deleteAccount(t, user, "", "alice-secret"); w.Code != http.StatusOK || accountExists(t, user.ID) {
+		t.Fatalf("right password: %d %s", w.Code, w.Body)
+	}
+	var nodes int64
+	db.Model(&Node{}).Where("user_id = ?", user.ID).Count(&nodes)
+	if nodes != 0 {
+		t.Fatalf("%d nodes are left", nodes)
+	}
+}
+
+func TestDeleteAccountRefusesFolderTokens(t *testing.T) {
+	newTestDB(t)
+	user, root := newPasswordUser(t, "alice", "alice-secret")
+	folder := newFolder(t, "shared", root.ID, user.ID)
+	restricted, err := createAccessToken(user.ID, AccessTokenRequest{Name: "folder", FolderID: &folder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := deleteAccount(t, user, restricted.Token, "alice-secret"); w.Code != http.StatusForbidden || !accountExists(t, user.ID) {
+		t.Fatalf("folder-restricted token: %d", w.Code)
+	}
+	full, err := createAccessToken(user.ID, AccessTokenRequest{Name: "full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := deleteAccount(t, user, full.Token, "alice-secret"); w.Code != http.StatusOK || accountExists(t, user.ID) {
+		t.Fatalf("full token: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,957 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "/api/v1"
+
+// ErrorResponse is the body of every failed /api/v1 request.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	// Code is stable and meant for programs, e.g. not_found or conflict.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type Session struct {
+	UserID   uint   `json:"user_id"`
+	Username string `json:"username"`
+	IsAdmin  bool   `json:"is_admin"`
+}
+
+type NodeCreateRequest struct {
+	Name  string `json:"name"`
+	IsDir bool   `json:"is_dir"`
+}
+
+// NodeUpdateRequest renames or moves a node. Conflict is overwrite,
+// rename, skip or fail; overwrite is the older way to ask for "overwrite".
+type NodeUpdateRequest struct {
+	Name      *string `json:"name,omitempty"`
+	ParentID  *uint   `json:"parent_id,omitempty"`
+	Overwrite bool    `json:"overwrite,omitempty"`
+	Conflict  string  `json:"conflict,omitempty"`
+}
+
+type NodeCopyRequest struct {
+	ParentID  uint   `json:"parent_id"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+	Conflict  string `json:"conflict,omitempty"`
+}
+
+type ShareInfo struct {
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+type FileUpload struct {
+	File []byte `json:"file"`
+	Name string `json:"name,omitempty"`
+}
+
+type apiParam struct {
+	Name, In, Type, Description string
+}
+
+// apiRoute describes one endpoint. The table below is both what gets
+// registered on the mux and what the OpenAPI document is generated from.
+type apiRoute struct {
+	Method      string
+	Path        string
+	Summary     string
+	Public      bool
+	Params      []apiParam
+	Body        interface{}
+	BodyType    string
+	Status      int
+	Result      interface{}
+	ResultType  string
+	Errors      []int
+	Handler     http.HandlerFunc
+	OperationID string
+}
+
+var idParam = apiParam{"id", "path", "string", "node ID, or root for the root folder"}
+
+var conflictParam = apiParam{"conflict", "query", "string", "when the name is taken: overwrite, rename (to name (1).ext), skip or fail (default)"}
+
+var jobParam = apiParam{"id", "path", "string", "job ID"}
+
+var listParams = []apiParam{
+	{"sort", "query", "string", "name (natural order, the default), size, modified or type"},
+	{"order", "query", "string", "asc (default) or desc"},
+	{"folders_first", "query", "boolean", "list folders before files (default true)"},
+	{"type", "query", "string", "folder, file, or a MIME type or prefix such as image"},
+	{"ext", "query", "string", "comma-separated file extensions"},
+	{"limit", "query", "integer", "children per page, at most 1000; all of them when omitted"},
+	{"cursor", "query", "string", "next_cursor of the previous page"},
+}
+
+func apiRoutes() []apiRoute {
+	return []apiRoute{
+		{Method: "POST", Path: "/users", Summary: "Create an account and start a session", Public: true, OperationID: "createUser",
+			Body: Credentials{}, Status: http.StatusCreated, Result: Session{}, Errors: []int{400, 403, 409, 429}, Handler: apiCreateUser},
+		{Method: "POST", Path: "/session", Summary: "Log in", Public: true, OperationID: "login",
+			Body: Credentials{}, Status: http.StatusOK, Result: Session{}, Errors: []int{400, 401, 403, 429}, Handler: apiLogin},
+		{Method: "GET", Path: "/auth/methods", Summary: "Available ways to log in; single sign-on starts at oidc_login_url", Public: true, OperationID: "getAuthMethods",
+			Status: http.StatusOK, Result: AuthMethodsInfo{}, Handler: AuthMethods},
+		{Method: "DELETE", Path: "/session", Summary: "Log out", Public: true, OperationID: "logout",
+			Status: http.StatusNoContent, Handler: apiLogout},
+		{Method: "GET", Path: "/me", Summary: "Current user", OperationID: "getMe",
+			Status: http.StatusOK, Result: Session{}, Handler: apiMe},
+		{Method: "POST", Path: "/me/password", Summary: "Change the password; other sessions are logged out", OperationID: "changePassword",
+			Body: PasswordChangeRequest{}, Status: http.StatusOK, Result: Session{}, Errors: []int{400, 401, 403, 429}, Handler: apiChangePassword},
+		{Method: "POST", Path: "/password-reset", Summary: "Set a new password with a reset token from an administrator", Public: true, OperationID: "resetPassword",
+			Body: PasswordResetRequest{}, Status: http.StatusNoContent, Errors: []int{400, 429}, Handler: apiResetPassword},
+		{Method: "GET", Path: "/nodes/{id}", Summary: "Get a node with a page of its children; supports If-None-Match", OperationID: "getNode",
+			Params: append([]apiParam{idParam}, listParams...), Status: http.StatusOK, Result: Node{}, Errors: []int{400, 404}, Handler: apiGetNode},
+		{Method: "PATCH", Path: "/nodes/{id}", Summary: "Rename or move a node", OperationID: "updateNode",
+			Params: []apiParam{idParam}, Body: NodeUpdateRequest{}, Status: http.StatusOK, Result: Node{},
+			Errors: []int{400, 404, 409}, Handler: apiUpdateNode},
+		{Method: "DELETE", Path: "/nodes/{id}", Summary: "Delete a node and everything below it", OperationID: "deleteNode",
+			Params: []apiParam{idParam}, Status: http.StatusNoContent, Errors: []int{400, 404}, Handler: apiDeleteNode},
+		{Method: "POST", Path: "/nodes/{id}/children", Summary: "Create a folder (JSON) or upload a file (multipart) in a folder", OperationID: "createNode",
+			Params: []apiParam{idParam, conflictParam, {"overwrite", "query", "boolean", "same as conflict=overwrite"}},
+			Body:   FileUpload{}, BodyType: "multipart/form-data", Status: http.StatusCreated, Result: Node{},
+			Errors: []int{400, 404, 409, 412}, Handler: apiCreateNode},
+		{Method: "GET", Path: "/nodes/{id}/content", Summary: "Download a file; supports Range and If-None-Match", OperationID: "getContent",
+			Params: []apiParam{idParam, {"inline", "query", "boolean", "serve with Content-Disposition: inline"}},
+			Status: http.StatusOK, Result: []byte{}, ResultType: "application/octet-stream", Errors: []int{400, 404}, Handler: apiGetContent},
+		{Method: "PUT", Path: "/nodes/{id}/content", Summary: "Replace a file's content; send If-Match with the last seen hash to detect conflicts", OperationID: "putContent",
+			Params: []apiParam{idParam}, Body: []byte{}, BodyType: "application/octet-stream", Status: http.StatusOK, Result: Node{},
+			Errors: []int{400, 404, 412}, Handler: apiPutContent},
+		{Method: "POST", Path: "/nodes/{id}/copy", Summary: "Copy a node into a folder", OperationID: "copyNode",
+			Params: []apiParam{idParam}, Body: NodeCopyRequest{}, Status: http.StatusCreated, Result: Node{},
+			Errors: []int{400, 404, 409}, Handler: apiCopyNode},
+		{Method: "PUT", Path: "/nodes/{id}/share", Summary: "Create a share link, or return the existing one", OperationID: "shareNode",
+			Params: []apiParam{idParam}, Status: http.StatusOK, Result: ShareInfo{}, Errors: []int{404}, Handler: apiShareNode},
+		{Method: "DELETE", Path: "/nodes/{id}/share", Summary: "Remove a share link", OperationID: "unshareNode",
+			Params: []apiParam{idParam}, Status: http.StatusNoContent, Errors: []int{404}, Handler: apiUnshareNode},
+		{Method: "GET", Path: "/fs/{path...}", Summary: "List a folder, or download a file, by path; stat=true returns a file's metadata", OperationID: "getPath",
+			Params: append([]apiParam{fsPathParam, {"stat", "query", "boolean", "return the metadata of a file instead of its content"}}, listParams...),
+			Status: http.StatusOK, Result: Node{}, Errors: []int{400, 403, 404}, Handler: apiFsGet},
+		{Method: "PUT", Path: "/fs/{path...}", Summary: "Upload a file to a path; send If-Match with the last seen hash to detect conflicts", OperationID: "putPath",
+			Params: []apiParam{fsPathParam,
+				{"parents", "query", "boolean", "create missing folders on the way, like mkdir -p"},
+				conflictParam, {"overwrite", "query", "boolean", "same as conflict=overwrite"}},
+			Body: []byte{}, BodyType: "application/octet-stream", Status: http.StatusCreated, Result: Node{},
+			Errors: []int{400, 403, 404, 409, 412}, Handler: apiFsPut},
+		{Method: "POST", Path: "/fs/{path...}", Summary: "Create a folder at a path, or copy or move another path there", OperationID: "createPath",
+			Params: []apiParam{fsPathParam}, Body: FsCreateRequest{}, Status: http.StatusCreated, Result: Node{},
+			Errors: []int{400, 403, 404, 409}, Handler: apiFsPost},
+		{Method: "DELETE", Path: "/fs/{path...}", Summary: "Delete a path and everything below it", OperationID: "deletePath",
+			Params: []apiParam{fsPathParam}, Status: http.StatusNoContent, Errors: []int{400, 403, 404}, Handler: apiFsDelete},
+		{Method: "POST", Path: "/batch", Summary: "Copy, move or delete many nodes in a background job", OperationID: "startBatch",
+			Body: BatchRequest{}, Status: http.StatusAccepted, Result: JobStatus{}, Errors: []int{400, 403, 404}, Handler: apiBatch},
+		{Method: "GET", Path: "/jobs/{id}", Summary: "Progress, failures and summary of a job", OperationID: "getJob",
+			Params: []apiParam{jobParam}, Status: http.StatusOK, Result: JobStatus{}, Errors: []int{404}, Handler: apiGetJob},
+		{Method: "DELETE", Path: "/jobs/{id}", Summary: "Cancel a job; what it finished stays done", OperationID: "cancelJob",
+			Params: []apiParam{jobParam}, Status: http.StatusAccepted, Result: JobStatus{}, Errors: []int{404}, Handler: apiCancelJob},
+		{Method: "GET", Path: "/tokens", Summary: "List personal access tokens", OperationID: "listTokens",
+			Status: http.StatusOK, Result: []AccessToken{}, Errors: []int{403}, Handler: apiListTokens},
+		{Method: "POST", Path: "/tokens", Summary: "Create a personal access token; the secret is only returned here", OperationID: "createToken",
+			Body: AccessTokenRequest{}, Status: http.StatusCreated, Result: NewAccessToken{}, Errors: []int{400, 403, 404}, Handler: apiCreateToken},
+		{Method: "DELETE", Path: "/tokens/{id}", Summary: "Revoke a personal access token", OperationID: "revokeToken",
+			Params: []apiParam{{"id", "path", "integer", "token ID"}}, Status: http.StatusNoContent, Errors: []int{403, 404}, Handler: apiRevokeToken},
+		{Method: "GET", Path: "/changes", Summary: "Change journal for sync clients", OperationID: "getChanges",
+			Params: []apiParam{
+				{"cursor", "query", "integer", "cursor from the previous page; omit to get the current position"},
+				{"limit", "query", "integer", "maximum number of changes"},
+			},
+			Status: http.StatusOK, Result: ChangesPage{}, Errors: []int{400, 410}, Handler: apiErrors(GetChanges)},
+		{Method: "GET", Path: "/openapi.json", Summary: "This document", Public: true, OperationID: "getOpenAPI",
+			Status: http.StatusOK, Handler: apiOpenAPI},
+	}
+}
+
+func registerAPI(mux *http.ServeMux) {
+	for _, rt := range apiRoutes() {
+		h := rt.Handler
+		if !rt.Public {
+			h = apiAuth(h)
+		}
+		mux.HandleFunc(rt.Method+" "+apiPrefix+rt.Path, h)
+		if strings.HasPrefix(rt.Path, fsPrefix) {
+			mux.HandleFunc(rt.Method+" "+rt.Path, h)
+		}
+	}
+	mux.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		apiError(w, http.StatusNotFound, "", "no such endpoint")
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:                   "bad_request",
+	http.StatusUnauthorized:                 "unauthorized",
+	http.StatusForbidden:                    "forbidden",
+	http.StatusNotFound:                     "not_found",
+	http.StatusMethodNotAllowed:             "method_not_allowed",
+	http.StatusConflict:                     "conflict",
+	http.StatusGone:                         "gone",
+	http.StatusPreconditionFailed:           "precondition_failed",
+	http.StatusRequestEntityTooLarge:        "too_large",
+	http.StatusUnsupportedMediaType:         "unsupported_media_type",
+	http.StatusTooManyRequests:              "rate_limited",
+	http.StatusRequestedRangeNotSatisfiable: "range_not_satisfiable",
+}
+
+// apiError writes the error envelope. An empty code is derived from the
+// status.
+func apiError(w http.ResponseWriter, status int, code, message string) {
+	if code == "" {
+		code = errorCodes[status]
+	}
+	if code == "" {
+		code = "internal_error"
+	}
+	writeJSON(w, status, ErrorResponse{Error: ErrorDetail{Code: code, Message: message}})
+}
+
+// apiNodeError reports the errors of the shared node operations.
+func apiNodeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errFolderExists):
+		apiError(w, http.StatusConflict, "folder_exists", "a folder with that name already exists")
+	case errors.Is(err, errConflict), errors.Is(err, errMoved):
+		apiError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, errNoDestination):
+		apiError(w, http.StatusNotFound, "", err.Error())
+	case errors.Is(err, errIntoSelf):
+		apiError(w, http.StatusBadRequest, "invalid_destination", err.Error())
+	case errors.Is(err, errPathNotFound):
+		apiError(w, http.StatusNotFound, "", err.Error())
+	case errors.Is(err, errNotFolder):
+		apiError(w, http.StatusConflict, "not_a_folder", err.Error())
+	case errors.Is(err, errInvalidPath):
+		apiError(w, http.StatusBadRequest, "invalid_path", err.Error())
+	case errors.Is(err, errOutsideFolder):
+		apiError(w, http.StatusForbidden, "outside_token_folder", err.Error())
+	case errors.Is(err, errInvalidName):
+		apiError(w, http.StatusBadRequest, "invalid_name", err.Error())
+	case errors.Is(err, errConflictPolicy):
+		apiError(w, http.StatusBadRequest, "invalid_conflict", err.Error())
+	case errors.Is(err, errModified):
+		apiError(w, http.StatusPreconditionFailed, "", "file was modified since last sync")
+	case errors.Is(err, errTooManyJobs):
+		apiError(w, http.StatusTooManyRequests, "", err.Error())
+	default:
+		apiError(w, http.StatusInternalServerError, "", err.Error())
+	}
+}
+
+// envelopeWriter turns the plain-text errors of handlers shared with the
+// old endpoints (and of http.ServeContent) into the error envelope.
+type envelopeWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (e *envelopeWriter) WriteHeader(code int) {
+	if code >= 400 && strings.HasPrefix(e.Header().Get("Content-Type"), "text/plain") {
+		e.status = code
+		return
+	}
+	e.ResponseWriter.WriteHeader(code)
+}
+
+func (e *envelopeWriter) Write(p []byte) (int, error) {
+	if e.status != 0 {
+		return e.body.Write(p)
+	}
+	return e.ResponseWriter.Write(p)
+}
+
+func apiErrors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ew := &envelopeWriter{ResponseWriter: w}
+		next(ew, r)
+		if ew.status != 0 {
+			w.Header().Del("X-Content-Type-Options")
+			apiError(w, ew.status, "", strings.TrimSpace(ew.body.String()))
+		}
+	}
+}
+
+func apiAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r) {
+			apiError(w, http.StatusUnauthorized, "", "authentication required")
+			return
+		}
+		if !scopeAllows(r) {
+			apiError(w, http.StatusForbidden, "insufficient_scope", "token scope does not allow this request")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return false
+	}
+	return true
+}
+
+func apiThrottled(w http.ResponseWriter, r *http.Request, limit int, usernames ...string) bool {
+	if wait := allowRequest(r, throttleAuth, limit, usernames...); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		apiError(w, http.StatusTooManyRequests, "", "too many requests, try again later")
+		return true
+	}
+	return false
+}
+
+func sessionOf(user User) Session {
+	return Session{UserID: user.ID, Username: user.Username, IsAdmin: user.IsAdmin}
+}
+
+func apiCreateUser(w http.ResponseWriter, r *http.Request) {
+	if !passwordLoginEnabled() {
+		apiError(w, http.StatusForbidden, "password_login_disabled", "password login is disabled")
+		return
+	}
+	var req Credentials
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Username) == "" || strings.TrimSpace(req.Password) == "" {
+		apiError(w, http.StatusBadRequest, "", "username and password required")
+		return
+	}
+	if apiThrottled(w, r, getLimits().authRate) {
+		return
+	}
+	user, err := createUser(req.Username, req.Password)
+	if errors.Is(err, errUserExists) {
+		apiError(w, http.StatusConflict, "username_taken", err.Error())
+		return
+	}
+	if errors.Is(err, errWeakPassword) {
+		apiError(w, http.StatusBadRequest, "weak_password", err.Error())
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if err := startSession(w, user); err != nil {
+		apiError(w, http.StatusInternalServerError, "", "failed to generate token")
+		return
+	}
+	writeJSON(w, http.StatusCreated, sessionOf(user))
+}
+
+func apiLogin(w http.ResponseWriter, r *http.Request) {
+	if !passwordLoginEnabled() {
+		apiError(w, http.StatusForbidden, "password_login_disabled", "password login is disabled")
+		return
+	}
+	var req Credentials
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if apiThrottled(w, r, getLimits().authRate, req.Username) {
+		return
+	}
+	user, ok := checkLogin(req.Username, req.Password)
+	if !ok {
+		recordFailure(r, throttleAuth, req.Username)
+		apiError(w, http.StatusUnauthorized, "invalid_credentials", "invalid credentials")
+		return
+	}
+	recordSuccess(r, req.Username)
+	if err := startSession(w, user); err != nil {
+		apiError(w, http.StatusInternalServerError, "", "failed to generate token")
+		return
+	}
+	writeJSON(w, http.StatusOK, sessionOf(user))
+}
+
+func apiLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiMe(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromRequest(r)
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		apiError(w, http.StatusUnauthorized, "", "account not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, sessionOf(user))
+}
+
+// passwordErrorCode names the password errors for programs.
+func passwordErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errWeakPassword):
+		return "weak_password"
+	case errors.Is(err, errWrongPassword):
+		return "invalid_credentials"
+	case errors.Is(err, errNoLocalPassword):
+		return "no_local_password"
+	case errors.Is(err, errResetToken):
+		return "invalid_reset_token"
+	}
+	return ""
+}
+
+func apiChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := apiSessionOnly(w, r)
+	if !ok {
+		return
+	}
+	var req PasswordChangeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		apiError(w, http.StatusUnauthorized, "", "account not found")
+		return
+	}
+	if apiThrottled(w, r, getLimits().authRate, user.Username) {
+		return
+	}
+	if err := changePassword(r, &user, req); err != nil {
+		apiError(w, passwordErrorStatus(err), passwordErrorCode(err), err.Error())
+		return
+	}
+	if err := startSession(w, user); err != nil {
+		apiError(w, http.StatusInternalServerError, "", "failed to generate token")
+		return
+	}
+	writeJSON(w, http.StatusOK, sessionOf(user))
+}
+
+func apiResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if apiThrottled(w, r, getLimits().authRate) {
+		return
+	}
+	if _, err := redeemPasswordReset(r, req); err != nil {
+		apiError(w, passwordErrorStatus(err), passwordErrorCode(err), err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiNode loads the node named by the {id} path parameter.
+func apiNode(w http.ResponseWriter, r *http.Request) (Node, uint, bool) {
+	userID, _ := getUserIDFromRequest(r)
+	var node Node
+	if idStr := r.PathValue("id"); idStr == "root" {
+		if node = rootFor(r, userID); node.ID == 0 {
+			apiError(w, http.StatusNotFound, "", "root folder not found")
+			return node, userID, false
+		}
+	} else if id, err := strconv.ParseUint(idStr, 10, 64); err != nil || db.First(&node, "id = ? AND user_id = ?", id, userID).Error != nil {
+		apiError(w, http.StatusNotFound, "", "node not found")
+		return node, userID, false
+	}
+	if !apiNodeAllowed(w, r, node) {
+		return node, userID, false
+	}
+	return node, userID, true
+}
+
+func apiNodeAllowed(w http.ResponseWriter, r *http.Request, node Node) bool {
+	if !nodeAllowed(r, node) {
+		apiError(w, http.StatusForbidden, "outside_token_folder", "token is restricted to another folder")
+		return false
+	}
+	return true
+}
+
+func writeNode(w http.ResponseWriter, code int, id uint, userID uint) {
+	var node Node
+	if err := db.First(&node, "id = ? AND user_id = ?", id, userID).Error; err != nil {
+		apiError(w, http.StatusNotFound, "", "node not found")
+		return
+	}
+	if err := listChildren(&node, userID, listOptions{sort: "name", foldersFirst: true}); err != nil {
+		apiError(w, http.StatusInternalServerError, "", "failed to list folder")
+		return
+	}
+	nodeView(&node, userID)
+	writeJSON(w, code, node)
+}
+
+func apiGetNode(w http.ResponseWriter, r *http.Request) {
+	node, userID, ok := apiNode(w, r)
+	if !ok {
+		return
+	}
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_listing", err.Error())
+		return
+	}
+	if err := writeListing(w, r, node, userID, opts); err != nil {
+		apiError(w, http.StatusInternalServerError, "", "failed to list folder")
+	}
+}
+
+func apiCreateNode(w http.ResponseWriter, r *http.Request) {
+	parent, userID, ok := apiNode(w, r)
+	if !ok {
+		return
+	}
+	if !parent.IsDir {
+		apiError(w, http.StatusBadRequest, "not_a_folder", "parent is not a folder")
+		return
+	}
+	var name string
+	var isDir bool
+	var reader io.Reader
+	switch ct := r.Header.Get("Content-Type"); {
+	case strings.HasPrefix(ct, "multipart/form-data"):
+		if err := r.ParseMultipartForm(1024 << 20); err != nil {
+			apiError(w, http.StatusBadRequest, "", "failed to parse multipart form: "+err.Error())
+			return
+		}
+		file, fh, err := r.FormFile("file")
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "", "missing file: "+err.Error())
+			return
+		}
+		defer file.Close()
+		name = r.FormValue("name")
+		if name == "" {
+			name = fh.Filename
+		}
+		reader = file
+	case strings.HasPrefix(ct, "application/json"):
+		var req NodeCreateRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		name, isDir = req.Name, req.IsDir
+		if !isDir {
+			reader = strings.NewReader("")
+		}
+	default:
+		apiError(w, http.StatusUnsupportedMediaType, "", "use multipart/form-data for files or application/json for folders")
+		return
+	}
+	name, err := cleanName(name)
+	if err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	policy, err := conflictPolicy(q.Get("conflict"), q.Get("overwrite") == "true" || q.Get("overwrite") == "1")
+	if err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	policy = uploadPolicy(r, policy)
+	if existing, ok := findChildByName(parent.ID, name, userID); ok && policy == conflictOverwrite && (isDir || existing.IsDir) {
+		apiError(w, http.StatusConflict, "conflict", "the folder already contains an entry with that name")
+		return
+	}
+	var id uint
+	if isDir {
+		id, err = UploadNode(name, reader, true, &parent.ID, userID, policy)
+	} else {
+		id, err = uploadFileNode(name, reader, &parent.ID, userID, policy, strings.Trim(r.Header.Get("If-Match"), `"`))
+	}
+	switch {
+	case errors.Is(err, errSkipped):
+		writeNode(w, http.StatusOK, id, userID)
+	case err != nil:
+		apiNodeError(w, err)
+	default:
+		writeNode(w, http.StatusCreated, id, userID)
+	}
+}
+
+func apiGetContent(w http.ResponseWriter, r *http.Request) {
+	node, _, ok := apiNode(w, r)
+	if !ok {
+		return
+	}
+	if node.Fid == nil {
+		apiError(w, http.StatusBadRequest, "not_a_file", "node is a folder")
+		return
+	}
+	apiErrors(func(w http.ResponseWriter, r *http.Request) {
+		if err := serveNode(w, r, node); err != nil {
+			apiError(w, http.StatusInternalServerError, "", "failed to open file")
+		}
+	})(w, r)
+}
+
+func apiPutContent(w http.ResponseWriter, r *http.Request) {
+	node, userID, ok := apiNode(w, r)
+	if !ok {
+		return
+	}
+	if node.Fid == nil {
+		apiError(w, http.StatusBadRequest, "not_a_file", "node is a folder")
+		return
+	}
+	if err := replaceContent(&node, r.Body, strings.Trim(r.Header.Get("If-Match"), `"`)); err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	writeNode(w, http.StatusOK, node.ID, userID)
+}
+
+func apiUpdateNode(w http.ResponseWriter, r *http.Request) {
+	node, userID, ok := apiNode(w, r)
+	if !ok {
+		return
+	}
+	var req NodeUpdateRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if node.OyaID == nil {
+		apiError(w, http.StatusBadRequest, "root_folder", "the root folder cannot be renamed or moved")
+		return
+	}
+	name, parentID := node.Name, *node.OyaID
+	if req.Name != nil {
+		var err error
+		if name, err = cleanName(*req.Name); err != nil {
+			apiNodeError(w, err)
+			return
+		}
+	}
+	policy, err := conflictPolicy(req.Conflict, req.Overwrite)
+	if err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	if req.ParentID != nil {
+		parentID = *req.ParentID
+		if parentID == node.ID || isAncestor(node.ID, parentID, userID) {
+			apiNodeError(w, errIntoSelf)
+			return
+		}
+		if _, err := destinationFolder(parentID, userID); err != nil {
+			apiNodeError(w, err)
+			return
+		}
+		if !apiNodeAllowed(w, r, Node{ID: parentID, UserID: userID}) {
+			return
+		}
+	}
+	id, err := moveNodeAs(node, parentID, name, userID, policy)
+	if err != nil && !errors.Is(err, errSkipped) {
+		apiNodeError(w, err)
+		return
+	}
+	writeNode(w, http.StatusOK, id, userID)
+}
+
+func apiDeleteNode(w http.ResponseWriter, r *http.Request) {
+	node, userID, ok := apiNode(w, r)
+	if !ok {
+		return
+	}
+	if node.OyaID == nil {
+		apiError(w, http.StatusBadRequest, "root_folder", "the root folder cannot be deleted")
+		return
+	}
+	if err := DeleteNodeRecursive(node.ID, userID); err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiCopyNode(w http.ResponseWriter, r *http.Request) {
+	node, userID, ok := apiNode(w, r)
+	if !ok {
+		return
+	}
+	var req NodeCopyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !apiNodeAllowed(w, r, Node{ID: req.ParentID, UserID: userID}) {
+		return
+	}
+	policy, err := conflictPolicy(req.Conflict, req.Overwrite)
+	if err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	id, err := copyNodeTo(node, req.ParentID, userID, policy, nil)
+	switch {
+	case errors.Is(err, errSkipped):
+		writeNode(w, http.StatusOK, id, userID)
+	case err != nil:
+		apiNodeError(w, err)
+	default:
+		writeNode(w, http.StatusCreated, id, userID)
+	}
+}
+
+func apiShareNode(w http.ResponseWriter, r *http.Request) {
+	node, userID, ok := apiNode(w, r)
+	if !ok {
+		return
+	}
+	var share Share
+	if err := db.First(&share, "node_id = ? AND user_id = ?", node.ID, userID).Error; err != nil {
+		share = Share{Token: generateShareToken(), NodeID: node.ID, UserID: userID}
+		if err := db.Create(&share).Error; err != nil {
+			apiError(w, http.StatusInternalServerError, "", "failed to create share")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, ShareInfo{Token: share.Token, URL: "/s/" + share.Token})
+}
+
+func apiUnshareNode(w http.ResponseWriter, r *http.Request) {
+	node, userID, ok := apiNode(w, r)
+	if !ok {
+		return
+	}
+	res := db.Where("node_id = ? AND user_id = ?", node.ID, userID).Delete(&Share{})
+	if res.Error != nil {
+		apiError(w, http.StatusInternalServerError, "", "failed to delete share")
+		return
+	}
+	if res.RowsAffected == 0 {
+		apiError(w, http.StatusNotFound, "", "node is not shared")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiSessionOnly keeps tokens from managing tokens or the password.
+func apiSessionOnly(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	userID, _ := getUserIDFromRequest(r)
+	if isTokenRequest(r) {
+		apiError(w, http.StatusForbidden, "", "only available from a login session")
+		return userID, false
+	}
+	return userID, true
+}
+
+func apiListTokens(w http.ResponseWriter, r *http.Request) {
+	if userID, ok := apiSessionOnly(w, r); ok {
+		writeJSON(w, http.StatusOK, listAccessTokens(userID))
+	}
+}
+
+func apiCreateToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := apiSessionOnly(w, r)
+	if !ok {
+		return
+	}
+	var req AccessTokenRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	nt, err := createAccessToken(userID, req)
+	if err != nil {
+		apiError(w, tokenErrorStatus(err), "", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, nt)
+}
+
+func apiRevokeToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := apiSessionOnly(w, r)
+	if !ok {
+		return
+	}
+	res := db.Where("id = ? AND user_id = ?", r.PathValue("id"), userID).Delete(&AccessToken{})
+	if res.Error != nil {
+		apiError(w, http.StatusInternalServerError, "", "failed to revoke token")
+		return
+	}
+	if res.RowsAffected == 0 {
+		apiError(w, http.StatusNotFound, "", "token not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPIDoc())
+}
+
+// openAPIDoc generates the OpenAPI 3 description of the route table, with
+// schemas derived from the Go types' JSON tags.
+func openAPIDoc() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+	errRef := schemaOf(reflect.TypeOf(ErrorResponse{}), schemas)
+	for _, rt := range apiRoutes() {
+		op := map[string]interface{}{"summary": rt.Summary, "operationId": rt.OperationID}
+		var params []interface{}
+		for _, p := range rt.Params {
+			params = append(params, map[string]interface{}{
+				"name": p.Name, "in": p.In, "required": p.In == "path",
+				"description": p.Description, "schema": map[string]string{"type": p.Type},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if rt.Body != nil {
+			ct := rt.BodyType
+			if ct == "" {
+				ct = "application/json"
+			}
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{ct: map[string]interface{}{"schema": schemaOf(reflect.TypeOf(rt.Body), schemas)}},
+			}
+		}
+		ok := map[string]interface{}{"description": http.StatusText(rt.Status)}
+		if rt.Result != nil {
+			ct := rt.ResultType
+			if ct == "" {
+				ct = "application/json"
+			}
+			ok["content"] = map[string]interface{}{ct: map[string]interface{}{"schema": schemaOf(reflect.TypeOf(rt.Result), schemas)}}
+		} else if rt.Path == "/openapi.json" {
+			ok["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]string{"type": "object"}}}
+		}
+		responses := map[string]interface{}{strconv.Itoa(rt.Status): ok}
+		errs := rt.Errors
+		if !rt.Public {
+			errs = append(errs, http.StatusUnauthorized)
+		}
+		for _, code := range errs {
+			responses[strconv.Itoa(code)] = map[string]interface{}{
+				"description": http.StatusText(code),
+				"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": errRef}},
+			}
+		}
+		op["responses"] = responses
+		if !rt.Public {
+			op["security"] = []map[string][]string{{"cookieAuth": {}}, {"bearerAuth": {}}}
+		}
+		// OpenAPI has no rest-of-path wildcards; {path...} becomes {path}.
+		path := apiPrefix + strings.ReplaceAll(rt.Path, "...}", "}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(rt.Method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]string{"title": "HaNas API", "version": "1"},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"cookieAuth": map[string]string{"type": "apiKey", "in": "cookie", "name": "token"},
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer", "description": "personal access token"},
+			},
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// structProps adds the JSON fields of t to props, flattening embedded
+// structs the way encoding/json does, and returns the required ones.
+func structProps(t reflect.Type, props map[string]interface{}, schemas map[string]interface{}) []string {
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			required = append(required, structProps(f.Type, props, schemas)...)
+			continue
+		}
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaOf(f.Type, schemas)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	return required
+}
+
+// schemaOf returns the schema for t, adding named structs to schemas and
+// referring to them so recursive types like Node work.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		s := schemaOf(t.Elem(), schemas)
+		if _, isRef := s["$ref"]; !isRef {
+			s["nullable"] = true
+		}
+		return s
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]interface{}{"type": "string", "format": "binary"}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, seen := schemas[t.Name()]; seen {
+			return ref
+		}
+		schemas[t.Name()] = nil
+		props := map[string]interface{}{}
+		required := structProps(t, props, schemas)
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if required != nil {
+			s["required"] = required
+		}
+		schemas[t.Name()] = s
+		return ref
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	newTestDB(t)
+	srv := newAPIServer(t)
+	resp, b := apiCall(t, srv, nil, "GET", apiPrefix+"/openapi.json", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("openapi.json: %d %s", resp.StatusCode, b)
+	}
+	var doc struct {
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, rt := range apiRoutes() {
+		path := apiPrefix + strings.ReplaceAll(rt.Path, "...}", "}")
+		op, ok := doc.Paths[path][strings.ToLower(rt.Method)]
+		if !ok {
+			t.Errorf("%s %s is not documented", rt.Method, path)
+			continue
+		}
+		if rt.OperationID == "" || op["operationId"] != rt.OperationID {
+			t.Errorf("%s %s: operationId %v", rt.Method, path, op["operationId"])
+		}
+		responses, _ := op["responses"].(map[string]interface{})
+		if _, ok := responses["401"]; !ok && !rt.Public {
+			t.Errorf("%s %s: 401 is not documented", rt.Method, path)
+		}
+	}
+	// Every schema reference resolves.
+	for _, ref := range strings.Split(string(b), `"$ref":"#/components/schemas/`)[1:] {
+		name, _, _ := strings.Cut(ref, `"`)
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("schema %s is referenced but not defined", name)
+		}
+	}
+}
+
+func TestAPIErrorsAreJSON(t *testing.T) {
+	newTestDB(t)
+	srv := newAPIServer(t)
+	user, _ := newTestUser(t, "alice")
+	for _, tc := range []struct {
+		user         *User
+		method, path string
+		body         string
+		status       int
+		code         string
+	}{
+		{nil, "GET", "/me", "", http.StatusUnauthorized, "unauthorized"},
+		{nil, "GET", "/no/such/endpoint", "", http.StatusNotFound, "not_found"},
+		{nil, "POST", "/session", "{", http.StatusBadRequest, "invalid_json"},
+		{nil, "POST", "/session", `{"username":"alice","password":"wrong"}`, http.StatusUnauthorized, "invalid_credentials"},
+		{&user, "GET", "/nodes/999999", "", http.StatusNotFound, "not_found"},
+		{&user, "GET", "/changes?cursor=x", "", http.StatusBadRequest, "bad_request"},
+		{&user, "DELETE", "/jobs/nope", "", http.StatusNotFound, "not_found"},
+	} {
+		var body io.Reader
+		if tc.body != "" {
+			body = strings.NewReader(tc.body)
+		}
+		resp, b := apiCall(t, srv, tc.user, tc.method, apiPrefix+tc.path, body)
+		var e ErrorResponse
+		if err := json.Unmarshal(b, &e); err != nil || resp.StatusCode != tc.status || e.Error.Code != tc.code || e.Error.Message == "" {
+			t.Errorf("%s %s: %d %s, want %d with code %s", tc.method, tc.path, resp.StatusCode, b, tc.status, tc.code)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type %q", tc.method, tc.path, ct)
+		}
+	}
+}
@@ -2,22 +2,26 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	_ "embed"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"image"
 	_ "image/gif"
 	"image/jpeg"
 	_ "image/png"
 	"io"
-	mrand "math/rand"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,7 +31,9 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/nfnt/resize"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/unicode/norm"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 const (
@@ -37,8 +43,6 @@ const (
 	programName = "HaNas"
 )
 
-var jwtSecret string
-
 var db *gorm.DB
 
 var (
@@ -48,10 +52,21 @@ var (
 	}{m: make(map[uint]*sync.RWMutex)}
 	nodeLocks = struct {
 		sync.RWMutex
-		m map[uint]*sync.Mutex
-	}{m: make(map[uint]*sync.Mutex)}
+		m map[uint]*folderLock
+	}{m: make(map[uint]*folderLock)}
 	uploadMutex    sync.Mutex
 	thumbnailMutex sync.Map
+	// fids handed out by UploadFile whose blob is still being written
+	reservedFids = make(map[uint]bool)
+)
+
+var (
+	errFolderExists  = errors.New("folder_exists")
+	errConflict      = errors.New("conflict: destination already contains an entry with same name")
+	errNoDestination = errors.New("destination folder not found")
+	errIntoSelf      = errors.New("cannot move into self or descendant")
+	errModified      = errors.New("conflict: file was modified since last sync")
+	errMoved         = errors.New("conflict: the entry was moved meanwhile")
 )
 
 type Config struct {
@@ -64,12 +79,22 @@ type User struct {
 	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
 	Username  string    `gorm:"uniqueIndex;not null" json:"username"`
 	Password  string    `gorm:"not null" json:"-"`
+	IsAdmin   bool      `gorm:"not null;default:false" json:"is_admin"`
 	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	// OIDCSubject links accounts created by single sign-on to the
+	// provider's "issuer subject"; they have no password.
+	OIDCSubject *string `gorm:"column:oidc_subject;uniqueIndex" json:"-"`
+	// LDAPDN links accounts created from the directory to their entry.
+	LDAPDN *string `gorm:"column:ldap_dn;uniqueIndex" json:"-"`
+	// TokenVersion is raised when the password changes; sessions issued
+	// with an older version are no longer accepted.
+	TokenVersion int `gorm:"not null;default:0" json:"-"`
 }
 
 type Claims struct {
 	UserID   uint   `json:"user_id"`
 	Username string `json:"username"`
+	Version  int    `json:"ver,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -82,18 +107,28 @@ type Share struct {
 	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
+// Node is a file or folder. Sizes and FileCount of a folder are totals of
+// its subtree.
 type Node struct {
 	ID         uint      `gorm:"primaryKey;autoIncrement" json:"id"`
 	UserID     uint      `gorm:"not null;index" json:"user_id"`
 	Fid        *uint     `gorm:"uniqueIndex;check:((is_dir = true AND fid IS NULL) OR (is_dir = false AND fid IS NOT NULL))" json:"-"`
 	Name       string    `gorm:"not null" json:"name"`
-	IsDir      bool      `gorm:"not null" json:"is_dir"`
-	OyaID      *uint     `gorm:"index" json:"oya_id,omitempty"`
+	IsDir      bool      `gorm:"not null;index:idx_nodes_listing,priority:2,sort:desc" json:"is_dir"`
+	OyaID      *uint     `gorm:"index;index:idx_nodes_listing,priority:1" json:"oya_id,omitempty"`
 	Ko         []Node    `gorm:"foreignKey:OyaID;references:ID;constraint:OnDelete:CASCADE" json:"ko,omitempty"`
 	UpdatedAt  time.Time `gorm:"autoUpdateTime" json:"updated_at"`
-	Size       int64     `gorm:"-" json:"size,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	Ancestry   string    `gorm:"not null;default:'';index" json:"-"`
+	MimeType   string    `json:"mime_type,omitempty"`
+	Size       int64     `gorm:"not null;default:0" json:"size,omitempty"`
+	StoredSize int64     `gorm:"not null;default:0" json:"stored_size,omitempty"`
+	FileCount  int64     `gorm:"not null;default:0" json:"file_count,omitempty"`
+	SortName   string    `gorm:"not null;default:'';index:idx_nodes_listing,priority:3" json:"-"`
+	SortExt    string    `gorm:"not null;default:''" json:"-"`
 	Path       string    `gorm:"-" json:"path,omitempty"`
 	ShareToken string    `gorm:"-" json:"share_token,omitempty"`
+	NextCursor string    `gorm:"-" json:"next_cursor,omitempty"`
 }
 
 func (n Node) to_json() []byte {
@@ -101,89 +136,174 @@ func (n Node) to_json() []byte {
 	return data
 }
 
-func (n Node) return_file() []byte {
-	if n.Fid == nil {
-		return nil
+// configValue looks a setting up in the environment first (HANAS_<KEY>) and
+// then in the config table, so deployments can override stored values.
+func configValue(key, def string) string {
+	if v := os.Getenv("HANAS_" + strings.ToUpper(key)); v != "" {
+		return v
 	}
-	p := dataDir + "/" + fmt.Sprintf("%d", *n.Fid)
-	data, _ := os.ReadFile(p)
-	return data
+	if db == nil {
+		return def
+	}
+	// Find instead of First: a missing key is normal and not worth a log line.
+	var configs []Config
+	if err := db.Where("key = ?", key).Limit(1).Find(&configs).Error; err == nil && len(configs) > 0 {
+		return configs[0].Value
+	}
+	return def
 }
 
 func return_root(userID uint) Node {
 	var root Node
-	db.Preload("Ko").First(&root, "oya_id IS NULL AND user_id = ?", userID)
+	db.First(&root, "oya_id IS NULL AND user_id = ?", userID)
 	return root
 }
 
 func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	bcryptSlots <- struct{}{}
+	defer func() { <-bcryptSlots }()
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), getPasswordPolicy().cost)
 	return string(bytes), err
 }
 
 func checkPasswordHash(password, hash string) bool {
+	bcryptSlots <- struct{}{}
+	defer func() { <-bcryptSlots }()
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
 
-func initJWTSecret() error {
-	var config Config
-	if err := db.First(&config, "key = ?", "jwt_secret").Error; err != nil {
-		b := make([]byte, 32)
-		for i := range b {
-			b[i] = byte(mrand.Intn(256))
-		}
-		jwtSecret = base64.StdEncoding.EncodeToString(b)
-		config = Config{
-			Key:   "jwt_secret",
-			Value: jwtSecret,
-		}
-		if err := db.Create(&config).Error; err != nil {
-			return fmt.Errorf("failed to save jwt secret: %w", err)
-		}
-		fmt.Println("Generated new JWT secret")
-	} else {
-		jwtSecret = config.Value
-		fmt.Println("Loaded JWT secret from database")
-	}
-	return nil
-}
-
-func generateToken(userID uint, username string) (string, error) {
+func generateToken(user User) (string, error) {
 	claims := &Claims{
-		UserID:   userID,
-		Username: username,
+		UserID:   user.ID,
+		Username: user.Username,
+		Version:  user.TokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(876000 * time.Hour)), // ~100 years
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
+	key := currentSigningKey()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(jwtSecret))
+	token.Header["kid"] = key.ID
+	return token.SignedString([]byte(key.Secret))
+}
+
+// authenticate checks the session cookie or a personal access token and
+// passes the user on to handlers in the X-User-ID and X-Username headers.
+func authenticate(r *http.Request) bool {
+	r.Header.Del("X-Token-Scope")
+	r.Header.Del("X-Token-Folder")
+	if secret, ok := bearerToken(r); ok {
+		return authenticateToken(r, secret)
+	}
+	cookie, err := r.Cookie("token")
+	if err != nil {
+		return false
+	}
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(cookie.Value, claims, jwtKeyFunc, jwt.WithValidMethods([]string{"HS256"}))
+	if err != nil || !token.Valid {
+		return false
+	}
+	var users []User
+	db.Select("id", "token_version").Where("id = ?", claims.UserID).Limit(1).Find(&users)
+	if len(users) == 0 || users[0].TokenVersion != claims.Version {
+		return false
+	}
+	r.Header.Set("X-User-ID", fmt.Sprintf("%d", claims.UserID))
+	r.Header.Set("X-Username", claims.Username)
+	return true
+}
+
+// recentLogin is how old a session may be to confirm deleting an account
+// that has no password.
+const recentLogin = 10 * time.Minute
+
+// sessionAge returns how long ago the session of r logged in. Requests with
+// an access token have no session.
+func sessionAge(r *http.Request) (time.Duration, bool) {
+	cookie, err := r.Cookie("token")
+	if err != nil || isTokenRequest(r) {
+		return 0, false
+	}
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(cookie.Value, claims, jwtKeyFunc, jwt.WithValidMethods([]string{"HS256"})); err != nil || claims.IssuedAt == nil {
+		return 0, false
+	}
+	return time.Since(claims.IssuedAt.Time), true
 }
 
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("token")
-		if err != nil {
+		if !authenticate(r) {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		tokenStr := cookie.Value
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtSecret), nil
-		})
-		if err != nil || !token.Valid {
+		if !scopeAllows(r) {
+			http.Error(w, "Forbidden: token scope does not allow this request", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromRequest(r)
+		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		r.Header.Set("X-User-ID", fmt.Sprintf("%d", claims.UserID))
-		r.Header.Set("X-Username", claims.Username)
+		var user User
+		if err := db.First(&user, userID).Error; err != nil || !user.IsAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if _, restricted := tokenFolder(r); restricted {
+			http.Error(w, "Forbidden: token is restricted to a folder", http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
+	})
+}
+
+// ensureAdmin points out a database without an administrator, as created
+// before accounts had roles.
+func ensureAdmin() {
+	var count int64
+	db.Model(&User{}).Where("is_admin = ?", true).Count(&count)
+	if count > 0 {
+		return
+	}
+	var users int64
+	db.Model(&User{}).Count(&users)
+	if users > 0 {
+		fmt.Println("notice: no account is an administrator; run `hanas promote-admin <username>` to make one")
 	}
 }
 
+func promoteAdminCommand(args []string) int {
+	fs := flag.NewFlagSet("promote-admin", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: hanas promote-admin <username>")
+		return 2
+	}
+	var user User
+	if err := db.First(&user, "username = ?", fs.Arg(0)).Error; err != nil {
+		fmt.Fprintln(os.Stderr, "no such user:", fs.Arg(0))
+		return 1
+	}
+	if err := db.Model(&user).Update("is_admin", true).Error; err != nil {
+		fmt.Fprintln(os.Stderr, "cannot promote user:", err)
+		return 1
+	}
+	audit("admin_promoted", user.Username, "", "")
+	fmt.Printf("Promoted %s to administrator\n", user.Username)
+	return 0
+}
+
 func getUserIDFromRequest(r *http.Request) (uint, error) {
 	userIDStr := r.Header.Get("X-User-ID")
 	if userIDStr == "" {
@@ -196,176 +316,387 @@ func getUserIDFromRequest(r *http.Request) (uint, error) {
 	return uint(userID), nil
 }
 
-func UploadFile(reader io.Reader) (uint, error) {
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return 0, fmt.Errorf("cannot create data dir: %w", err)
+func fileLock(fid uint) *sync.RWMutex {
+	fileLocks.Lock()
+	defer fileLocks.Unlock()
+	lock, exists := fileLocks.m[fid]
+	if !exists {
+		lock = &sync.RWMutex{}
+		fileLocks.m[fid] = lock
 	}
+	return lock
+}
+
+// reserveFid picks an unused fid for a new blob. Call release once the
+// blob is written.
+func reserveFid() (fid uint, release func(), err error) {
 	uploadMutex.Lock()
-	r := mrand.New(mrand.NewSource(time.Now().UnixNano()))
-	var filename uint
+	defer uploadMutex.Unlock()
 	for {
-		filename = uint(r.Intn(100000000))
-		filepath := fmt.Sprintf("%s/%d", dataDir, filename)
-		file, err := os.OpenFile(filepath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		fid, err = randomFid()
 		if err != nil {
-			if os.IsExist(err) {
-				continue
-			}
-			uploadMutex.Unlock()
-			return 0, fmt.Errorf("cannot create file: %w", err)
+			return 0, nil, fmt.Errorf("cannot pick file name: %w", err)
 		}
-		uploadMutex.Unlock()
-		_, err = io.Copy(file, reader)
-		file.Close()
-		if err != nil {
-			os.Remove(filepath)
-			return 0, fmt.Errorf("cannot write file: %w", err)
+		if reservedFids[fid] {
+			continue
+		}
+		if _, err := store.Stat(blobKey(fid)); err == nil {
+			continue
+		} else if !isNotExist(err) {
+			return 0, nil, fmt.Errorf("cannot create file: %w", err)
 		}
-		break
+		reservedFids[fid] = true
+		return fid, func() {
+			uploadMutex.Lock()
+			delete(reservedFids, fid)
+			uploadMutex.Unlock()
+		}, nil
+	}
+}
+
+func UploadFile(reader io.Reader) (uint, string, error) {
+	filename, release, err := reserveFid()
+	if err != nil {
+		return 0, "", err
+	}
+	defer release()
+	h := sha256.New()
+	if _, err := store.Put(blobKey(filename), io.TeeReader(reader, h)); err != nil {
+		return 0, "", fmt.Errorf("cannot write file: %w", err)
 	}
-	return filename, nil
+	return filename, hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func UploadNode(filename string, reader io.Reader, isDir bool, oyaID *uint, userID uint) (uint, error) {
+// UploadNode creates a file or folder under the conflict policy; with skip
+// it returns the existing entry and errSkipped.
+func UploadNode(filename string, reader io.Reader, isDir bool, oyaID *uint, userID uint, policy string) (uint, error) {
+	filename = norm.NFC.String(filename)
+	if !isDir {
+		return uploadFileNode(filename, reader, oyaID, userID, policy, "")
+	}
+	if oyaID != nil {
+		defer lockFolders(*oyaID)()
+	}
+	var u unitOfWork
 	var nodeID uint
-	err := db.Transaction(func(tx *gorm.DB) error {
-		var existing Node
-		if err := tx.First(&existing, "name = ? AND oya_id = ? AND user_id = ?", filename, oyaID, userID).Error; err == nil {
-			if isDir {
-				if existing.IsDir {
-					nodeID = existing.ID
-					return nil
-				}
-				if err := DeleteNodeRecursive(existing.ID, userID); err != nil {
-					return err
-				}
-				newNode := Node{
-					UserID: userID,
-					Name:   filename,
-					IsDir:  true,
-					OyaID:  oyaID,
-				}
-				if res := tx.Create(&newNode); res.Error != nil {
-					return res.Error
-				}
-				nodeID = newNode.ID
-				return nil
-			}
-			if existing.IsDir {
-				return fmt.Errorf("folder_exists")
-			}
-			if !UpdateNode(existing.Fid, reader) {
-				return fmt.Errorf("failed to update existing node")
-			}
-			existing.UpdatedAt = time.Now()
-			if err := tx.Save(&existing).Error; err != nil {
-				return fmt.Errorf("failed to update timestamp: %w", err)
-			}
-			nodeID = existing.ID
-			return nil
+	err := u.commit(func(tx *gorm.DB) error {
+		var err error
+		nodeID, err = putFolder(&u, tx, filename, oyaID, userID, policy)
+		return err
+	})
+	return nodeID, err
+}
+
+// UploadPath is UploadNode to the relative path dir below oya, creating
+// missing folders in the same unit.
+func UploadPath(dir []string, filename string, reader io.Reader, isDir bool, oya Node, userID uint, policy, ifMatch string) (uint, error) {
+	filename = norm.NFC.String(filename)
+	node, n := walkFrom(db, oya, userID, dir)
+	if !node.IsDir {
+		return 0, errNotFolder
+	}
+	if n == len(dir) && !isDir {
+		return uploadFileNode(filename, reader, &node.ID, userID, policy, ifMatch)
+	}
+	if n == len(dir) {
+		return UploadNode(filename, reader, isDir, &node.ID, userID, policy)
+	}
+	if err := checkNewNames(dir[n:]); err != nil {
+		return 0, err
+	}
+	var u unitOfWork
+	var content Node
+	if !isDir {
+		var err error
+		if content, err = stageContent(&u, filename, reader); err != nil {
+			return 0, err
 		}
-		if isDir {
-			newNode := Node{
-				UserID: userID,
-				Name:   filename,
-				IsDir:  true,
-				OyaID:  oyaID,
-			}
-			if result := tx.Create(&newNode); result.Error != nil {
-				return result.Error
-			}
-			nodeID = newNode.ID
-			return nil
+	}
+	// The files of one folder upload arrive in parallel and all create
+	// their folders below oya, so they wait for each other there.
+	defer lockFolders(oya.ID, node.ID)()
+	var nodeID uint
+	err := u.commit(func(tx *gorm.DB) error {
+		parent, m := walkFrom(tx, node, userID, dir[n:])
+		if !parent.IsDir {
+			return errNotFolder
 		}
-		fid, err := UploadFile(reader)
+		parent, err := makeFolders(&u, tx, parent, dir[n+m:], userID)
 		if err != nil {
 			return err
 		}
-		newNode := Node{
-			UserID: userID,
-			Fid:    &fid,
-			Name:   filename,
-			IsDir:  false,
-			OyaID:  oyaID,
-		}
-		if result := tx.Create(&newNode); result.Error != nil {
-			return result.Error
+		if isDir {
+			nodeID, err = putFolder(&u, tx, filename, &parent.ID, userID, policy)
+			return err
 		}
-		nodeID = newNode.ID
-		return nil
+		nodeID, _, err = putFile(&u, tx, &parent.ID, filename, userID, content, policy, ifMatch)
+		return err
 	})
 	return nodeID, err
 }
 
-func UpdateNode(fid *uint, reader io.Reader) bool {
-	if fid == nil {
-		return false
-	}
-	fileLocks.Lock()
-	lock, exists := fileLocks.m[*fid]
-	if !exists {
-		lock = &sync.RWMutex{}
-		fileLocks.m[*fid] = lock
+// putFolder creates the folder name, or with overwrite merges it into the
+// folder already of that name.
+func putFolder(u *unitOfWork, tx *gorm.DB, name string, oyaID *uint, userID uint, policy string) (uint, error) {
+	if policy != conflictOverwrite && oyaID != nil {
+		var skipID uint
+		var err error
+		if name, skipID, err = claimName(u, tx, *oyaID, name, true, userID, policy, 0); err != nil {
+			return skipID, err
+		}
 	}
-	fileLocks.Unlock()
-	lock.Lock()
-	defer lock.Unlock()
-	filepath := fmt.Sprintf("%s/%d", dataDir, *fid)
-	tmpPath := filepath + ".tmp"
-	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	return createFolder(u, tx, name, oyaID, userID)
+}
+
+// createFolder returns the folder of that name, creating it and deleting a
+// file in its way if needed.
+func createFolder(u *unitOfWork, tx *gorm.DB, name string, oyaID *uint, userID uint) (uint, error) {
+	existing, ok, err := childByName(tx, oyaID, name, userID)
 	if err != nil {
-		return false
+		return 0, err
 	}
-	_, err = io.Copy(file, reader)
-	file.Close()
-	if err != nil {
-		os.Remove(tmpPath)
-		return false
+	if ok {
+		if existing.IsDir {
+			return existing.ID, nil
+		}
+		if err := deleteTree(u, tx, existing); err != nil {
+			return 0, err
+		}
 	}
-	if err := os.Rename(tmpPath, filepath); err != nil {
-		os.Remove(tmpPath)
-		return false
+	newNode := Node{
+		UserID: userID,
+		Name:   name,
+		IsDir:  true,
+		OyaID:  oyaID,
 	}
-	return true
+	if result := tx.Create(&newNode); result.Error != nil {
+		return 0, result.Error
+	}
+	return newNode.ID, recordChange(tx, changeCreate, newNode)
 }
 
-func CopyNode(src Node, newOyaID uint, userID uint) (uint, error) {
-	if src.IsDir {
-		newNode := Node{
-			UserID: userID,
-			Name:   src.Name,
-			IsDir:  true,
-			OyaID:  &newOyaID,
+// uploadFileNode stages the blob before the transaction opens: the store
+// keeps data keys in the database, and SQLite blocks those writes while
+// another transaction holds its lock.
+func uploadFileNode(filename string, reader io.Reader, oyaID *uint, userID uint, policy, ifMatch string) (uint, error) {
+	if existing, ok, _ := childByName(db, oyaID, filename, userID); ok {
+		if ifMatch != "" {
+			ensureHash(&existing)
 		}
-		if res := db.Create(&newNode); res.Error != nil {
-			return 0, res.Error
+		switch {
+		case policy == conflictSkip:
+			return existing.ID, errSkipped
+		case policy == conflictFail:
+			return 0, errConflict
+		case policy == conflictOverwrite && existing.IsDir:
+			return 0, errFolderExists
 		}
-		var children []Node
-		db.Where("oya_id = ? AND user_id = ?", src.ID, userID).Find(&children)
-		for _, c := range children {
-			_, err := CopyNode(c, newNode.ID, userID)
-			if err != nil {
-				fmt.Println("warning: copy child failed:", err)
-			}
-		}
-		return newNode.ID, nil
 	}
-	fid, err := UploadFile(bytes.NewReader(src.return_file()))
+	var u unitOfWork
+	content, err := stageContent(&u, filename, reader)
 	if err != nil {
 		return 0, err
 	}
+	if oyaID != nil {
+		defer lockFolders(*oyaID)()
+	}
+	var nodeID uint
+	err = u.commit(func(tx *gorm.DB) error {
+		var err error
+		nodeID, _, err = putFile(&u, tx, oyaID, filename, userID, content, policy, ifMatch)
+		return err
+	})
+	return nodeID, err
+}
+
+// stageContent stages the blob of a file called name and reads its sizes
+// and MIME type into a node that is not saved.
+func stageContent(u *unitOfWork, name string, reader io.Reader) (Node, error) {
+	fid, hash, err := u.upload(reader)
+	if err != nil {
+		return Node{}, err
+	}
+	content := Node{Name: name, Fid: &fid, Hash: hash}
+	fileMeta(&content)
+	return content, nil
+}
+
+// putFile creates the file name with the staged content, or overwrites it
+// if ifMatch allows. It reports whether it created the node.
+func putFile(u *unitOfWork, tx *gorm.DB, oyaID *uint, name string, userID uint, content Node, policy, ifMatch string) (uint, bool, error) {
+	existing, ok, err := childByName(tx, oyaID, name, userID)
+	if err != nil {
+		return 0, false, err
+	}
+	if ok && policy == conflictOverwrite {
+		if existing.IsDir {
+			return 0, false, errFolderExists
+		}
+		if err := checkIfMatch(existing, ifMatch); err != nil {
+			return 0, false, err
+		}
+		return existing.ID, false, setContent(u, tx, &existing, content)
+	}
+	if ok {
+		var skipID uint
+		if name, skipID, err = claimName(u, tx, *oyaID, name, false, userID, policy, 0); err != nil {
+			return skipID, false, err
+		}
+	}
 	newNode := Node{
-		UserID: userID,
-		Fid:    &fid,
-		Name:   src.Name,
-		IsDir:  false,
-		OyaID:  &newOyaID,
+		UserID:     userID,
+		Fid:        content.Fid,
+		Name:       name,
+		IsDir:      false,
+		OyaID:      oyaID,
+		Hash:       content.Hash,
+		Size:       content.Size,
+		StoredSize: content.StoredSize,
+		MimeType:   content.MimeType,
+	}
+	if result := tx.Create(&newNode); result.Error != nil {
+		return 0, false, result.Error
+	}
+	return newNode.ID, true, recordChange(tx, changeCreate, newNode)
+}
+
+// setContent points a file node at staged content, reading the old blob
+// back inside the transaction.
+func setContent(u *unitOfWork, tx *gorm.DB, n *Node, content Node) error {
+	var current Node
+	if err := tx.Select("fid", "size", "stored_size").First(&current, n.ID).Error; err != nil {
+		return err
 	}
-	result := db.Create(&newNode)
-	if result.Error != nil {
-		return 0, result.Error
+	if current.Fid != nil {
+		u.discard(*current.Fid)
+	}
+	n.Fid = content.Fid
+	n.Hash = content.Hash
+	n.Size, n.StoredSize, n.MimeType = content.Size, content.StoredSize, content.MimeType
+	n.UpdatedAt = time.Now()
+	if err := tx.Omit("ancestry").Save(n).Error; err != nil {
+		return fmt.Errorf("failed to update file: %w", err)
+	}
+	if err := addToAncestors(tx, n.Ancestry, n.Size-current.Size, n.StoredSize-current.StoredSize, 0); err != nil {
+		return err
+	}
+	return recordChange(tx, changeModify, *n)
+}
+
+// replaceContent overwrites the content of an existing file node, if it
+// still has the hash ifMatch when that is given.
+func replaceContent(existing *Node, reader io.Reader, ifMatch string) error {
+	if ifMatch != "" {
+		ensureHash(existing)
+	}
+	var u unitOfWork
+	content, err := stageContent(&u, existing.Name, reader)
+	if err != nil {
+		return err
+	}
+	if existing.OyaID != nil {
+		defer lockFolders(*existing.OyaID)()
+	}
+	return u.commit(func(tx *gorm.DB) error {
+		var current Node
+		if err := tx.First(&current, existing.ID).Error; err != nil {
+			return err
+		}
+		if err := checkIfMatch(current, ifMatch); err != nil {
+			return err
+		}
+		return setContent(&u, tx, existing, content)
+	})
+}
+
+// checkIfMatch fails with errModified if ifMatch is given and is not the
+// file's hash. Sync clients send the hash they last saw so that overwriting
+// a file changed elsewhere in the meantime is reported as a conflict.
+// Only the stored hash is compared, as this runs inside the write
+// transaction; callers backfill it with ensureHash beforehand.
+func checkIfMatch(n Node, ifMatch string) error {
+	if ifMatch != "" && n.Hash != ifMatch {
+		return errModified
+	}
+	return nil
+}
+
+// treeCopy is a subtree whose file contents were staged ahead of the
+// transaction that creates the copied nodes.
+type treeCopy struct {
+	nodes   []Node        // parents before children
+	content map[uint]Node // staged content by source node ID
+}
+
+// stageCopy copies the blobs of src's subtree. With a job, failed files are
+// reported and left out.
+func stageCopy(u *unitOfWork, src Node, j *Job) (*treeCopy, error) {
+	nodes := []Node{src}
+	if src.IsDir {
+		var err error
+		if nodes, err = subtreeNodes(db, src); err != nil {
+			return nil, err
+		}
+	}
+	c := &treeCopy{content: make(map[uint]Node)}
+	for _, n := range nodes {
+		if n.IsDir {
+			c.nodes = append(c.nodes, n)
+			continue
+		}
+		if j != nil {
+			if err := j.stopped(); err != nil {
+				return nil, err
+			}
+		}
+		fid, hash, err := u.copyBlob(*n.Fid, n.Hash)
+		if err != nil {
+			if j == nil || n.ID == src.ID {
+				return nil, fmt.Errorf("%s: %w", n.Name, err)
+			}
+			j.fail(n, err)
+			continue
+		}
+		content := Node{Fid: &fid, Hash: hash, MimeType: n.MimeType}
+		content.Size, content.StoredSize = blobSizes(&fid)
+		c.content[n.ID] = content
+		c.nodes = append(c.nodes, n)
+		if j != nil {
+			j.advance(1, n.Size)
+		}
 	}
-	return newNode.ID, nil
+	return c, nil
+}
+
+// create adds the copied nodes below newOyaID, the top one called name.
+func (c *treeCopy) create(tx *gorm.DB, newOyaID uint, name string, userID uint) (uint, error) {
+	ids := make(map[uint]uint, len(c.nodes))
+	for i, n := range c.nodes {
+		parent := newOyaID
+		if i > 0 {
+			parent = ids[*n.OyaID]
+		} else {
+			n.Name = name
+		}
+		newNode := Node{
+			UserID: userID,
+			Name:   n.Name,
+			IsDir:  n.IsDir,
+			OyaID:  &parent,
+		}
+		if content, ok := c.content[n.ID]; ok {
+			newNode.Fid, newNode.Hash, newNode.MimeType = content.Fid, content.Hash, content.MimeType
+			newNode.Size, newNode.StoredSize = content.Size, content.StoredSize
+		}
+		if result := tx.Create(&newNode); result.Error != nil {
+			return 0, result.Error
+		}
+		if err := recordChange(tx, changeCreate, newNode); err != nil {
+			return 0, err
+		}
+		ids[n.ID] = newNode.ID
+	}
+	return ids[c.nodes[0].ID], nil
 }
 
 func findChildByName(oyaID uint, name string, userID uint) (Node, bool) {
@@ -377,83 +708,207 @@ func findChildByName(oyaID uint, name string, userID uint) (Node, bool) {
 }
 
 func isAncestor(ancestorID uint, nodeID uint, userID uint) bool {
-	var cur Node
-	if err := db.First(&cur, "id = ? AND user_id = ?", nodeID, userID).Error; err != nil {
+	var nodes []Node
+	db.Select("ancestry").Where("id = ? AND user_id = ?", nodeID, userID).Limit(1).Find(&nodes)
+	if len(nodes) == 0 {
 		return false
 	}
-	for cur.OyaID != nil {
-		if *cur.OyaID == ancestorID {
+	for _, id := range ancestorIDs(nodes[0].Ancestry) {
+		if id == ancestorID {
 			return true
 		}
-		if err := db.First(&cur, "id = ? AND user_id = ?", *cur.OyaID, userID).Error; err != nil {
-			break
-		}
 	}
 	return false
 }
 
+// checkNotInside fails with errIntoSelf if the folder dstID is src or lies
+// below it. The checks before a unit are only a quick answer: inside the
+// transaction, under the folder lock, this one also sees a move that
+// committed in the meantime, such as the other half of two crossed moves.
+func checkNotInside(tx *gorm.DB, src Node, dstID uint) error {
+	if src.ID == dstID {
+		return errIntoSelf
+	}
+	var dst []Node
+	if err := tx.Select("ancestry").Where("id = ?", dstID).Limit(1).Find(&dst).Error; err != nil {
+		return err
+	}
+	if len(dst) > 0 && slices.Contains(ancestorIDs(dst[0].Ancestry), src.ID) {
+		return errIntoSelf
+	}
+	return nil
+}
+
+// DeleteNodeRecursive deletes a node and its subtree in a unit of its own.
 func DeleteNodeRecursive(id uint, userID uint) error {
 	var n Node
-	if err := db.Preload("Ko").First(&n, "id = ? AND user_id = ?", id, userID).Error; err != nil {
+	if err := db.First(&n, "id = ? AND user_id = ?", id, userID).Error; err != nil {
 		return err
 	}
-	for _, c := range n.Ko {
-		_ = DeleteNodeRecursive(c.ID, userID)
+	var u unitOfWork
+	return u.commit(func(tx *gorm.DB) error {
+		return deleteTree(&u, tx, n)
+	})
+}
+
+// deleteTree deletes a node and its subtree; the blobs go once the unit
+// commits.
+func deleteTree(u *unitOfWork, tx *gorm.DB, n Node) error {
+	nodes, err := subtreeNodes(tx, n)
+	if err != nil {
+		return err
 	}
-	if n.Fid != nil {
-		p := fmt.Sprintf("%s/%d", dataDir, *n.Fid)
-		_ = os.Remove(p)
-		thumbPath := fmt.Sprintf("%s/%d.jpg", thumbDir, *n.Fid)
-		_ = os.Remove(thumbPath)
+	if err := subtree(tx, n.Ancestry).Where("user_id = ?", n.UserID).Delete(&Node{}).Error; err != nil {
+		return err
 	}
-	result := db.Delete(&n)
-	if result.Error != nil {
-		return result.Error
+	if err := removeFromAncestors(tx, n); err != nil {
+		return err
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if nodes[i].Fid != nil {
+			u.discard(*nodes[i].Fid)
+		}
+		if err := recordChange(tx, changeDelete, nodes[i]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func MoveNode(src Node, newOyaID uint) error {
+// removeBlob deletes a file's data and cached thumbnail. Failures are only
+// logged: the node is already gone and fsck reclaims whatever is left.
+func removeBlob(fid uint) {
+	if blobsHeld() {
+		db.Clauses(clause.OnConflict{DoNothing: true}).Create(&PendingRemoval{Fid: fid})
+		return
+	}
+	deleteBlob(fid)
+}
+
+func deleteBlob(fid uint) {
+	if err := store.Delete(blobKey(fid)); err != nil {
+		fmt.Println("warning: failed to remove blob:", err)
+	}
+	thumbPath := fmt.Sprintf("%s/%d.jpg", thumbDir, fid)
+	if err := os.Remove(thumbPath); err != nil && !os.IsNotExist(err) {
+		fmt.Println("warning: failed to remove thumbnail:", err)
+	}
+}
+
+// moveNode moves src into the folder newOyaID. src must have been read in
+// tx, as its ancestry and totals are what is moved.
+func moveNode(tx *gorm.DB, src Node, newOyaID uint) error {
 	src.OyaID = &newOyaID
-	result := db.Save(&src)
-	return result.Error
+	if err := savePlace(tx, &src); err != nil {
+		return err
+	}
+	if err := reparent(tx, src, newOyaID); err != nil {
+		return err
+	}
+	return recordChange(tx, changeMove, src)
 }
 
-func RenameNode(src Node, newName string) error {
-	src.Name = newName
-	result := db.Save(&src)
-	return result.Error
+// moveNodeAs moves src into the folder oyaID under name, in a unit of its
+// own. It returns the ID of the node that ends up there.
+func moveNodeAs(src Node, oyaID uint, name string, userID uint, policy string) (uint, error) {
+	locked := []uint{oyaID}
+	if src.OyaID != nil {
+		locked = append(locked, *src.OyaID)
+	}
+	defer lockFolders(locked...)()
+	var u unitOfWork
+	var id uint
+	err := u.commit(func(tx *gorm.DB) error {
+		var err error
+		id, err = placeNode(&u, tx, src, oyaID, name, userID, policy)
+		return err
+	})
+	return id, err
 }
 
-func DeleteNode(src Node) error {
-	result := db.Delete(&src)
-	success := result.Error == nil && result.RowsAffected > 0
-	if !success {
-		return fmt.Errorf("delete failed")
+// placeNode moves src into oyaID as name under the conflict policy. It
+// returns src's ID, or with skip the existing entry's. The caller holds the
+// locks of oyaID and of the folder src was in when it was read.
+func placeNode(u *unitOfWork, tx *gorm.DB, src Node, oyaID uint, name string, userID uint, policy string) (uint, error) {
+	// src may have been read before the lock, e.g. before an overwrite gave
+	// it a new blob.
+	from := src.OyaID
+	if err := tx.First(&src, src.ID).Error; err != nil {
+		return 0, err
 	}
-	fid := src.Fid
-	if fid != nil {
-		p := dataDir + "/" + fmt.Sprintf("%d", *fid)
-		_ = os.Remove(p)
+	if (from == nil) != (src.OyaID == nil) || from != nil && *from != *src.OyaID {
+		// Moved out of the locked folder in the meantime.
+		return 0, errMoved
 	}
-	return nil
+	if err := checkNotInside(tx, src, oyaID); err != nil {
+		return 0, err
+	}
+	name, skipID, err := claimName(u, tx, oyaID, name, src.IsDir, userID, policy, src.ID)
+	if err != nil {
+		return skipID, err
+	}
+	if src.OyaID != nil && *src.OyaID == oyaID {
+		if name == src.Name {
+			return src.ID, nil
+		}
+		return src.ID, renameNode(tx, src, name)
+	}
+	if name != src.Name {
+		src.Name = name
+		if !src.IsDir {
+			src.MimeType = detectMime(name, src.Fid)
+		}
+	}
+	return src.ID, moveNode(tx, src, oyaID)
 }
 
-func calculateDirSize(nodeID uint, userID uint) int64 {
-	var totalSize int64
-	var children []Node
-	db.Where("oya_id = ? AND user_id = ?", nodeID, userID).Find(&children)
-	for _, child := range children {
-		if child.IsDir {
-			totalSize += calculateDirSize(child.ID, userID)
-		} else if child.Fid != nil {
-			p := fmt.Sprintf("%s/%d", dataDir, *child.Fid)
-			if st, err := os.Stat(p); err == nil {
-				totalSize += st.Size()
-			}
+func renameNode(tx *gorm.DB, src Node, newName string) error {
+	src.Name = newName
+	if !src.IsDir {
+		src.MimeType = detectMime(newName, src.Fid)
+	}
+	if err := savePlace(tx, &src); err != nil {
+		return err
+	}
+	return recordChange(tx, changeMove, src)
+}
+
+// savePlace writes the folder and name of src and nothing else, so a copy
+// read earlier cannot undo changes to its content.
+func savePlace(tx *gorm.DB, src *Node) error {
+	src.UpdatedAt = time.Now()
+	return tx.Model(&Node{}).Where("id = ?", src.ID).UpdateColumns(map[string]interface{}{
+		"oya_id":     src.OyaID,
+		"name":       src.Name,
+		"sort_name":  naturalKey(src.Name),
+		"sort_ext":   strings.ToLower(filepath.Ext(src.Name)),
+		"mime_type":  src.MimeType,
+		"updated_at": src.UpdatedAt,
+	}).Error
+}
+
+// nodePath loads the names of all ancestors in one query.
+func nodePath(n Node) string {
+	if n.OyaID == nil {
+		return "/"
+	}
+	ids := ancestorIDs(n.Ancestry)
+	var ancestors []Node
+	db.Select("id", "name", "oya_id").Where("id IN ? AND user_id = ?", ids, n.UserID).Find(&ancestors)
+	names := make(map[uint]string, len(ancestors))
+	for _, a := range ancestors {
+		if a.OyaID != nil {
+			names[a.ID] = a.Name
+		}
+	}
+	var parts []string
+	for _, id := range ids {
+		if name, ok := names[id]; ok {
+			parts = append(parts, name)
 		}
 	}
-	return totalSize
+	parts = append(parts, n.Name)
+	return "/" + strings.Join(parts, "/")
 }
 
 func GetJson(w http.ResponseWriter, r *http.Request) {
@@ -465,71 +920,46 @@ func GetJson(w http.ResponseWriter, r *http.Request) {
 	idStr := r.URL.Path[len("/node/"):]
 	var node Node
 	if idStr == "" {
-		node = return_root(userID)
+		node = rootFor(r, userID)
 	} else {
 		id, err := strconv.Atoi(idStr)
 		if err != nil || id <= 0 {
-			node = return_root(userID)
+			node = rootFor(r, userID)
 		} else {
-			db.Preload("Ko").First(&node, "id = ? AND user_id = ?", id, userID)
+			db.First(&node, "id = ? AND user_id = ?", id, userID)
 		}
 	}
-	buildPath := func(n Node) string {
-		if n.OyaID == nil {
-			return "/"
-		}
-		parts := []string{n.Name}
-		cur := n
-		for cur.OyaID != nil {
-			var parent Node
-			if err := db.First(&parent, "id = ? AND user_id = ?", *cur.OyaID, userID).Error; err != nil {
-				break
-			}
-			if parent.OyaID == nil {
-				break
-			}
-			parts = append([]string{parent.Name}, parts...)
-			cur = parent
-		}
-		return "/" + strings.Join(parts, "/")
-	}
-	node.Path = buildPath(node)
-	if node.Fid != nil {
-		p := fmt.Sprintf("%s/%d", dataDir, *node.Fid)
-		if st, err := os.Stat(p); err == nil {
-			node.Size = st.Size()
-		}
-	} else {
-		node.Size = calculateDirSize(node.ID, userID)
+	if node.ID != 0 && denyOutsideFolder(w, r, node) {
+		return
 	}
-	var share Share
-	if err := db.First(&share, "node_id = ? AND user_id = ?", node.ID, userID).Error; err == nil {
-		node.ShareToken = share.Token
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if len(node.Ko) > 1 {
-		sort.Slice(node.Ko, func(i, j int) bool {
-			if node.Ko[i].IsDir != node.Ko[j].IsDir {
-				return node.Ko[i].IsDir
-			}
-			return node.Ko[i].Name < node.Ko[j].Name
-		})
+	if err := writeListing(w, r, node, userID, opts); err != nil {
+		http.Error(w, "failed to list folder", http.StatusInternalServerError)
 	}
+}
+
+// nodeView fills in the computed fields of a node and its loaded children:
+// path and share tokens. The shares are looked up in one query.
+func nodeView(node *Node, userID uint) {
+	node.Path = nodePath(*node)
+	ids := []uint{node.ID}
+	for _, k := range node.Ko {
+		ids = append(ids, k.ID)
+	}
+	var shares []Share
+	db.Where("node_id IN ? AND user_id = ?", ids, userID).Find(&shares)
+	tokens := make(map[uint]string, len(shares))
+	for _, s := range shares {
+		tokens[s.NodeID] = s.Token
+	}
+	node.ShareToken = tokens[node.ID]
 	for i := range node.Ko {
-		if node.Ko[i].Fid != nil {
-			p := fmt.Sprintf("%s/%d", dataDir, *node.Ko[i].Fid)
-			if st, err := os.Stat(p); err == nil {
-				node.Ko[i].Size = st.Size()
-			}
-		} else if node.Ko[i].IsDir {
-			node.Ko[i].Size = calculateDirSize(node.Ko[i].ID, userID)
-		}
-		var childShare Share
-		if err := db.First(&childShare, "node_id = ? AND user_id = ?", node.Ko[i].ID, userID).Error; err == nil {
-			node.Ko[i].ShareToken = childShare.Token
-		}
+		node.Ko[i].ShareToken = tokens[node.Ko[i].ID]
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(node.to_json())
 }
 
 func GetFile(w http.ResponseWriter, r *http.Request) {
@@ -546,31 +976,38 @@ func GetFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "file not found", http.StatusNotFound)
 		return
 	}
-	p := fmt.Sprintf("%s/%d", dataDir, *node.Fid)
-	f, err := os.Open(p)
-	if err != nil {
-		http.Error(w, "failed to open file", http.StatusInternalServerError)
+	if denyOutsideFolder(w, r, node) {
 		return
 	}
-	defer f.Close()
-	fi, err := f.Stat()
+	if err := serveNode(w, r, node); err != nil {
+		http.Error(w, "failed to open file", http.StatusInternalServerError)
+	}
+}
+
+// serveNode writes a file's content with range support. It only returns an
+// error when nothing has been written yet.
+func serveNode(w http.ResponseWriter, r *http.Request, node Node) error {
+	f, err := store.Open(blobKey(*node.Fid))
 	if err != nil {
-		http.Error(w, "failed to stat file", http.StatusInternalServerError)
-		return
+		return err
+	}
+	defer f.Close()
+	ctype := node.MimeType
+	if ctype == "" {
+		ctype = detectMime(node.Name, nil)
 	}
-	ext := strings.ToLower("." + strings.TrimPrefix(strings.TrimPrefix(filepath.Ext(node.Name), "."), "."))
-	ctype := mime.TypeByExtension(ext)
 	if ctype == "" {
 		ctype = "application/octet-stream"
 	}
-	inline := r.URL.Query().Get("inline")
-	if inline == "1" || inline == "true" {
-		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", node.Name))
-	} else {
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", node.Name))
+	disposition := "attachment"
+	if inline := r.URL.Query().Get("inline"); inline == "1" || inline == "true" {
+		disposition = "inline"
 	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": node.Name}))
 	w.Header().Set("Content-Type", ctype)
-	http.ServeContent(w, r, node.Name, fi.ModTime(), f)
+	setDigestHeaders(w, node)
+	http.ServeContent(w, r, node.Name, f.Info().ModTime, f)
+	return nil
 }
 
 func GetThumbnail(w http.ResponseWriter, r *http.Request) {
@@ -588,7 +1025,9 @@ func GetThumbnail(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "file not found", http.StatusNotFound)
 		return
 	}
-	p := fmt.Sprintf("%s/%d", dataDir, *node.Fid)
+	if denyOutsideFolder(w, r, node) {
+		return
+	}
 	fmt.Printf("Thumbnail request for %s (node_id=%d, fid=%d)\n", node.Name, id, *node.Fid)
 	if err := os.MkdirAll(thumbDir, 0755); err != nil {
 		http.Error(w, "failed to create thumbnail directory", http.StatusInternalServerError)
@@ -636,7 +1075,7 @@ func GetThumbnail(w http.ResponseWriter, r *http.Request) {
 	var thumbnail image.Image
 	if isImage {
 		fmt.Printf("Generating image thumbnail for %s\n", node.Name)
-		file, err := os.Open(p)
+		file, err := store.Open(blobKey(*node.Fid))
 		if err != nil {
 			http.Error(w, "failed to open file", http.StatusInternalServerError)
 			return
@@ -651,6 +1090,12 @@ func GetThumbnail(w http.ResponseWriter, r *http.Request) {
 		thumbnail = resize.Thumbnail(200, 200, img, resize.Lanczos3)
 	} else if isVideo {
 		fmt.Printf("Generating video thumbnail for %s\n", node.Name)
+		p, cleanup, err := localFile(blobKey(*node.Fid))
+		if err != nil {
+			http.Error(w, "failed to open file", http.StatusInternalServerError)
+			return
+		}
+		defer cleanup()
 		thumbnail, err = extractVideoFrame(p)
 		if err != nil {
 			fmt.Printf("Video thumbnail generation failed for %s: %v\n", node.Name, err)
@@ -760,6 +1205,8 @@ func UpFile(w http.ResponseWriter, r *http.Request) {
 	var oyaPtr *uint
 	var dataReader io.Reader
 	var uploadID string
+	conflict := r.URL.Query().Get("conflict")
+	relPath := r.URL.Query().Get("path")
 	if strings.HasPrefix(contentType, "multipart/form-data") {
 		err := r.ParseMultipartForm(1024 << 20)
 		if err != nil {
@@ -773,6 +1220,12 @@ func UpFile(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		isDir = r.FormValue("is_dir") == "true" || r.FormValue("is_dir") == "1"
+		if c := r.FormValue("conflict"); c != "" {
+			conflict = c
+		}
+		if p := r.FormValue("path"); p != "" {
+			relPath = p
+		}
 		oyaStr := r.FormValue("oya_id")
 		if oyaStr != "" {
 			if id, err := strconv.Atoi(oyaStr); err == nil {
@@ -807,6 +1260,8 @@ func UpFile(w http.ResponseWriter, r *http.Request) {
 			IsDir      bool   `json:"is_dir"`
 			OyaID      *uint  `json:"oya_id"`
 			DataBase64 string `json:"data_base64"`
+			Conflict   string `json:"conflict"`
+			Path       string `json:"path"`
 		}
 		dec := json.NewDecoder(r.Body)
 		if err := dec.Decode(&body); err != nil {
@@ -816,6 +1271,12 @@ func UpFile(w http.ResponseWriter, r *http.Request) {
 		filename = body.Filename
 		isDir = body.IsDir
 		oyaPtr = body.OyaID
+		if body.Conflict != "" {
+			conflict = body.Conflict
+		}
+		if body.Path != "" {
+			relPath = body.Path
+		}
 		if !isDir && body.DataBase64 != "" {
 			dataReader = base64.NewDecoder(base64.StdEncoding, strings.NewReader(body.DataBase64))
 		}
@@ -823,37 +1284,187 @@ func UpFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "unsupported content type: "+contentType, http.StatusUnsupportedMediaType)
 		return
 	}
+	// A relative path, such as a browser's webkitRelativePath, names the
+	// entry and the folders below oya_id it goes into.
+	var dir []string
+	if relPath != "" {
+		names, err := splitPath(relPath, false)
+		if err != nil || len(names) == 0 {
+			http.Error(w, errInvalidPath.Error(), http.StatusBadRequest)
+			return
+		}
+		dir, filename = names[:len(names)-1], names[len(names)-1]
+	}
 	if filename == "" {
 		http.Error(w, "filename is required", http.StatusBadRequest)
 		return
 	}
-	if oyaPtr == nil {
-		root := return_root(userID)
-		oyaPtr = &root.ID
-	} else {
-		var parentNode Node
-		if err := db.First(&parentNode, "id = ? AND user_id = ?", *oyaPtr, userID).Error; err != nil {
-			http.Error(w, "parent folder not found", http.StatusNotFound)
+	if filename, err = cleanName(filename); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Uploads replaced files of the same name before there was a choice.
+	policy, err := conflictPolicy(conflict, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy = uploadPolicy(r, policy)
+	oya, ok := uploadFolder(w, r, oyaPtr, userID)
+	if !ok {
+		return
+	}
+	ifMatch := strings.Trim(r.Header.Get("If-Match"), `"`)
+	nodeID, err := UploadPath(dir, filename, dataReader, isDir, oya, userID, policy, ifMatch)
+	skipped := errors.Is(err, errSkipped)
+	if err != nil && !skipped {
+		if errors.Is(err, errModified) {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
 			return
 		}
-		if !parentNode.IsDir {
-			http.Error(w, "parent is not a folder", http.StatusBadRequest)
+		if errors.Is(err, errFolderExists) {
+			http.Error(w, "folder_exists", http.StatusConflict)
 			return
 		}
-	}
-	nodeID, err := UploadNode(filename, dataReader, isDir, oyaPtr, userID)
-	if err != nil {
-		if err.Error() == "folder_exists" {
-			http.Error(w, "folder_exists", http.StatusConflict)
+		if errors.Is(err, errConflict) || errors.Is(err, errNotFolder) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errInvalidName) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		http.Error(w, "upload_error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	resp := fmt.Sprintf(`{"success":true,"node_id":%d,"name":"%s"}`, nodeID, filename)
-	_, _ = w.Write([]byte(resp))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"node_id": nodeID,
+		"name":    nodeName(nodeID),
+		"skipped": skipped,
+	})
+}
+
+// uploadFolder loads the folder an upload goes into, the root of the
+// request when oyaID is nil.
+func uploadFolder(w http.ResponseWriter, r *http.Request, oyaID *uint, userID uint) (Node, bool) {
+	if oyaID == nil {
+		return rootFor(r, userID), true
+	}
+	var parentNode Node
+	if err := db.First(&parentNode, "id = ? AND user_id = ?", *oyaID, userID).Error; err != nil {
+		http.Error(w, "parent folder not found", http.StatusNotFound)
+		return parentNode, false
+	}
+	if !parentNode.IsDir {
+		http.Error(w, "parent is not a folder", http.StatusBadRequest)
+		return parentNode, false
+	}
+	if denyOutsideFolder(w, r, parentNode) {
+		return parentNode, false
+	}
+	return parentNode, true
+}
+
+// UploadResult reports how one file of a multi-file upload went.
+type UploadResult struct {
+	Path    string `json:"path"`
+	Status  int    `json:"status"`
+	NodeID  uint   `json:"node_id,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// UpFiles uploads the file parts of a multipart request below oya_id, each
+// to its optional path field.
+func UpFiles(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "multipart/form-data") {
+		http.Error(w, "unsupported content type: "+contentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := r.ParseMultipartForm(1024 << 20); err != nil {
+		http.Error(w, "failed to parse multipart form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	files := r.MultipartForm.File["file"]
+	paths := r.MultipartForm.Value["path"]
+	if len(files) == 0 {
+		http.Error(w, "missing file", http.StatusBadRequest)
+		return
+	}
+	if len(paths) > 0 && len(paths) != len(files) {
+		http.Error(w, "give one path per file", http.StatusBadRequest)
+		return
+	}
+	policy, err := conflictPolicy(r.FormValue("conflict"), true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy = uploadPolicy(r, policy)
+	var oyaPtr *uint
+	if id, err := strconv.Atoi(r.FormValue("oya_id")); err == nil {
+		u := uint(id)
+		oyaPtr = &u
+	}
+	oya, ok := uploadFolder(w, r, oyaPtr, userID)
+	if !ok {
+		return
+	}
+	results := make([]UploadResult, len(files))
+	failed := 0
+	for i, fh := range files {
+		p := fh.Filename
+		if len(paths) > 0 {
+			p = paths[i]
+		}
+		results[i] = uploadPart(fh, p, oya, userID, policy)
+		if results[i].Error != "" {
+			failed++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": failed == 0,
+		"failed":  failed,
+		"results": results,
+	})
+}
+
+// uploadPart uploads one file of UpFiles to the relative path p.
+func uploadPart(fh *multipart.FileHeader, p string, oya Node, userID uint, policy string) UploadResult {
+	res := UploadResult{Path: p}
+	names, err := splitPath(p, false)
+	if err == nil && len(names) == 0 {
+		err = errInvalidPath
+	}
+	var name string
+	if err == nil {
+		name, err = cleanName(names[len(names)-1])
+	}
+	var file multipart.File
+	if err == nil {
+		file, err = fh.Open()
+	}
+	if err == nil {
+		defer file.Close()
+		res.NodeID, err = UploadPath(names[:len(names)-1], name, file, false, oya, userID, policy, "")
+	}
+	res.Skipped = errors.Is(err, errSkipped)
+	if err != nil && !res.Skipped {
+		res.Status = errorStatus(err)
+		res.Error = err.Error()
+		return res
+	}
+	res.Status = http.StatusOK
+	res.Name = nodeName(res.NodeID)
+	return res
 }
 
 func UploadProgressSSE(w http.ResponseWriter, r *http.Request) {
@@ -909,9 +1520,10 @@ func CpFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var req struct {
-		SrcID     uint `json:"src_id"`
-		DstID     uint `json:"dst_id"`
-		Overwrite bool `json:"overwrite"`
+		SrcID     uint   `json:"src_id"`
+		DstID     uint   `json:"dst_id"`
+		Overwrite bool   `json:"overwrite"`
+		Conflict  string `json:"conflict"`
 	}
 	dec := json.NewDecoder(r.Body)
 	if err := dec.Decode(&req); err != nil {
@@ -922,36 +1534,117 @@ func CpFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "src_id and dst_id required", http.StatusBadRequest)
 		return
 	}
+	policy, err := conflictPolicy(req.Conflict, req.Overwrite)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	var src Node
 	if err := db.First(&src, "id = ? AND user_id = ?", req.SrcID, userID).Error; err != nil {
 		http.Error(w, "source not found", http.StatusNotFound)
 		return
 	}
-	err = db.Transaction(func(tx *gorm.DB) error {
-		if existing, ok := findChildByName(req.DstID, src.Name, userID); ok {
-			if !req.Overwrite {
-				return fmt.Errorf("conflict: destination already contains an entry with same name")
-			}
-			if err := DeleteNodeRecursive(existing.ID, userID); err != nil {
-				return fmt.Errorf("failed to remove existing target: %w", err)
-			}
+	if denyOutsideFolder(w, r, src, Node{ID: req.DstID, UserID: userID}) {
+		return
+	}
+	id, err := copyNodeTo(src, req.DstID, userID, policy, nil)
+	skipped := errors.Is(err, errSkipped)
+	if err != nil && !skipped {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "name": nodeName(id), "skipped": skipped})
+}
+
+// errorStatus maps the errors of the node operations to HTTP statuses.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errConflict), errors.Is(err, errMoved), errors.Is(err, errFolderExists), errors.Is(err, errNotFolder):
+		return http.StatusConflict
+	case errors.Is(err, errNoDestination):
+		return http.StatusNotFound
+	case errors.Is(err, errIntoSelf), errors.Is(err, errInvalidName), errors.Is(err, errConflictPolicy), errors.Is(err, errInvalidPath):
+		return http.StatusBadRequest
+	case errors.Is(err, errTooManyJobs):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errModified):
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusInternalServerError
+}
+
+// destinationFolder loads a folder of the user that nodes are copied or
+// moved into.
+func destinationFolder(dstID uint, userID uint) (Node, error) {
+	var dst Node
+	if err := db.First(&dst, "id = ? AND user_id = ?", dstID, userID).Error; err != nil || !dst.IsDir {
+		return dst, errNoDestination
+	}
+	return dst, nil
+}
+
+// copyNodeTo copies src into the folder dstID, with the conflict policy
+// deciding about an entry of the same name.
+func copyNodeTo(src Node, dstID uint, userID uint, policy string, j *Job) (uint, error) {
+	if src.ID == dstID || isAncestor(src.ID, dstID, userID) {
+		return 0, errIntoSelf
+	}
+	if _, err := destinationFolder(dstID, userID); err != nil {
+		return 0, err
+	}
+	if existing, ok := findChildByName(dstID, src.Name, userID); ok {
+		switch policy {
+		case conflictSkip:
+			return existing.ID, errSkipped
+		case conflictFail:
+			return 0, errConflict
 		}
-		_, err := CopyNode(src, req.DstID, userID)
+	}
+	var u unitOfWork
+	c, err := stageCopy(&u, src, j)
+	if err != nil {
+		u.abort()
+		return 0, fmt.Errorf("copy failed: %w", err)
+	}
+	defer lockFolders(dstID)()
+	var id uint
+	err = u.commit(func(tx *gorm.DB) error {
+		if err := checkNotInside(tx, src, dstID); err != nil {
+			return err
+		}
+		name, skipID, err := claimName(&u, tx, dstID, src.Name, src.IsDir, userID, policy, 0)
 		if err != nil {
-			return fmt.Errorf("copy failed: %w", err)
+			id = skipID
+			return err
 		}
-		return nil
+		id, err = c.create(tx, dstID, name, userID)
+		return err
 	})
-	if err != nil {
-		if strings.Contains(err.Error(), "conflict:") {
-			http.Error(w, err.Error(), http.StatusConflict)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
+	return id, err
+}
+
+// moveNodeTo moves src into the folder dstID, with the conflict policy
+// deciding about an entry of the same name.
+func moveNodeTo(src Node, dstID uint, userID uint, policy string) (uint, error) {
+	if src.ID == dstID || isAncestor(src.ID, dstID, userID) {
+		return 0, errIntoSelf
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(fmt.Sprintf(`{"success":true,"name":"%s"}`, src.Name)))
+	if _, err := destinationFolder(dstID, userID); err != nil {
+		return 0, err
+	}
+	id, err := moveNodeAs(src, dstID, src.Name, userID, policy)
+	if err != nil && !errors.Is(err, errSkipped) && !errors.Is(err, errConflict) {
+		return id, fmt.Errorf("move failed: %w", err)
+	}
+	return id, err
+}
+
+// nodeName looks up the name a node ended up with after a conflict policy
+// had its say.
+func nodeName(id uint) string {
+	var n Node
+	db.Select("name").Where("id = ?", id).Limit(1).Find(&n)
+	return n.Name
 }
 
 func MvFile(w http.ResponseWriter, r *http.Request) {
@@ -961,9 +1654,10 @@ func MvFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var req struct {
-		SrcID     uint `json:"src_id"`
-		DstID     uint `json:"dst_id"`
-		Overwrite bool `json:"overwrite"`
+		SrcID     uint   `json:"src_id"`
+		DstID     uint   `json:"dst_id"`
+		Overwrite bool   `json:"overwrite"`
+		Conflict  string `json:"conflict"`
 	}
 	dec := json.NewDecoder(r.Body)
 	if err := dec.Decode(&req); err != nil {
@@ -974,39 +1668,26 @@ func MvFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "src_id and dst_id required", http.StatusBadRequest)
 		return
 	}
+	policy, err := conflictPolicy(req.Conflict, req.Overwrite)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	var src Node
 	if err := db.First(&src, "id = ? AND user_id = ?", req.SrcID, userID).Error; err != nil {
 		http.Error(w, "source not found", http.StatusNotFound)
 		return
 	}
-	if src.ID == req.DstID || isAncestor(src.ID, req.DstID, userID) {
-		http.Error(w, "cannot move into self or descendant", http.StatusBadRequest)
+	if denyOutsideFolder(w, r, src, Node{ID: req.DstID, UserID: userID}) {
 		return
 	}
-	err = db.Transaction(func(tx *gorm.DB) error {
-		if existing, ok := findChildByName(req.DstID, src.Name, userID); ok {
-			if !req.Overwrite {
-				return fmt.Errorf("conflict: destination already contains an entry with same name")
-			}
-			if err := DeleteNodeRecursive(existing.ID, userID); err != nil {
-				return fmt.Errorf("failed to remove existing target: %w", err)
-			}
-		}
-		if err := MoveNode(src, req.DstID); err != nil {
-			return fmt.Errorf("move failed: %w", err)
-		}
-		return nil
-	})
-	if err != nil {
-		if strings.Contains(err.Error(), "conflict:") {
-			http.Error(w, err.Error(), http.StatusConflict)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	id, err := moveNodeTo(src, req.DstID, userID, policy)
+	skipped := errors.Is(err, errSkipped)
+	if err != nil && !skipped {
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(fmt.Sprintf(`{"success":true,"name":"%s"}`, src.Name)))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "name": nodeName(id), "skipped": skipped})
 }
 
 func RnFile(w http.ResponseWriter, r *http.Request) {
@@ -1016,8 +1697,9 @@ func RnFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var req struct {
-		SrcID   uint   `json:"src_id"`
-		NewName string `json:"new_name"`
+		SrcID    uint   `json:"src_id"`
+		NewName  string `json:"new_name"`
+		Conflict string `json:"conflict"`
 	}
 	dec := json.NewDecoder(r.Body)
 	if err := dec.Decode(&req); err != nil {
@@ -1028,17 +1710,35 @@ func RnFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "src_id and new_name required", http.StatusBadRequest)
 		return
 	}
+	name, err := cleanName(req.NewName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy, err := conflictPolicy(req.Conflict, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	var src Node
 	if err := db.First(&src, "id = ? AND user_id = ?", req.SrcID, userID).Error; err != nil {
 		http.Error(w, "source not found", http.StatusNotFound)
 		return
 	}
-	if err := RenameNode(src, req.NewName); err != nil {
-		http.Error(w, "rename failed: "+err.Error(), http.StatusInternalServerError)
+	if denyOutsideFolder(w, r, src) {
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"success":true}`))
+	if src.OyaID == nil {
+		http.Error(w, "the root folder cannot be renamed", http.StatusBadRequest)
+		return
+	}
+	id, err := moveNodeAs(src, *src.OyaID, name, userID, policy)
+	skipped := errors.Is(err, errSkipped)
+	if err != nil && !skipped {
+		http.Error(w, "rename failed: "+err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "name": nodeName(id), "skipped": skipped})
 }
 
 func DlFile(w http.ResponseWriter, r *http.Request) {
@@ -1064,6 +1764,9 @@ func DlFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "source not found", http.StatusNotFound)
 		return
 	}
+	if denyOutsideFolder(w, r, src) {
+		return
+	}
 	if err := DeleteNodeRecursive(src.ID, userID); err != nil {
 		http.Error(w, "delete failed: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -1082,6 +1785,10 @@ var js_script string
 var css_style string
 
 func Register(w http.ResponseWriter, r *http.Request) {
+	if !passwordLoginEnabled() {
+		http.Error(w, "password login is disabled", http.StatusForbidden)
+		return
+	}
 	var req struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
@@ -1094,23 +1801,60 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "username and password required", http.StatusBadRequest)
 		return
 	}
-	var existing User
-	if err := db.First(&existing, "username = ?", req.Username).Error; err == nil {
+	if throttled(w, r, throttleAuth, getLimits().authRate) {
+		return
+	}
+	user, err := createUser(req.Username, req.Password)
+	if errors.Is(err, errUserExists) {
 		http.Error(w, "username already exists", http.StatusConflict)
 		return
 	}
-	hashedPassword, err := hashPassword(req.Password)
+	if errors.Is(err, errWeakPassword) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, "failed to hash password", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := startSession(w, user); err != nil {
+		http.Error(w, "failed to generate token", http.StatusInternalServerError)
 		return
 	}
-	user := User{
-		Username: req.Username,
-		Password: hashedPassword,
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"user_id":  user.ID,
+		"username": user.Username,
+	})
+}
+
+var errUserExists = errors.New("username already exists")
+
+// createUser adds an account with a password.
+func createUser(username, password string) (User, error) {
+	var existing User
+	if err := db.First(&existing, "username = ?", username).Error; err == nil {
+		return User{}, errUserExists
+	}
+	if err := checkPasswordPolicy(username, password); err != nil {
+		return User{}, err
+	}
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to hash password")
 	}
+	return createAccount(User{Username: username, Password: hashedPassword})
+}
+
+// createAccount adds an account with its root folder. The first account
+// becomes the administrator.
+func createAccount(user User) (User, error) {
+	var userCount int64
+	db.Model(&User{}).Count(&userCount)
+	user.IsAdmin = userCount == 0
 	if err := db.Create(&user).Error; err != nil {
-		http.Error(w, "failed to create user", http.StatusInternalServerError)
-		return
+		return User{}, fmt.Errorf("failed to create user")
 	}
 	root := Node{
 		UserID: user.ID,
@@ -1121,10 +1865,14 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	if err := db.Create(&root).Error; err != nil {
 		fmt.Println("warning: failed to create root node for user:", err)
 	}
-	token, err := generateToken(user.ID, user.Username)
+	return user, nil
+}
+
+// startSession issues a token for user and sets it as the session cookie.
+func startSession(w http.ResponseWriter, user User) error {
+	token, err := generateToken(user)
 	if err != nil {
-		http.Error(w, "failed to generate token", http.StatusInternalServerError)
-		return
+		return err
 	}
 	http.SetCookie(w, &http.Cookie{
 		Name:     "token",
@@ -1134,12 +1882,37 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
 	})
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":  true,
-		"user_id":  user.ID,
-		"username": user.Username,
-	})
+	return nil
+}
+
+// checkLogin returns the user when the password matches, locally or via
+// LDAP. Accounts of a single sign-on provider never go to LDAP.
+func checkLogin(username, password string) (User, bool) {
+	var user User
+	db.Where("username = ?", username).Limit(1).Find(&user)
+	if user.ID != 0 && user.Password != "" {
+		if checkPasswordHash(password, user.Password) {
+			rehashPassword(user, password)
+			return user, true
+		}
+		if user.LDAPDN == nil && configValue("ldap_link_existing", "false") != "true" {
+			return User{}, false
+		}
+	}
+	if user.OIDCSubject != nil && user.LDAPDN == nil {
+		// The account belongs to a provider login; a directory entry of
+		// the same name is someone else.
+		return User{}, false
+	}
+	if !ldapEnabled() {
+		return User{}, false
+	}
+	user, err := ldapLogin(username, password)
+	if err != nil {
+		fmt.Printf("LDAP login for %s failed: %v\n", username, err)
+		return User{}, false
+	}
+	return user, true
 }
 
 func Login(w http.ResponseWriter, r *http.Request) {
@@ -1148,6 +1921,10 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte(indexHtmlContent))
 		return
 	}
+	if !passwordLoginEnabled() {
+		http.Error(w, "password login is disabled", http.StatusForbidden)
+		return
+	}
 	var req struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
@@ -1156,28 +1933,20 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid json", http.StatusBadRequest)
 		return
 	}
-	var user User
-	if err := db.First(&user, "username = ?", req.Username).Error; err != nil {
-		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+	if throttled(w, r, throttleAuth, getLimits().authRate, req.Username) {
 		return
 	}
-	if !checkPasswordHash(req.Password, user.Password) {
+	user, ok := checkLogin(req.Username, req.Password)
+	if !ok {
+		recordFailure(r, throttleAuth, req.Username)
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
-	token, err := generateToken(user.ID, user.Username)
-	if err != nil {
+	recordSuccess(r, req.Username)
+	if err := startSession(w, user); err != nil {
 		http.Error(w, "failed to generate token", http.StatusInternalServerError)
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		Path:     "/",
-		MaxAge:   86400,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-	})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":  true,
@@ -1205,21 +1974,16 @@ func Me(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	username := r.Header.Get("X-Username")
+	var user User
+	db.First(&user, userID)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"user_id":  userID,
 		"username": username,
+		"is_admin": user.IsAdmin,
 	})
 }
 
-func generateShareToken() string {
-	b := make([]byte, 16)
-	for i := range b {
-		b[i] = byte(mrand.Intn(256))
-	}
-	return base64.URLEncoding.EncodeToString(b)
-}
-
 func CreateShare(w http.ResponseWriter, r *http.Request) {
 	userID, err := getUserIDFromRequest(r)
 	if err != nil {
@@ -1242,6 +2006,9 @@ func CreateShare(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "node not found", http.StatusNotFound)
 		return
 	}
+	if denyOutsideFolder(w, r, node) {
+		return
+	}
 	var existingShare Share
 	if err := db.First(&existingShare, "node_id = ? AND user_id = ?", req.NodeID, userID).Error; err == nil {
 		w.Header().Set("Content-Type", "application/json")
@@ -1269,9 +2036,14 @@ func CreateShare(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetSharedFile(w http.ResponseWriter, r *http.Request) {
+	if throttled(w, r, throttleShare, getLimits().shareRate) {
+		return
+	}
 	token := strings.TrimPrefix(r.URL.Path, "/s/")
 	var share Share
 	if err := db.First(&share, "token = ?", token).Error; err != nil {
+		// Guessing tokens counts as failures and ends in a lockout.
+		recordFailure(r, throttleShare, "")
 		http.Error(w, "shared link not found", http.StatusNotFound)
 		return
 	}
@@ -1288,31 +2060,9 @@ func GetSharedFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "not a file", http.StatusBadRequest)
 		return
 	}
-	p := fmt.Sprintf("%s/%d", dataDir, *node.Fid)
-	f, err := os.Open(p)
-	if err != nil {
+	if err := serveNode(shareWriter(w), r, node); err != nil {
 		http.Error(w, "failed to open file", http.StatusInternalServerError)
-		return
 	}
-	defer f.Close()
-	fi, err := f.Stat()
-	if err != nil {
-		http.Error(w, "failed to stat file", http.StatusInternalServerError)
-		return
-	}
-	ext := strings.ToLower("." + strings.TrimPrefix(strings.TrimPrefix(filepath.Ext(node.Name), "."), "."))
-	ctype := mime.TypeByExtension(ext)
-	if ctype == "" {
-		ctype = "application/octet-stream"
-	}
-	inline := r.URL.Query().Get("inline")
-	if inline == "1" || inline == "true" {
-		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", node.Name))
-	} else {
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", node.Name))
-	}
-	w.Header().Set("Content-Type", ctype)
-	http.ServeContent(w, r, node.Name, fi.ModTime(), f)
 }
 
 func DeleteShare(w http.ResponseWriter, r *http.Request) {
@@ -1332,6 +2082,9 @@ func DeleteShare(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "node_id required", http.StatusBadRequest)
 		return
 	}
+	if denyOutsideFolder(w, r, Node{ID: req.NodeID, UserID: userID}) {
+		return
+	}
 	result := db.Where("node_id = ? AND user_id = ?", req.NodeID, userID).Delete(&Share{})
 	if result.Error != nil {
 		http.Error(w, "failed to delete share", http.StatusInternalServerError)
@@ -1347,11 +2100,16 @@ func DeleteAccount(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	if _, restricted := tokenFolder(r); restricted {
+		// The account holds more than the token's folder.
+		http.Error(w, "Forbidden: token is restricted to a folder", http.StatusForbidden)
+		return
+	}
 	var req struct {
 		Password string `json:"password"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
-		http.Error(w, "Password required", http.StatusBadRequest)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "invalid json", http.StatusBadRequest)
 		return
 	}
 	var user User
@@ -1359,24 +2117,46 @@ func DeleteAccount(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
-	if !checkPasswordHash(req.Password, user.Password) {
+	if throttled(w, r, throttleAuth, getLimits().authRate, user.Username) {
+		return
+	}
+	switch {
+	case user.Password == "" && user.OIDCSubject != nil:
+		// Provider accounts have no password to ask for; a login through
+		// the provider moments ago stands in for it.
+		if age, ok := sessionAge(r); !ok || age > recentLogin {
+			http.Error(w, "Log in again to delete the account", http.StatusUnauthorized)
+			return
+		}
+	case req.Password == "":
+		http.Error(w, "Password required", http.StatusBadRequest)
+		return
+	case user.Password == "" && user.LDAPDN != nil:
+		if !ldapCheckPassword(user, req.Password) {
+			recordFailure(r, throttleAuth, user.Username)
+			http.Error(w, "Incorrect password", http.StatusUnauthorized)
+			return
+		}
+	case !checkPasswordHash(req.Password, user.Password):
+		recordFailure(r, throttleAuth, user.Username)
 		http.Error(w, "Incorrect password", http.StatusUnauthorized)
 		return
 	}
 	var nodes []Node
-	db.Where("user_id = ?", userID).Find(&nodes)
+	db.Where("user_id = ? AND fid IS NOT NULL", userID).Find(&nodes)
+	var u unitOfWork
 	for _, n := range nodes {
-		if n.Fid != nil {
-			p := fmt.Sprintf("%s/%d", dataDir, *n.Fid)
-			_ = os.Remove(p)
-			thumbPath := fmt.Sprintf("%s/%d.jpg", thumbDir, *n.Fid)
-			_ = os.Remove(thumbPath)
-		}
+		u.discard(*n.Fid)
 	}
-	db.Where("user_id = ?", userID).Delete(&Node{})
-	db.Where("user_id = ?", userID).Delete(&Share{})
-	result := db.Delete(&User{}, userID)
-	if result.Error != nil {
+	err = u.commit(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&Node{}, &Share{}, &Change{}, &ChangeHorizon{}, &AccessToken{}, &PasswordReset{}} {
+			if err := tx.Where("user_id = ?", userID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&User{}, userID).Error
+	})
+	if err != nil {
 		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
 		return
 	}
@@ -1390,33 +2170,139 @@ var favicon []byte
 //go:embed assets/apple-touch-icon.png
 var appleTouchIcon []byte
 
-func main() {
+func openDB() {
 	var err error
-	db, err = gorm.Open(sqlite.Open(dbFile), &gorm.Config{})
+	// Transactions take the write lock up front, so that concurrent
+	// requests wait for each other instead of failing with SQLITE_BUSY.
+	db, err = gorm.Open(sqlite.Open(dbFile+"?_pragma=busy_timeout(10000)&_txlock=immediate"), &gorm.Config{})
 	if err != nil {
 		panic(err)
 	}
-	db.AutoMigrate(&Config{}, &User{}, &Node{}, &Share{})
+	db.AutoMigrate(&Config{}, &User{}, &Node{}, &Share{}, &Change{}, &ChangeHorizon{}, &DataKey{}, &CompressedBlob{}, &AccessToken{}, &AuditLog{}, &PasswordReset{}, &SigningKey{}, &BlobHold{}, &PendingRemoval{})
+	if err := fillAncestry(db); err != nil {
+		fmt.Println("warning: failed to compute tree paths:", err)
+	}
+	openStore()
+	migrateUniqueNames()
+	migrateNFCNames()
+	migrateSortKeys()
+}
+
+// instanceLock is held by the server while it runs, so that commands that
+// need it stopped can tell.
+const instanceLock = "./hanas.lock"
+
+var errInstanceLocked = errors.New("the server is running; stop it first")
+
+// offlineCommands write to the database or the store behind the server's
+// back, so they take the instance lock and refuse to run next to it.
+var offlineCommands = map[string]bool{
+	"migrate-storage":         true,
+	"recalc-sizes":            true,
+	"rotate-key":              true,
+	"regenerate-share-tokens": true,
+	"promote-admin":           true,
+}
+
+func runCommand(name string, args []string) int {
+	if name == "restore" {
+		// Restore replaces database.db, so it must not hold it open.
+		return restoreCommand(args)
+	}
+	if offlineCommands[name] {
+		release, err := lockInstance(instanceLock)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot run %s: %v\n", name, err)
+			return 1
+		}
+		defer release()
+	}
+	openDB()
+	switch name {
+	case "scrub":
+		return scrubCommand(args)
+	case "fsck":
+		return fsckCommand(args)
+	case "backup":
+		return backupCommand(args)
+	case "migrate-storage":
+		return migrateStorageCommand(args)
+	case "rotate-key":
+		return rotateKeyCommand(args)
+	case "rotate-jwt-key":
+		return rotateJWTCommand(args)
+	case "regenerate-share-tokens":
+		return regenerateSharesCommand(args)
+	case "recalc-sizes":
+		return recalcSizesCommand(args)
+	case "promote-admin":
+		return promoteAdminCommand(args)
+	}
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n", name)
+	return 1
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	release, err := lockInstance(instanceLock)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot start:", err)
+		os.Exit(1)
+	}
+	defer release()
+	openDB()
 	if err := initJWTSecret(); err != nil {
 		panic(err)
 	}
+	ensureAdmin()
+	migrateSizes()
+	if !blobsHeld() {
+		// Removals left behind by a backup that did not finish.
+		flushRemovals()
+	}
+	startScrubScheduler()
+	startChangePruner()
 	http.HandleFunc("/register", Register)
 	http.HandleFunc("/login", Login)
 	http.HandleFunc("/logout", Logout)
+	http.HandleFunc("/auth/methods", AuthMethods)
+	http.HandleFunc("/auth/oidc/login", OIDCLogin)
+	http.HandleFunc("/auth/oidc/callback", OIDCCallback)
 	http.HandleFunc("/me", authMiddleware(Me))
 	http.HandleFunc("/file/", authMiddleware(GetFile))
 	http.HandleFunc("/thumbnail/", authMiddleware(GetThumbnail))
 	http.HandleFunc("/node/", authMiddleware(GetJson))
 	http.HandleFunc("/upload", authMiddleware(UpFile))
+	http.HandleFunc("/upload/files", authMiddleware(UpFiles))
 	http.HandleFunc("/upload/progress", UploadProgressSSE)
 	http.HandleFunc("/copy", authMiddleware(CpFile))
 	http.HandleFunc("/move", authMiddleware(MvFile))
 	http.HandleFunc("/rename", authMiddleware(RnFile))
 	http.HandleFunc("/delete", authMiddleware(DlFile))
+	http.HandleFunc("/batch", authMiddleware(Batch))
+	http.HandleFunc("/jobs/", authMiddleware(Jobs))
 	http.HandleFunc("/share/create", authMiddleware(CreateShare))
 	http.HandleFunc("/share/delete", authMiddleware(DeleteShare))
 	http.HandleFunc("/s/", GetSharedFile)
 	http.HandleFunc("/delete-account", authMiddleware(DeleteAccount))
+	http.HandleFunc("/account/password", authMiddleware(ChangePassword))
+	http.HandleFunc("/password-reset", ResetPassword)
+	http.HandleFunc("/changes", authMiddleware(GetChanges))
+	http.HandleFunc("/tokens", authMiddleware(Tokens))
+	http.HandleFunc("/tokens/", authMiddleware(Tokens))
+	http.HandleFunc("/export", authMiddleware(Export))
+	http.HandleFunc("/export/", authMiddleware(Export))
+	http.HandleFunc("/import", authMiddleware(Import))
+	http.HandleFunc("/import/", authMiddleware(Import))
+	http.HandleFunc("/admin/scrub", adminMiddleware(AdminScrub))
+	http.HandleFunc("/admin/fsck", adminMiddleware(AdminFsck))
+	http.HandleFunc("/admin/backup", adminMiddleware(AdminBackup))
+	http.HandleFunc("/admin/audit", adminMiddleware(AdminAudit))
+	http.HandleFunc("/admin/jwt/rotate", adminMiddleware(AdminRotateJWT))
+	http.HandleFunc("/admin/users/", adminMiddleware(AdminPasswordReset))
+	registerAPI(http.DefaultServeMux)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		_, _ = w.Write([]byte(indexHtmlContent))
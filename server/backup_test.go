@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// openRestored opens the database restored into dir.
+func openRestored(t *testing.T, dir string) *gorm.DB {
+	t.Helper()
+	rdb, err := gorm.Open(sqlite.Open(filepath.Join(dir, backupDatabase)), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := rdb.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return rdb
+}
+
+func TestBackupRestore(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	first := nodeByID(t, uploadTestFile(t, "first.txt", "first", root.ID, user.ID))
+	full := filepath.Join(t.TempDir(), "full")
+	if _, err := writeBackup(dirSink{dir: full}, nil); err != nil {
+		t.Fatal(err)
+	}
+	base, err := openBackup(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := nodeByID(t, uploadTestFile(t, "second.txt", "second", root.ID, user.ID))
+	incr := filepath.Join(t.TempDir(), "incr.tar.gz")
+	f, err := os.Create(incr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := writeBackup(newTarSink(f, true), &base.manifest)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Blobs) != 2 || m.Blobs[0].In != base.manifest.ID || m.Blobs[1].In != m.ID {
+		t.Fatalf("incremental manifest: %+v", m.Blobs)
+	}
+	top, err := openBackup(incr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreBackup(t.TempDir(), []*backupSource{top}, true, false); err == nil {
+		t.Fatal("restored an incremental backup without its base")
+	}
+
+	dir := t.TempDir()
+	if err := restoreBackup(dir, []*backupSource{top, base}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	rdb := openRestored(t, dir)
+	var names []string
+	rdb.Model(&Node{}).Where("fid IS NOT NULL").Order("name").Pluck("name", &names)
+	if len(names) != 2 || names[0] != "first.txt" || names[1] != "second.txt" {
+		t.Fatalf("restored files: %q", names)
+	}
+	for _, n := range []Node{first, second} {
+		if _, err := os.Stat(filepath.Join(dir, dataDir, blobKey(*n.Fid))); err != nil {
+			t.Fatalf("blob of %s: %v", n.Name, err)
+		}
+	}
+	var holds int64
+	rdb.Model(&BlobHold{}).Count(&holds)
+	if holds != 0 {
+		t.Fatalf("the restored instance has %d blob holds", holds)
+	}
+	if err := restoreBackup(dir, []*backupSource{top, base}, false, false); err == nil {
+		t.Fatal("restored over an instance without -force")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// maxBatchItems bounds the source IDs of one batch request.
+const maxBatchItems = 10000
+
+// BatchRequest starts a job that copies, moves or deletes many nodes.
+// Overwrite is the older form of Conflict "overwrite".
+type BatchRequest struct {
+	Op        string `json:"op"`
+	SrcIDs    []uint `json:"src_ids"`
+	DstID     uint   `json:"dst_id,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+	Conflict  string `json:"conflict,omitempty"`
+}
+
+var (
+	errBatchOp    = errors.New("op must be copy, move or delete")
+	errBatchEmpty = errors.New("src_ids required")
+	errBatchSize  = fmt.Errorf("at most %d src_ids per batch", maxBatchItems)
+	errBatchDst   = errors.New("dst_id required")
+	errNotFound   = errors.New("not found")
+)
+
+// startBatch checks a batch request and starts its job. Sources outside the
+// token's folder refuse the whole batch; missing ones only fail themselves.
+func startBatch(r *http.Request, userID uint, req BatchRequest) (*Job, error) {
+	switch req.Op {
+	case "copy", "move":
+		if req.DstID == 0 {
+			return nil, errBatchDst
+		}
+		if _, err := destinationFolder(req.DstID, userID); err != nil {
+			return nil, err
+		}
+		if !nodeAllowed(r, Node{ID: req.DstID, UserID: userID}) {
+			return nil, errOutsideFolder
+		}
+	case "delete":
+	default:
+		return nil, errBatchOp
+	}
+	if len(req.SrcIDs) == 0 {
+		return nil, errBatchEmpty
+	}
+	policy, err := conflictPolicy(req.Conflict, req.Overwrite)
+	if err != nil {
+		return nil, err
+	}
+	req.Conflict = policy
+	if len(req.SrcIDs) > maxBatchItems {
+		return nil, errBatchSize
+	}
+	var found []Node
+	if err := db.Where("id IN ? AND user_id = ?", req.SrcIDs, userID).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]Node, len(found))
+	for _, n := range found {
+		if !nodeAllowed(r, n) {
+			return nil, errOutsideFolder
+		}
+		byID[n.ID] = n
+	}
+	return startJob(userID, req.Op, func(j *Job) error {
+		return runBatch(j, userID, req, byID)
+	})
+}
+
+// runBatch works through the sources in the order given. Progress counts
+// files; folders are done when everything below them is. A source below
+// one moved or deleted earlier in the batch went along with it and is
+// skipped.
+func runBatch(j *Job, userID uint, req BatchRequest, byID map[uint]Node) error {
+	var items, bytes int64
+	for _, n := range byID {
+		size, _, files := totals(n)
+		items += files
+		bytes += size
+	}
+	j.setTotal(items, bytes)
+	succeeded, skipped, failed := 0, 0, 0
+	defer func() {
+		j.set("succeeded", succeeded)
+		j.set("skipped", skipped)
+		j.set("failed", failed)
+	}()
+	done := make(map[uint]bool)
+	for _, id := range req.SrcIDs {
+		if err := j.stopped(); err != nil {
+			return err
+		}
+		src, ok := byID[id]
+		if !ok {
+			j.fail(Node{ID: id}, errNotFound)
+			failed++
+			continue
+		}
+		if slices.ContainsFunc(ancestorIDs(src.Ancestry), func(a uint) bool { return done[a] }) {
+			size, _, files := totals(src)
+			j.advance(files, size)
+			skipped++
+			continue
+		}
+		// The tree may have changed since the batch was started.
+		if err := db.Where("id = ? AND user_id = ?", id, userID).First(&src).Error; err != nil {
+			j.fail(Node{ID: id}, errNotFound)
+			failed++
+			continue
+		}
+		var err error
+		switch {
+		case src.OyaID == nil:
+			err = errors.New("the root folder cannot be copied, moved or deleted")
+		case req.Op == "copy":
+			_, err = copyNodeTo(src, req.DstID, userID, req.Conflict, j)
+		case req.Op == "move":
+			_, err = moveNodeTo(src, req.DstID, userID, req.Conflict)
+		default:
+			err = DeleteNodeRecursive(src.ID, userID)
+		}
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+		if errors.Is(err, errSkipped) {
+			size, _, files := totals(src)
+			j.advance(files, size)
+			skipped++
+			continue
+		}
+		if err != nil {
+			j.fail(src, err)
+			failed++
+			continue
+		}
+		if req.Op != "copy" {
+			size, _, files := totals(src)
+			j.advance(files, size)
+			done[src.ID] = true
+		}
+		succeeded++
+	}
+	return nil
+}
+
+func batchErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errOutsideFolder):
+		return http.StatusForbidden
+	case errors.Is(err, errBatchOp), errors.Is(err, errBatchEmpty), errors.Is(err, errBatchSize), errors.Is(err, errBatchDst), errors.Is(err, errConflictPolicy):
+		return http.StatusBadRequest
+	}
+	return errorStatus(err)
+}
+
+// Batch handles POST /batch.
+func Batch(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := startBatch(r, userID, req)
+	if err != nil {
+		http.Error(w, err.Error(), batchErrorStatus(err))
+		return
+	}
+	writeJob(w, http.StatusAccepted, j)
+}
+
+// Jobs handles GET /jobs/<id> for any job and DELETE /jobs/<id> to cancel
+// one.
+func Jobs(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	j, ok := getJob(userID, strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/"))
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJob(w, http.StatusOK, j)
+	case http.MethodDelete:
+		j.Cancel()
+		writeJob(w, http.StatusAccepted, j)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func apiBatch(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromRequest(r)
+	var req BatchRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	j, err := startBatch(r, userID, req)
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusAccepted, j.status())
+	case errors.Is(err, errOutsideFolder), errors.Is(err, errTooManyJobs):
+		apiNodeError(w, err)
+	case batchErrorStatus(err) == http.StatusBadRequest:
+		apiError(w, http.StatusBadRequest, "invalid_batch", err.Error())
+	default:
+		apiNodeError(w, err)
+	}
+}
+
+func apiJob(w http.ResponseWriter, r *http.Request) (*Job, bool) {
+	userID, _ := getUserIDFromRequest(r)
+	j, ok := getJob(userID, r.PathValue("id"))
+	if !ok {
+		apiError(w, http.StatusNotFound, "", "job not found")
+	}
+	return j, ok
+}
+
+func apiGetJob(w http.ResponseWriter, r *http.Request) {
+	if j, ok := apiJob(w, r); ok {
+		writeJSON(w, http.StatusOK, j.status())
+	}
+}
+
+func apiCancelJob(w http.ResponseWriter, r *http.Request) {
+	if j, ok := apiJob(w, r); ok {
+		j.Cancel()
+		writeJSON(w, http.StatusAccepted, j.status())
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitJob polls a job until it is no longer running.
+func waitJob(t *testing.T, j *Job) JobStatus {
+	t.Helper()
+	for range 500 {
+		if st := j.status(); st.Status != jobRunning {
+			return st
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s is still running", j.ID)
+	return JobStatus{}
+}
+
+func newFolder(t *testing.T, name string, oyaID uint, userID uint) uint {
+	t.Helper()
+	id, err := UploadNode(name, nil, true, &oyaID, userID, conflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func childNames(t *testing.T, oyaID uint) []string {
+	t.Helper()
+	var nodes []Node
+	db.Where("oya_id = ?", oyaID).Order("name").Find(&nodes)
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+func TestBatchCopyMoveDelete(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	docs := newFolder(t, "docs", root.ID, user.ID)
+	uploadTestFile(t, "a.txt", "aaaa", docs, user.ID)
+	uploadTestFile(t, "b.txt", "bb", docs, user.ID)
+	single := uploadTestFile(t, "c.txt", "cccccc", root.ID, user.ID)
+	dst := newFolder(t, "dst", root.ID, user.ID)
+	r := httptest.NewRequest("POST", "/batch", nil)
+
+	j, err := startBatch(r, user.ID, BatchRequest{Op: "copy", SrcIDs: []uint{docs, single, 999}, DstID: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := waitJob(t, j)
+	if st.Status != jobDone || st.Result["succeeded"] != 2 || st.Result["failed"] != 1 {
+		t.Fatalf("copy job: %+v", st)
+	}
+	if p := st.Progress; p == nil || p.Items != 3 || p.ItemsTotal != 3 || p.Bytes != 12 || p.BytesTotal != 12 {
+		t.Fatalf("copy progress: %+v", st.Progress)
+	}
+	if len(st.Failures) != 1 || st.Failures[0].NodeID != 999 {
+		t.Fatalf("copy failures: %+v", st.Failures)
+	}
+	if got := strings.Join(childNames(t, dst), ","); got != "c.txt,docs" {
+		t.Fatalf("destination after copy holds %s", got)
+	}
+
+	j, err = startBatch(r, user.ID, BatchRequest{Op: "move", SrcIDs: []uint{docs, single}, DstID: dst, Conflict: conflictRename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := waitJob(t, j); st.Status != jobDone || st.Result["succeeded"] != 2 {
+		t.Fatalf("move job: %+v", st)
+	}
+	if got := strings.Join(childNames(t, dst), ","); got != "c (1).txt,c.txt,docs,docs (1)" {
+		t.Fatalf("destination after move holds %s", got)
+	}
+
+	j, err = startBatch(r, user.ID, BatchRequest{Op: "move", SrcIDs: []uint{dst}, DstID: docs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := waitJob(t, j); st.Result["failed"] != 1 || !strings.Contains(st.Failures[0].Error, errIntoSelf.Error()) {
+		t.Fatalf("move into own subtree: %+v", st)
+	}
+
+	j, err = startBatch(r, user.ID, BatchRequest{Op: "delete", SrcIDs: []uint{dst, root.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := waitJob(t, j); st.Result["succeeded"] != 1 || st.Result["failed"] != 1 {
+		t.Fatalf("delete job: %+v", st)
+	}
+	if got := childNames(t, root.ID); len(got) != 0 {
+		t.Fatalf("root still holds %q", got)
+	}
+
+	for _, req := range []BatchRequest{
+		{Op: "rename", SrcIDs: []uint{1}},
+		{Op: "delete"},
+		{Op: "copy", SrcIDs: []uint{1}},
+		{Op: "delete", SrcIDs: []uint{1}, Conflict: "merge"},
+	} {
+		if _, err := startBatch(r, user.ID, req); batchErrorStatus(err) != 400 {
+			t.Errorf("%+v: %v, want a bad request", req, err)
+		}
+	}
+}
+
+func TestBatchNestedSources(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	a := newFolder(t, "a", root.ID, user.ID)
+	f := uploadTestFile(t, "f.txt", "12345", a, user.ID)
+	dst := newFolder(t, "dst", root.ID, user.ID)
+	r := httptest.NewRequest("POST", "/batch", nil)
+
+	j, err := startBatch(r, user.ID, BatchRequest{Op: "move", SrcIDs: []uint{a, f}, DstID: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := waitJob(t, j); st.Status != jobDone || st.Result["succeeded"] != 1 || st.Result["skipped"] != 1 {
+		t.Fatalf("move job: %+v", st)
+	}
+	if n := nodeByID(t, f); *n.OyaID != a || n.Ancestry != fmt.Sprintf("/%d/%d/%d/%d/", root.ID, dst, a, f) {
+		t.Fatalf("f.txt is in %d with ancestry %s", *n.OyaID, n.Ancestry)
+	}
+	checkTotals(t, "move", dst, 5, 1)
+
+	j, err = startBatch(r, user.ID, BatchRequest{Op: "delete", SrcIDs: []uint{a, f}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := waitJob(t, j); st.Status != jobDone || st.Result["succeeded"] != 1 || st.Result["skipped"] != 1 || len(st.Failures) != 0 {
+		t.Fatalf("delete job: %+v", st)
+	}
+	checkTotals(t, "delete", dst, 0, 0)
+}
+
+func TestCrossedMoves(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	a := newFolder(t, "a", root.ID, user.ID)
+	b := newFolder(t, "b", root.ID, user.ID)
+	var nodeA, nodeB Node
+	db.First(&nodeA, a)
+	db.First(&nodeB, b)
+	// Both moves passed their early checks before either ran.
+	if _, err := moveNodeAs(nodeA, b, "a", user.ID, conflictFail); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := moveNodeAs(nodeB, a, "b", user.ID, conflictFail); !errors.Is(err, errIntoSelf) {
+		t.Fatalf("second of two crossed moves: %v, want %v", err, errIntoSelf)
+	}
+	if _, err := copyNodeTo(nodeB, a, user.ID, conflictFail, nil); !errors.Is(err, errIntoSelf) {
+		t.Fatalf("copy into own subtree: %v, want %v", err, errIntoSelf)
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	started := make(chan struct{})
+	j, err := startJob(1001, "test", func(j *Job) error {
+		close(started)
+		<-j.ctx.Done()
+		return j.stopped()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	j.Cancel()
+	if st := waitJob(t, j); st.Status != jobCancelled || st.FinishedAt == nil {
+		t.Fatalf("cancelled job: %+v", st)
+	}
+}
+
+func TestJobPanicFails(t *testing.T) {
+	j, err := startJob(1002, "test", func(j *Job) error {
+		var m map[string]int
+		m["boom"]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := waitJob(t, j); st.Status != jobFailed || !strings.HasPrefix(st.Error, "panic:") {
+		t.Fatalf("panicking job: %+v", st)
+	}
+}
+
+func TestJobsPerUser(t *testing.T) {
+	t.Setenv("HANAS_JOBS_PER_USER", "2")
+	release := make(chan struct{})
+	block := func(j *Job) error {
+		<-release
+		return nil
+	}
+	var running []*Job
+	for range 2 {
+		j, err := startJob(1003, "test", block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		running = append(running, j)
+	}
+	if _, err := startJob(1003, "test", block); !errors.Is(err, errTooManyJobs) {
+		t.Fatalf("third job: %v, want %v", err, errTooManyJobs)
+	}
+	other, err := startJob(1004, "test", block)
+	if err != nil {
+		t.Fatalf("another user's job: %v", err)
+	}
+	close(release)
+	for _, j := range append(running, other) {
+		waitJob(t, j)
+	}
+	j, err := startJob(1003, "test", func(*Job) error { return nil })
+	if err != nil {
+		t.Fatalf("job after the others finished: %v", err)
+	}
+	waitJob(t, j)
+	if _, ok := getJob(1004, j.ID); ok {
+		t.Fatal("another user can see the job")
+	}
+}
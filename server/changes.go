@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	changeCreate = "create"
+	changeModify = "modify"
+	changeMove   = "move"
+	changeDelete = "delete"
+
+	defaultChangeLimit = 1000
+	maxChangeLimit     = 10000
+
+	changePruneInterval = time.Hour
+)
+
+// Change is one entry of the per-user change journal. Its ID doubles as the
+// sync cursor: it only ever grows, so "everything after cursor N" is exact.
+type Change struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement" json:"cursor"`
+	UserID     uint      `gorm:"not null;index" json:"-"`
+	NodeID     uint      `gorm:"not null;index" json:"node_id"`
+	Kind       string    `gorm:"not null" json:"kind"`
+	Name       string    `json:"name"`
+	IsDir      bool      `json:"is_dir"`
+	OyaID      *uint     `json:"oya_id,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	ModifiedAt time.Time `json:"modified_at"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"changed_at"`
+}
+
+// ChangeHorizon records how far a user's journal has been pruned. Cursors
+// below Pruned would silently skip changes, so they are refused.
+type ChangeHorizon struct {
+	UserID uint `gorm:"primaryKey;autoIncrement:false"`
+	Pruned uint `gorm:"not null"`
+}
+
+// ChangesPage is one page of the change journal.
+type ChangesPage struct {
+	Changes []Change `json:"changes"`
+	Cursor  uint     `json:"cursor"`
+	HasMore bool     `json:"has_more"`
+}
+
+// blobSizes returns the content size of a file and what it takes up in
+// storage.
+func blobSizes(fid *uint) (int64, int64) {
+	if fid == nil {
+		return 0, 0
+	}
+	info, err := store.Stat(blobKey(*fid))
+	if err != nil {
+		return 0, 0
+	}
+	return info.Size, info.Stored
+}
+
+func recordChange(tx *gorm.DB, kind string, n Node) error {
+	c := Change{
+		UserID:     n.UserID,
+		NodeID:     n.ID,
+		Kind:       kind,
+		Name:       n.Name,
+		IsDir:      n.IsDir,
+		OyaID:      n.OyaID,
+		ModifiedAt: n.UpdatedAt,
+	}
+	if kind != changeDelete && !n.IsDir {
+		c.Size = n.Size
+		// Not nodeHash: reading a whole blob would hold the write lock.
+		// Files from before hashes were recorded get theirs from a scrub.
+		c.Hash = n.Hash
+	}
+	if err := tx.Create(&c).Error; err != nil {
+		return fmt.Errorf("failed to record change: %w", err)
+	}
+	return nil
+}
+
+func latestCursor(userID uint) uint {
+	var c Change
+	if err := db.Where("user_id = ?", userID).Order("id DESC").First(&c).Error; err != nil {
+		return changeHorizon(userID)
+	}
+	return c.ID
+}
+
+func changeHorizon(userID uint) uint {
+	var h ChangeHorizon
+	db.Where("user_id = ?", userID).Limit(1).Find(&h)
+	return h.Pruned
+}
+
+// pruneChanges deletes journal entries recorded before cutoff and moves
+// each affected user's horizon past them.
+func pruneChanges(cutoff time.Time) (int64, error) {
+	var pruned int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var horizons []ChangeHorizon
+		if err := tx.Model(&Change{}).Select("user_id, MAX(id) AS pruned").
+			Where("created_at < ?", cutoff).Group("user_id").Scan(&horizons).Error; err != nil {
+			return err
+		}
+		if len(horizons) == 0 {
+			return nil
+		}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"pruned"}),
+		}).Create(&horizons).Error; err != nil {
+			return err
+		}
+		res := tx.Where("created_at < ?", cutoff).Delete(&Change{})
+		pruned = res.RowsAffected
+		return res.Error
+	})
+	return pruned, err
+}
+
+// startChangePruner keeps the journal to change_retention_days; 0 keeps
+// it forever.
+func startChangePruner() {
+	days := configInt("change_retention_days", 90)
+	if days <= 0 {
+		return
+	}
+	retention := time.Duration(days) * 24 * time.Hour
+	go func() {
+		for ; ; time.Sleep(changePruneInterval) {
+			n, err := pruneChanges(time.Now().Add(-retention))
+			if err != nil {
+				fmt.Println("warning: failed to prune change journal:", err)
+			} else if n > 0 {
+				fmt.Printf("Pruned %d journal entries older than %d days\n", n, days)
+			}
+		}
+	}()
+}
+
+func GetChanges(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if _, restricted := tokenFolder(r); restricted {
+		// The journal covers the whole account.
+		http.Error(w, "Forbidden: token is restricted to a folder", http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	resp := ChangesPage{Changes: []Change{}}
+	cursorStr := q.Get("cursor")
+	if cursorStr == "" {
+		// No cursor: hand out the current position so a client can take a
+		// full listing with GetJson and follow the journal from here on.
+		resp.Cursor = latestCursor(userID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	cursor, err := strconv.ParseUint(cursorStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid cursor", http.StatusBadRequest)
+		return
+	}
+	if uint(cursor) < changeHorizon(userID) {
+		// The changes after it are gone; the client has to list everything
+		// again and continue from the current cursor.
+		http.Error(w, "cursor expired, resync", http.StatusGone)
+		return
+	}
+	limit := defaultChangeLimit
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 {
+		limit = min(l, maxChangeLimit)
+	}
+	var changes []Change
+	if err := db.Where("user_id = ? AND id > ?", userID, cursor).Order("id").Limit(limit + 1).Find(&changes).Error; err != nil {
+		http.Error(w, "failed to read changes", http.StatusInternalServerError)
+		return
+	}
+	if len(changes) > limit {
+		changes = changes[:limit]
+		resp.HasMore = true
+	}
+	resp.Cursor = uint(cursor)
+	if len(changes) > 0 {
+		resp.Changes = changes
+		resp.Cursor = changes[len(changes)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
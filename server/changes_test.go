@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// changesPage follows the journal from cursor and fails unless the status
+// is want.
+func changesPage(t *testing.T, srv *httptest.Server, user User, query string, want int) ChangesPage {
+	t.Helper()
+	resp, b := apiCall(t, srv, &user, "GET", apiPrefix+"/changes"+query, nil)
+	if resp.StatusCode != want {
+		t.Fatalf("changes%s: %d %s, want %d", query, resp.StatusCode, b, want)
+	}
+	var page ChangesPage
+	if want == http.StatusOK {
+		if err := json.Unmarshal(b, &page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return page
+}
+
+func changeKinds(page ChangesPage) []string {
+	var kinds []string
+	for _, c := range page.Changes {
+		kinds = append(kinds, c.Kind+" "+c.Name)
+	}
+	return kinds
+}
+
+func TestChangeCursors(t *testing.T) {
+	newTestDB(t)
+	srv := newAPIServer(t)
+	user, root := newTestUser(t, "alice")
+	other, otherRoot := newTestUser(t, "bob")
+	start := changesPage(t, srv, user, "", http.StatusOK)
+	if start.Cursor != 0 || len(start.Changes) != 0 {
+		t.Fatalf("empty journal: %+v", start)
+	}
+	id := uploadTestFile(t, "a.txt", "a", root.ID, user.ID)
+	uploadTestFile(t, "b.txt", "b", otherRoot.ID, other.ID)
+	docs := newFolder(t, "docs", root.ID, user.ID)
+	if _, err := moveNodeAs(nodeByID(t, id), docs, "a.txt", user.ID, conflictFail); err != nil {
+		t.Fatal(err)
+	}
+
+	page := changesPage(t, srv, user, "?cursor=0&limit=2", http.StatusOK)
+	if got := fmt.Sprint(changeKinds(page)); got != "[create a.txt create docs]" || !page.HasMore {
+		t.Fatalf("first page: %s, has_more %v", got, page.HasMore)
+	}
+	if page.Changes[0].Hash != sha256Hex("a") || page.Changes[0].Size != 1 {
+		t.Fatalf("file change: %+v", page.Changes[0])
+	}
+	page = changesPage(t, srv, user, fmt.Sprintf("?cursor=%d", page.Cursor), http.StatusOK)
+	if got := fmt.Sprint(changeKinds(page)); got != "[move a.txt]" || page.HasMore {
+		t.Fatalf("second page: %s, has_more %v", got, page.HasMore)
+	}
+	if *page.Changes[0].OyaID != docs {
+		t.Fatalf("move into %d, want %d", *page.Changes[0].OyaID, docs)
+	}
+	end := changesPage(t, srv, user, fmt.Sprintf("?cursor=%d", page.Cursor), http.StatusOK)
+	if len(end.Changes) != 0 || end.Cursor != page.Cursor {
+		t.Fatalf("past the end: %+v", end)
+	}
+	if now := changesPage(t, srv, user, "", http.StatusOK); now.Cursor != page.Cursor {
+		t.Fatalf("current cursor %d, want %d", now.Cursor, page.Cursor)
+	}
+	changesPage(t, srv, user, "?cursor=x", http.StatusBadRequest)
+}
+
+func TestChangeRetention(t *testing.T) {
+	newTestDB(t)
+	srv := newAPIServer(t)
+	user, root := newTestUser(t, "alice")
+	other, otherRoot := newTestUser(t, "bob")
+	uploadTestFile(t, "old.txt", "old", root.ID, user.ID)
+	uploadTestFile(t, "kept.txt", "kept", otherRoot.ID, other.ID)
+	seen := changesPage(t, srv, user, "?cursor=0", http.StatusOK).Cursor
+	db.Model(&Change{}).Where("user_id = ?", user.ID).UpdateColumn("created_at", time.Now().Add(-48*time.Hour))
+	uploadTestFile(t, "new.txt", "new", root.ID, user.ID)
+
+	if n, err := pruneChanges(time.Now().Add(-24 * time.Hour)); err != nil || n != 1 {
+		t.Fatalf("pruned %d entries: %v", n, err)
+	}
+	resp, b := apiCall(t, srv, &user, "GET", apiPrefix+"/changes?cursor=0", nil)
+	var e ErrorResponse
+	if json.Unmarshal(b, &e); resp.StatusCode != http.StatusGone || e.Error.Code != "gone" {
+		t.Fatalf("expired cursor: %d %s", resp.StatusCode, b)
+	}
+	// A client that had seen the pruned entries carries on.
+	if got := fmt.Sprint(changeKinds(changesPage(t, srv, user, fmt.Sprintf("?cursor=%d", seen), http.StatusOK))); got != "[create new.txt]" {
+		t.Fatalf("after the horizon: %s", got)
+	}
+	if got := changesPage(t, srv, other, "?cursor=0", http.StatusOK); len(got.Changes) != 1 {
+		t.Fatalf("another user's journal: %+v", got)
+	}
+
+	// Once everything is pruned, the current cursor is the horizon, so a
+	// resync does not land below it again.
+	db.Model(&Change{}).Where("user_id = ?", user.ID).UpdateColumn("created_at", time.Now().Add(-48*time.Hour))
+	if _, err := pruneChanges(time.Now().Add(-24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	now := changesPage(t, srv, user, "", http.StatusOK).Cursor
+	if now == 0 {
+		t.Fatal("the current cursor of a pruned journal is 0")
+	}
+	if got := changesPage(t, srv, user, fmt.Sprintf("?cursor=%d", now), http.StatusOK); len(got.Changes) != 0 {
+		t.Fatalf("after a resync: %+v", got)
+	}
+}
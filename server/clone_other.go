@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// cloneFile copies src to dst. Go uses the platform's file copy call where
+// it has one.
+func cloneFile(dst, src *os.File) (int64, error) {
+	return io.Copy(dst, src)
+}
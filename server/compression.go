@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed blobs use the zstd seekable format, so range reads only
+// decompress the frames they touch:
+//
+//	marker skippable frame ("HNZ1") | frame 0 | frame 1 | ... | seek table
+const (
+	zstdFrameSize      = 256 << 10
+	zstdSampleSize     = 64 << 10
+	zstdSkippableMagic = 0x184D2A50
+	zstdSeekTableMagic = 0x184D2A5E
+	zstdSeekableMagic  = 0x8F92EAB1
+	zstdFooterSize     = 9
+	compMarker         = "HNZ1"
+	compHeaderSize     = 8 + len(compMarker)
+)
+
+// CompressedBlob records which blobs are stored compressed and their
+// content size, so listings do not have to read the seek table.
+type CompressedBlob struct {
+	Key       string `gorm:"primaryKey"`
+	Size      int64
+	UpdatedAt time.Time
+}
+
+// compStore compresses blobs that are worth it before handing them to the
+// wrapped store. It sits above encryption, which leaves nothing to compress.
+type compStore struct {
+	inner   BlobStore
+	enabled bool
+	enc     *zstd.Encoder
+	dec     *zstd.Decoder
+}
+
+func newCompStore(inner BlobStore) (*compStore, error) {
+	s := &compStore{inner: inner}
+	switch mode := configValue("compression", ""); mode {
+	case "", "off":
+	case "zstd":
+		s.enabled = true
+	default:
+		return nil, fmt.Errorf("unknown compression %q", mode)
+	}
+	level, err := strconv.Atoi(configValue("compression_level", "3"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compression_level: %w", err)
+	}
+	if s.enc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level))); err != nil {
+		return nil, err
+	}
+	if s.dec, err = zstd.NewReader(nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compressedTypes are formats that are already compressed.
+var compressedTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "video/", "audio/",
+	"application/zip", "application/x-gzip", "application/x-rar-compressed",
+	"application/pdf", "font/woff", "font/woff2",
+}
+
+// worthCompressing looks at the start of a file: known compressed formats
+// are skipped, everything else is compressed unless its bytes look random.
+func worthCompressing(sample []byte) bool {
+	if len(sample) < 512 {
+		return false
+	}
+	mime := http.DetectContentType(sample)
+	for _, t := range compressedTypes {
+		if strings.HasPrefix(mime, t) {
+			return false
+		}
+	}
+	return entropy(sample) < 7.0
+}
+
+// entropy returns the Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var e float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(b))
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+func (s *compStore) compressed(key string) (CompressedBlob, bool) {
+	var rows []CompressedBlob
+	db.Where("key = ?", key).Limit(1).Find(&rows)
+	if len(rows) == 0 {
+		return CompressedBlob{}, false
+	}
+	return rows[0], true
+}
+
+func (s *compStore) compress(dst io.Writer, src io.Reader) error {
+	header := binary.LittleEndian.AppendUint32(nil, zstdSkippableMagic)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(compMarker)))
+	header = append(header, compMarker...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	var table []byte
+	frames := 0
+	buf := make([]byte, zstdFrameSize)
+	var out []byte
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			out = s.enc.EncodeAll(buf[:n], out[:0])
+			if _, werr := dst.Write(out); werr != nil {
+				return werr
+			}
+			table = binary.LittleEndian.AppendUint32(table, uint32(len(out)))
+			table = binary.LittleEndian.AppendUint32(table, uint32(n))
+			frames++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	footer := binary.LittleEndian.AppendUint32(nil, zstdSeekTableMagic)
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(table)+zstdFooterSize))
+	footer = append(footer, table...)
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(frames))
+	footer = append(footer, 0)
+	footer = binary.LittleEndian.AppendUint32(footer, zstdSeekableMagic)
+	_, err := dst.Write(footer)
+	return err
+}
+
+func (s *compStore) Put(key string, r io.Reader) (int64, error) {
+	if !s.enabled {
+		return s.putRaw(key, r)
+	}
+	sample := make([]byte, zstdSampleSize)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	sample = sample[:n]
+	r = io.MultiReader(bytes.NewReader(sample), r)
+	if !worthCompressing(sample) {
+		return s.putRaw(key, r)
+	}
+	// The row goes in first: a row next to a plain blob is harmless, a
+	// compressed blob without one is not.
+	_, existed := s.compressed(key)
+	if !existed {
+		if err := db.Create(&CompressedBlob{Key: key}).Error; err != nil {
+			return 0, fmt.Errorf("cannot record compression: %w", err)
+		}
+	}
+	pr, pw := io.Pipe()
+	cr := &countingReader{r: r}
+	go func() {
+		pw.CloseWithError(s.compress(pw, cr))
+	}()
+	_, err = s.inner.Put(key, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		if !existed {
+			db.Delete(&CompressedBlob{}, "key = ?", key)
+		}
+		return 0, err
+	}
+	db.Model(&CompressedBlob{}).Where("key = ?", key).Update("size", cr.n)
+	return cr.n, nil
+}
+
+func (s *compStore) putRaw(key string, r io.Reader) (int64, error) {
+	n, err := s.inner.Put(key, r)
+	if err == nil {
+		db.Where("key = ?", key).Delete(&CompressedBlob{})
+	}
+	return n, err
+}
+
+func (s *compStore) Open(key string) (Blob, error) {
+	b, err := s.inner.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.compressed(key); !ok {
+		return b, nil
+	}
+	header := make([]byte, compHeaderSize)
+	if n, err := io.ReadFull(b, header); err != nil || string(header[8:]) != compMarker {
+		if n > 0 {
+			if _, err := b.Seek(0, io.SeekStart); err != nil {
+				b.Close()
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	cb, err := s.openSeekable(b)
+	if err != nil {
+		b.Close()
+		return nil, fmt.Errorf("blob %s: %w", key, err)
+	}
+	return cb, nil
+}
+
+func (s *compStore) openSeekable(b Blob) (*compBlob, error) {
+	stored := b.Info().Size
+	footer := make([]byte, zstdFooterSize)
+	if _, err := b.Seek(stored-zstdFooterSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(b, footer); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != zstdSeekableMagic {
+		return nil, errors.New("seek table not found")
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer[:4]))
+	tableStart := stored - zstdFooterSize - frames*8
+	if tableStart < int64(compHeaderSize)+8 {
+		return nil, errors.New("seek table is corrupt")
+	}
+	table := make([]byte, frames*8)
+	if _, err := b.Seek(tableStart, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(b, table); err != nil {
+		return nil, err
+	}
+	cb := &compBlob{inner: b, dec: s.dec, info: b.Info(), cached: -1}
+	off, pos := int64(compHeaderSize), int64(0)
+	for i := int64(0); i < frames; i++ {
+		c := int64(binary.LittleEndian.Uint32(table[i*8:]))
+		d := int64(binary.LittleEndian.Uint32(table[i*8+4:]))
+		cb.frames = append(cb.frames, seekFrame{offset: off, size: c, start: pos, length: d})
+		off += c
+		pos += d
+	}
+	cb.info.Size = pos
+	return cb, nil
+}
+
+func (s *compStore) Stat(key string) (BlobInfo, error) {
+	info, err := s.inner.Stat(key)
+	if err != nil {
+		return info, err
+	}
+	if row, ok := s.compressed(key); ok {
+		info.Size = row.Size
+	}
+	return info, nil
+}
+
+func (s *compStore) Delete(key string) error {
+	if err := s.inner.Delete(key); err != nil {
+		return err
+	}
+	return db.Where("key = ?", key).Delete(&CompressedBlob{}).Error
+}
+
+// Copy copies the stored bytes as they are, compressed or not, together
+// with the compression row.
+func (s *compStore) Copy(src, dst string) (int64, error) {
+	c, ok := s.inner.(blobCopier)
+	if !ok {
+		return 0, errCopyUnsupported
+	}
+	row, compressed := s.compressed(src)
+	if compressed {
+		if err := db.Create(&CompressedBlob{Key: dst, Size: row.Size}).Error; err != nil {
+			return 0, fmt.Errorf("cannot record compression: %w", err)
+		}
+	}
+	n, err := c.Copy(src, dst)
+	if err != nil {
+		if compressed {
+			db.Delete(&CompressedBlob{}, "key = ?", dst)
+		}
+		return 0, err
+	}
+	if compressed {
+		n = row.Size
+	}
+	return n, nil
+}
+
+func (s *compStore) List(fn func(BlobInfo) error) error {
+	return s.inner.List(fn)
+}
+
+func (s *compStore) localPath(key string) (string, bool) {
+	if _, ok := s.compressed(key); ok {
+		return "", false
+	}
+	if p, ok := s.inner.(localPather); ok {
+		return p.localPath(key)
+	}
+	return "", false
+}
+
+type seekFrame struct {
+	offset, size  int64 // position in the stored blob
+	start, length int64 // position in the content
+}
+
+type compBlob struct {
+	inner  Blob
+	dec    *zstd.Decoder
+	info   BlobInfo
+	frames []seekFrame
+	pos    int64
+	cached int
+	plain  []byte
+}
+
+func (b *compBlob) Info() BlobInfo { return b.info }
+
+func (b *compBlob) Close() error { return b.inner.Close() }
+
+func (b *compBlob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.info.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.pos = offset
+	return offset, nil
+}
+
+func (b *compBlob) load(i int) error {
+	if b.cached == i {
+		return nil
+	}
+	f := b.frames[i]
+	if _, err := b.inner.Seek(f.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data := make([]byte, f.size)
+	if _, err := io.ReadFull(b.inner, data); err != nil {
+		return err
+	}
+	plain, err := b.dec.DecodeAll(data, b.plain[:0])
+	if err != nil || int64(len(plain)) != f.length {
+		b.cached = -1
+		return fmt.Errorf("blob %s: frame %d is corrupt", b.info.Key, i)
+	}
+	b.plain = plain
+	b.cached = i
+	return nil
+}
+
+func (b *compBlob) Read(p []byte) (int, error) {
+	if b.pos >= b.info.Size {
+		return 0, io.EOF
+	}
+	// Frames are all zstdFrameSize long except the last one.
+	i := int(b.pos / b.frames[0].length)
+	if i >= len(b.frames) {
+		i = len(b.frames) - 1
+	}
+	if err := b.load(i); err != nil {
+		return 0, err
+	}
+	n := copy(p, b.plain[b.pos-b.frames[i].start:])
+	b.pos += int64(n)
+	return n, nil
+}
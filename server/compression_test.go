@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestCompStoreFrameBoundaries(t *testing.T) {
+	t.Setenv("HANAS_COMPRESSION", "zstd")
+	newTestDB(t)
+	s, ok := store.(*compStore)
+	if !ok {
+		t.Fatalf("store is %T, want *compStore", store)
+	}
+	var text bytes.Buffer
+	for i := 0; text.Len() < 3*zstdFrameSize+500; i++ {
+		fmt.Fprintf(&text, "line %d of a file that compresses well\n", i)
+	}
+	for _, size := range []int64{zstdFrameSize, zstdFrameSize + 1, 3*zstdFrameSize + 500} {
+		content := text.Bytes()[:size]
+		key := blobKey(uint(size))
+		if _, err := s.Put(key, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := s.compressed(key); !ok {
+			t.Fatalf("size %d: blob was not compressed", size)
+		}
+		checkRange(t, s, key, content, 0, size+1)
+		for _, off := range []int64{zstdFrameSize - 1, zstdFrameSize, 2*zstdFrameSize - 3, size - 1} {
+			checkRange(t, s, key, content, off, 2)
+			checkRange(t, s, key, content, off, zstdFrameSize+2)
+		}
+	}
+}
+
+func TestCompStoreOverEncryption(t *testing.T) {
+	t.Setenv("HANAS_COMPRESSION", "zstd")
+	t.Setenv("HANAS_ENCRYPTION_KEY", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	newTestDB(t)
+	content := bytes.Repeat([]byte("compressed, then encrypted\n"), 2*zstdFrameSize/27)
+	if _, err := store.Put("1", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*compStore).compressed("1"); !ok {
+		t.Fatal("blob was not compressed")
+	}
+	if !store.(*compStore).inner.(*encStore).encrypted("1") {
+		t.Fatal("blob was not encrypted")
+	}
+	checkRange(t, store, "1", content, zstdFrameSize-5, encChunkSize)
+	checkRange(t, store, "1", content, int64(len(content))-3, 10)
+}
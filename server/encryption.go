@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Encrypted blobs are AES-256-GCM in chunks, nonce = chunk index, with a
+// fresh data key per Put:
+//
+//	magic "HNE1" | chunk size uint32 | data key ID (16 bytes)
+//	chunk 0 ciphertext+tag | chunk 1 ciphertext+tag | ...
+const (
+	encMagic      = "HNE1"
+	encHeaderSize = 4 + 4 + 16
+	encChunkSize  = 64 << 10
+	encTagSize    = 16
+)
+
+// DataKey is the per-blob content key, wrapped with a master key. Rotating
+// the master key rewraps these rows and leaves the blobs untouched.
+type DataKey struct {
+	ID          string `gorm:"primaryKey"`
+	BlobKey     string `gorm:"index"`
+	MasterKeyID string
+	Wrapped     []byte
+	CreatedAt   time.Time
+}
+
+type masterKey struct {
+	id  string
+	key []byte
+}
+
+// encStore encrypts blobs on Put and decrypts them on Open. Plain blobs
+// are served as they are.
+type encStore struct {
+	inner   BlobStore
+	current *masterKey
+	keys    map[string]*masterKey
+}
+
+func parseMasterKey(s string) (*masterKey, error) {
+	s = strings.TrimSpace(s)
+	// 64 hex digits are also valid base64, of the wrong length.
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		key, err = hex.DecodeString(s)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, base64 or hex encoded")
+	}
+	sum := sha256.Sum256(key)
+	return &masterKey{id: hex.EncodeToString(sum[:4]), key: key}, nil
+}
+
+// loadMasterKeys reads the current key and encryption_old_keys, which only
+// unwrap.
+func loadMasterKeys() (*masterKey, map[string]*masterKey, error) {
+	var list []string
+	if v := configValue("encryption_key", ""); v != "" {
+		list = append(list, v)
+	} else if p := configValue("encryption_key_file", ""); p != "" {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read encryption key file: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.TrimSpace(line) != "" {
+				list = append(list, line)
+			}
+		}
+	}
+	for _, v := range strings.Split(configValue("encryption_old_keys", ""), ",") {
+		if strings.TrimSpace(v) != "" {
+			list = append(list, v)
+		}
+	}
+	keys := make(map[string]*masterKey)
+	var current *masterKey
+	for i, v := range list {
+		k, err := parseMasterKey(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == 0 {
+			current = k
+		}
+		keys[k.id] = k
+	}
+	return current, keys, nil
+}
+
+func newEncStore(inner BlobStore) (*encStore, error) {
+	current, keys, err := loadMasterKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &encStore{inner: inner, current: current, keys: keys}, nil
+}
+
+func gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *masterKey) wrap(id string, dek []byte) ([]byte, error) {
+	aead, err := gcm(k.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dek, []byte(id)), nil
+}
+
+func (k *masterKey) unwrap(id string, wrapped []byte) ([]byte, error) {
+	aead, err := gcm(k.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("data key %s is corrupt", id)
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, wrapped[:n], wrapped[n:], []byte(id))
+}
+
+func (s *encStore) dataKey(key, id string) ([]byte, error) {
+	var rows []DataKey
+	if err := db.Where("id = ? AND blob_key = ?", id, key).Limit(1).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("data key %s not found", id)
+	}
+	mk := s.keys[rows[0].MasterKeyID]
+	if mk == nil {
+		return nil, fmt.Errorf("master key %s is not configured", rows[0].MasterKeyID)
+	}
+	return mk.unwrap(id, rows[0].Wrapped)
+}
+
+// encrypted reports whether key was stored by this store with encryption.
+func (s *encStore) encrypted(key string) bool {
+	var n int64
+	db.Model(&DataKey{}).Where("blob_key = ?", key).Count(&n)
+	return n > 0
+}
+
+func chunkNonce(i int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(i))
+	return nonce
+}
+
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// plainSize derives the content size from the size of an encrypted blob.
+func plainSize(size int64) int64 {
+	body := size - encHeaderSize
+	if body < encTagSize {
+		return 0
+	}
+	chunks := (body + encChunkSize + encTagSize - 1) / (encChunkSize + encTagSize)
+	return body - chunks*encTagSize
+}
+
+func encrypt(dst io.Writer, src io.Reader, id []byte, dek []byte) error {
+	aead, err := gcm(dek)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 0, encHeaderSize)
+	header = append(header, encMagic...)
+	header = binary.BigEndian.AppendUint32(header, encChunkSize)
+	header = append(header, id...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	buf := make([]byte, encChunkSize)
+	next := make([]byte, encChunkSize)
+	out := make([]byte, 0, encChunkSize+encTagSize)
+	n, err := io.ReadFull(src, buf)
+	for i := int64(0); ; i++ {
+		final := true
+		var m int
+		switch err {
+		case nil:
+			// A full chunk is the last one only if nothing follows it.
+			m, err = io.ReadFull(src, next)
+			final = m == 0 && err == io.EOF
+		case io.EOF, io.ErrUnexpectedEOF:
+		default:
+			return err
+		}
+		if _, werr := dst.Write(aead.Seal(out[:0], chunkNonce(i), buf[:n], chunkAAD(final))); werr != nil {
+			return werr
+		}
+		if final {
+			return nil
+		}
+		buf, next, n = next, buf, m
+	}
+}
+
+func (s *encStore) Put(key string, r io.Reader) (int64, error) {
+	if s.current == nil {
+		n, err := s.inner.Put(key, r)
+		if err == nil {
+			db.Where("blob_key = ?", key).Delete(&DataKey{})
+		}
+		return n, err
+	}
+	rawID := make([]byte, 16)
+	dek := make([]byte, 32)
+	if _, err := rand.Read(rawID); err != nil {
+		return 0, err
+	}
+	if _, err := rand.Read(dek); err != nil {
+		return 0, err
+	}
+	id := hex.EncodeToString(rawID)
+	wrapped, err := s.current.wrap(id, dek)
+	if err != nil {
+		return 0, err
+	}
+	// The key row goes in first so a blob on storage always has its key.
+	row := DataKey{ID: id, BlobKey: key, MasterKeyID: s.current.id, Wrapped: wrapped}
+	if err := db.Create(&row).Error; err != nil {
+		return 0, fmt.Errorf("cannot save data key: %w", err)
+	}
+	pr, pw := io.Pipe()
+	cr := &countingReader{r: r}
+	go func() {
+		pw.CloseWithError(encrypt(pw, cr, rawID, dek))
+	}()
+	_, err = s.inner.Put(key, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		db.Delete(&DataKey{}, "id = ?", id)
+		return 0, err
+	}
+	db.Where("blob_key = ? AND id <> ?", key, id).Delete(&DataKey{})
+	return cr.n, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (s *encStore) Open(key string) (Blob, error) {
+	b, err := s.inner.Open(key)
+	if err != nil || !s.encrypted(key) {
+		return b, err
+	}
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(b, header); err != nil || !bytes.Equal(header[:4], []byte(encMagic)) {
+		b.Close()
+		return nil, fmt.Errorf("blob %s has a data key but no encryption header", key)
+	}
+	id := hex.EncodeToString(header[8:])
+	dek, err := s.dataKey(key, id)
+	if err != nil {
+		b.Close()
+		return nil, fmt.Errorf("blob %s: %w", key, err)
+	}
+	aead, err := gcm(dek)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	info := b.Info()
+	info.Size = plainSize(info.Size)
+	return &encBlob{inner: b, aead: aead, info: info, chunkSize: int64(binary.BigEndian.Uint32(header[4:8])), cached: -1}, nil
+}
+
+func (s *encStore) Stat(key string) (BlobInfo, error) {
+	info, err := s.inner.Stat(key)
+	if err == nil && s.encrypted(key) {
+		info.Size = plainSize(info.Size)
+	}
+	return info, err
+}
+
+func (s *encStore) Delete(key string) error {
+	if err := s.inner.Delete(key); err != nil {
+		return err
+	}
+	return db.Where("blob_key = ?", key).Delete(&DataKey{}).Error
+}
+
+// Copy copies in place only while encryption is off; encrypted copies need
+// a data key of their own.
+func (s *encStore) Copy(src, dst string) (int64, error) {
+	c, ok := s.inner.(blobCopier)
+	if !ok || s.current != nil || s.encrypted(src) {
+		return 0, errCopyUnsupported
+	}
+	return c.Copy(src, dst)
+}
+
+func (s *encStore) List(fn func(BlobInfo) error) error {
+	return s.inner.List(fn)
+}
+
+func (s *encStore) localPath(key string) (string, bool) {
+	if s.encrypted(key) {
+		return "", false
+	}
+	if p, ok := s.inner.(localPather); ok {
+		return p.localPath(key)
+	}
+	return "", false
+}
+
+// encBlob decrypts an encrypted blob one chunk at a time, reading only the
+// chunks a Seek+Read touches.
+type encBlob struct {
+	inner     Blob
+	aead      cipher.AEAD
+	info      BlobInfo
+	chunkSize int64
+	pos       int64
+	cached    int64
+	plain     []byte
+}
+
+func (b *encBlob) Info() BlobInfo { return b.info }
+
+func (b *encBlob) Close() error { return b.inner.Close() }
+
+func (b *encBlob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.info.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.pos = offset
+	return offset, nil
+}
+
+func (b *encBlob) load(i int64) error {
+	if b.cached == i {
+		return nil
+	}
+	stride := b.chunkSize + encTagSize
+	if _, err := b.inner.Seek(encHeaderSize+i*stride, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, stride)
+	n, err := io.ReadFull(b.inner, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := b.info.Size / b.chunkSize
+	if b.info.Size > 0 && b.info.Size%b.chunkSize == 0 {
+		last--
+	}
+	b.plain, err = b.aead.Open(b.plain[:0], chunkNonce(i), sealed[:n], chunkAAD(i == last))
+	if err != nil {
+		b.cached = -1
+		return fmt.Errorf("blob %s: chunk %d failed authentication", b.info.Key, i)
+	}
+	b.cached = i
+	return nil
+}
+
+func (b *encBlob) Read(p []byte) (int, error) {
+	if b.pos >= b.info.Size {
+		return 0, io.EOF
+	}
+	i := b.pos / b.chunkSize
+	if err := b.load(i); err != nil {
+		return 0, err
+	}
+	n := copy(p, b.plain[b.pos-i*b.chunkSize:])
+	b.pos += int64(n)
+	return n, nil
+}
+
+// rotateKeyCommand rewraps every data key with the current master key, and
+// with -encrypt-existing encrypts plain blobs.
+func rotateKeyCommand(args []string) int {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	existing := fs.Bool("encrypt-existing", false, "also encrypt blobs stored in plain text")
+	fs.Parse(args)
+	cs, ok := store.(*compStore)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "storage is not open")
+		return 1
+	}
+	es, ok := cs.inner.(*encStore)
+	if !ok || es.current == nil {
+		fmt.Fprintln(os.Stderr, "no master key configured (set encryption_key or encryption_key_file)")
+		return 1
+	}
+	var rows []DataKey
+	if err := db.Find(&rows).Error; err != nil {
+		fmt.Fprintln(os.Stderr, "cannot read data keys:", err)
+		return 1
+	}
+	rewrapped, failed := 0, 0
+	for _, row := range rows {
+		if row.MasterKeyID == es.current.id {
+			continue
+		}
+		mk := es.keys[row.MasterKeyID]
+		if mk == nil {
+			fmt.Fprintf(os.Stderr, "data key %s: master key %s is not configured\n", row.ID, row.MasterKeyID)
+			failed++
+			continue
+		}
+		dek, err := mk.unwrap(row.ID, row.Wrapped)
+		if err == nil {
+			row.Wrapped, err = es.current.wrap(row.ID, dek)
+		}
+		if err == nil {
+			err = db.Model(&DataKey{}).Where("id = ?", row.ID).Updates(map[string]interface{}{
+				"master_key_id": es.current.id,
+				"wrapped":       row.Wrapped,
+			}).Error
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "data key %s: %v\n", row.ID, err)
+			failed++
+			continue
+		}
+		rewrapped++
+	}
+	fmt.Printf("Rewrapped %d data keys with master key %s, %d failed\n", rewrapped, es.current.id, failed)
+	if *existing {
+		encrypted, errs := encryptExisting(es)
+		fmt.Printf("Encrypted %d existing blobs, %d failed\n", encrypted, errs)
+		failed += errs
+	}
+	if failed > 0 {
+		return 2
+	}
+	return 0
+}
+
+func encryptExisting(es *encStore) (int, int) {
+	var nodes []Node
+	db.Select("fid").Where("fid IS NOT NULL").Find(&nodes)
+	done, failed := 0, 0
+	for _, n := range nodes {
+		key := blobKey(*n.Fid)
+		if es.encrypted(key) {
+			continue
+		}
+		lock := fileLock(*n.Fid)
+		lock.Lock()
+		err := func() error {
+			b, err := es.inner.Open(key)
+			if err != nil {
+				return err
+			}
+			defer b.Close()
+			_, err = es.Put(key, b)
+			return err
+		}()
+		lock.Unlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "blob %s: %v\n", key, err)
+			failed++
+			continue
+		}
+		done++
+	}
+	return done, failed
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func newTestEncStore(t *testing.T) *encStore {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	t.Setenv("HANAS_ENCRYPTION_KEY", hex.EncodeToString(key))
+	newTestDB(t)
+	s, err := newEncStore(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestEncStoreChunkBoundaries(t *testing.T) {
+	s := newTestEncStore(t)
+	for _, size := range []int64{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3*encChunkSize + 123} {
+		content := make([]byte, size)
+		rand.Read(content)
+		key := blobKey(uint(size) + 1)
+		if _, err := s.Put(key, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		if !s.encrypted(key) {
+			t.Fatalf("size %d: blob has no data key", size)
+		}
+		checkRange(t, s, key, content, 0, size+1)
+		for _, off := range []int64{encChunkSize - 1, encChunkSize, 2*encChunkSize - 7, size - 1} {
+			if off < 0 {
+				continue
+			}
+			checkRange(t, s, key, content, off, 2)
+			checkRange(t, s, key, content, off, encChunkSize+2)
+		}
+	}
+}
+
+func TestEncStoreDetectsTruncation(t *testing.T) {
+	s := newTestEncStore(t)
+	content := make([]byte, 2*encChunkSize+10)
+	rand.Read(content)
+	if _, err := s.Put("1", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	// Cut off the last chunk: the one before it was not sealed as the last.
+	raw, err := backend.Open("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := io.ReadAll(raw)
+	raw.Close()
+	cut := sealed[:encHeaderSize+2*(encChunkSize+encTagSize)]
+	if _, err := backend.Put("1", bytes.NewReader(cut)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Open("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := io.ReadAll(b); err == nil {
+		t.Fatal("reading a truncated blob succeeded")
+	}
+}
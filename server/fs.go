@@ -0,0 +1,415 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+)
+
+// The /fs/ endpoints address nodes by path below the user's root. Names are
+// unescaped one by one, so %2F stays in a name. They are served both below
+// /api/v1 and on their own.
+
+const fsPrefix = "/fs/"
+
+var (
+	errPathNotFound  = errors.New("no such file or folder")
+	errNotFolder     = errors.New("a file is in the way of the path")
+	errInvalidPath   = errors.New("path names must be non-empty and must not be . or .. or contain /")
+	errOutsideFolder = errors.New("token is restricted to another folder")
+)
+
+// FsCreateRequest is the body of POST /fs/<path>; without a source the path
+// becomes a folder.
+type FsCreateRequest struct {
+	CopyFrom  string `json:"copy_from,omitempty"`
+	MoveFrom  string `json:"move_from,omitempty"`
+	Parents   bool   `json:"parents,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+	Conflict  string `json:"conflict,omitempty"`
+}
+
+var fsPathParam = apiParam{"path", "path", "string", "slash-separated path below the root folder, each name percent-encoded"}
+
+// splitPath splits a path into NFC names, skipping empty ones.
+func splitPath(p string, unescape bool) ([]string, error) {
+	var names []string
+	for _, part := range strings.Split(p, "/") {
+		if part == "" {
+			continue
+		}
+		if unescape {
+			var err error
+			if part, err = url.PathUnescape(part); err != nil {
+				return nil, errInvalidPath
+			}
+		}
+		if part == "." || part == ".." || strings.Contains(part, "/") || strings.TrimSpace(part) == "" {
+			return nil, errInvalidPath
+		}
+		names = append(names, norm.NFC.String(part))
+	}
+	return names, nil
+}
+
+// checkNewNames checks the names of the entries a request is about to
+// create.
+func checkNewNames(names []string) error {
+	for _, name := range names {
+		if _, err := cleanName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestPath reads the names from the request URL. The escaped form is
+// used so that an encoded slash is not mistaken for a separator.
+func requestPath(r *http.Request) ([]string, error) {
+	p, ok := strings.CutPrefix(strings.TrimPrefix(r.URL.EscapedPath(), apiPrefix), fsPrefix)
+	if !ok {
+		return nil, nil
+	}
+	return splitPath(p, true)
+}
+
+// walkPath follows names down from the user's root as far as they exist.
+// It returns the last node reached and how many names that took.
+func walkPath(tx *gorm.DB, userID uint, names []string) (Node, int) {
+	return walkFrom(tx, return_root(userID), userID, names)
+}
+
+// walkFrom is walkPath starting at node.
+func walkFrom(tx *gorm.DB, node Node, userID uint, names []string) (Node, int) {
+	for i, name := range names {
+		if !node.IsDir {
+			return node, i
+		}
+		var children []Node
+		tx.Where("oya_id = ? AND name = ? AND user_id = ?", node.ID, name, userID).Limit(1).Find(&children)
+		if len(children) == 0 {
+			return node, i
+		}
+		node = children[0]
+	}
+	return node, len(names)
+}
+
+func resolvePath(userID uint, names []string) (Node, error) {
+	node, n := walkPath(db, userID, names)
+	if node.ID == 0 || n < len(names) {
+		return node, errPathNotFound
+	}
+	return node, nil
+}
+
+// findFolder walks names as far as they exist and checks the rest may be
+// created. It returns the folder and the count walked.
+func findFolder(tx *gorm.DB, r *http.Request, userID uint, names []string, parents bool) (Node, int, error) {
+	node, n := walkPath(tx, userID, names)
+	if node.ID == 0 {
+		return node, n, errPathNotFound
+	}
+	if !node.IsDir {
+		return node, n, errNotFolder
+	}
+	if n < len(names) && !parents {
+		return node, n, errPathNotFound
+	}
+	if !nodeAllowed(r, node) {
+		return node, n, errOutsideFolder
+	}
+	return node, n, nil
+}
+
+// folderAt resolves the folder a new entry goes into. With parents set,
+// missing folders are created like mkdir -p does, as part of the unit.
+func folderAt(u *unitOfWork, tx *gorm.DB, r *http.Request, userID uint, names []string, parents bool) (Node, error) {
+	node, n, err := findFolder(tx, r, userID, names, parents)
+	if err == nil {
+		err = checkNewNames(names[n:])
+	}
+	if err != nil {
+		return node, err
+	}
+	return makeFolders(u, tx, node, names[n:], userID)
+}
+
+// makeFolders creates the folders of names one inside the other below node
+// and returns the innermost.
+func makeFolders(u *unitOfWork, tx *gorm.DB, node Node, names []string, userID uint) (Node, error) {
+	for _, name := range names {
+		id, err := createFolder(u, tx, name, &node.ID, userID)
+		if err != nil {
+			return node, err
+		}
+		var created Node
+		if err := tx.First(&created, id).Error; err != nil {
+			return node, err
+		}
+		node = created
+	}
+	return node, nil
+}
+
+// apiFsNode resolves the path of the request to an existing node.
+func apiFsNode(w http.ResponseWriter, r *http.Request) (Node, []string, uint, bool) {
+	userID, _ := getUserIDFromRequest(r)
+	names, err := requestPath(r)
+	if err != nil {
+		apiNodeError(w, err)
+		return Node{}, nil, userID, false
+	}
+	node, err := resolvePath(userID, names)
+	if err != nil {
+		apiNodeError(w, err)
+		return node, names, userID, false
+	}
+	if !apiNodeAllowed(w, r, node) {
+		return node, names, userID, false
+	}
+	return node, names, userID, true
+}
+
+// apiFsGet lists a folder or downloads a file; stat=true returns a file's
+// metadata instead of its content.
+func apiFsGet(w http.ResponseWriter, r *http.Request) {
+	node, _, userID, ok := apiFsNode(w, r)
+	if !ok {
+		return
+	}
+	if !node.IsDir {
+		if stat := r.URL.Query().Get("stat"); stat == "true" || stat == "1" {
+			writeNode(w, http.StatusOK, node.ID, userID)
+			return
+		}
+		apiErrors(func(w http.ResponseWriter, r *http.Request) {
+			if err := serveNode(w, r, node); err != nil {
+				apiError(w, http.StatusInternalServerError, "", "failed to open file")
+			}
+		})(w, r)
+		return
+	}
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_listing", err.Error())
+		return
+	}
+	if err := writeListing(w, r, node, userID, opts); err != nil {
+		apiError(w, http.StatusInternalServerError, "", "failed to list folder")
+	}
+}
+
+// apiFsPut uploads the request body to the path.
+func apiFsPut(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromRequest(r)
+	names, err := requestPath(r)
+	if err == nil && len(names) == 0 {
+		err = errInvalidPath
+	}
+	if err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	dir, name := names[:len(names)-1], names[len(names)-1]
+	parents := q.Get("parents") == "true" || q.Get("parents") == "1"
+	policy, err := conflictPolicy(q.Get("conflict"), q.Get("overwrite") == "true" || q.Get("overwrite") == "1")
+	if err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	policy = uploadPolicy(r, policy)
+	parent, n, err := findFolder(db, r, userID, dir, parents)
+	if err == nil {
+		err = checkNewNames(names[n:])
+	}
+	if err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	if existing, ok := findChildByName(parent.ID, name, userID); ok && n == len(dir) {
+		switch {
+		case policy == conflictSkip:
+			writeNode(w, http.StatusOK, existing.ID, userID)
+			return
+		case policy == conflictFail:
+			apiNodeError(w, errConflict)
+			return
+		case policy == conflictOverwrite && existing.IsDir:
+			apiNodeError(w, errFolderExists)
+			return
+		}
+	}
+	var u unitOfWork
+	content, err := stageContent(&u, name, r.Body)
+	if err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	defer lockFolders(parent.ID)()
+	var id uint
+	created := false
+	err = u.commit(func(tx *gorm.DB) error {
+		parent, err := folderAt(&u, tx, r, userID, dir, parents)
+		if err != nil {
+			return err
+		}
+		id, created, err = putFile(&u, tx, &parent.ID, name, userID, content, policy, strings.Trim(r.Header.Get("If-Match"), `"`))
+		return err
+	})
+	if err != nil && !errors.Is(err, errSkipped) {
+		apiNodeError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeNode(w, status, id, userID)
+}
+
+// apiFsPost creates a folder at the path, or copies or moves another path
+// there.
+func apiFsPost(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromRequest(r)
+	names, err := requestPath(r)
+	if err == nil && len(names) == 0 {
+		err = errInvalidPath
+	}
+	if err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	var req FsCreateRequest
+	if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.CopyFrom != "" && req.MoveFrom != "" {
+		apiError(w, http.StatusBadRequest, "", "give copy_from or move_from, not both")
+		return
+	}
+	var src Node
+	if from := req.CopyFrom + req.MoveFrom; from != "" {
+		srcNames, err := splitPath(from, false)
+		if err == nil {
+			src, err = resolvePath(userID, srcNames)
+		}
+		if err != nil {
+			apiNodeError(w, err)
+			return
+		}
+		if !apiNodeAllowed(w, r, src) {
+			return
+		}
+		if src.OyaID == nil {
+			apiError(w, http.StatusBadRequest, "root_folder", "the root folder cannot be copied or moved")
+			return
+		}
+	}
+	policy, err := conflictPolicy(req.Conflict, req.Overwrite)
+	if err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	if src.ID == 0 && policy == conflictOverwrite {
+		// A new folder never replaces what is there.
+		policy = conflictFail
+	}
+	dir, name := names[:len(names)-1], names[len(names)-1]
+	parent, n, err := findFolder(db, r, userID, dir, req.Parents)
+	if err == nil {
+		err = checkNewNames(names[n:])
+	}
+	if err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	// Missing folders are created below parent, so this also covers them.
+	if src.ID != 0 && (parent.ID == src.ID || isAncestor(src.ID, parent.ID, userID)) {
+		apiNodeError(w, errIntoSelf)
+		return
+	}
+	existing, exists := findChildByName(parent.ID, name, userID)
+	switch {
+	case n < len(dir), !exists:
+	case src.ID == 0 && existing.IsDir && req.Parents, existing.ID == src.ID, policy == conflictSkip:
+		writeNode(w, http.StatusOK, existing.ID, userID)
+		return
+	case policy == conflictFail:
+		apiNodeError(w, errConflict)
+		return
+	case policy == conflictOverwrite && isAncestor(existing.ID, src.ID, userID):
+		apiNodeError(w, errIntoSelf)
+		return
+	}
+	var u unitOfWork
+	var c *treeCopy
+	if req.CopyFrom != "" {
+		if c, err = stageCopy(&u, src, nil); err != nil {
+			u.abort()
+			apiNodeError(w, err)
+			return
+		}
+	}
+	locked := []uint{parent.ID}
+	if req.MoveFrom != "" {
+		locked = append(locked, *src.OyaID)
+	}
+	defer lockFolders(locked...)()
+	var id uint
+	err = u.commit(func(tx *gorm.DB) error {
+		parent, err := folderAt(&u, tx, r, userID, dir, req.Parents)
+		if err != nil {
+			return err
+		}
+		if req.MoveFrom != "" {
+			id, err = placeNode(&u, tx, src, parent.ID, name, userID, policy)
+			return err
+		}
+		if c != nil {
+			if err := checkNotInside(tx, src, parent.ID); err != nil {
+				return err
+			}
+		}
+		name, skipID, err := claimName(&u, tx, parent.ID, name, src.ID == 0 || src.IsDir, userID, policy, 0)
+		if err != nil {
+			id = skipID
+			return err
+		}
+		if c != nil {
+			id, err = c.create(tx, parent.ID, name, userID)
+		} else {
+			id, err = createFolder(&u, tx, name, &parent.ID, userID)
+		}
+		return err
+	})
+	switch {
+	case errors.Is(err, errSkipped):
+		writeNode(w, http.StatusOK, id, userID)
+	case err != nil:
+		apiNodeError(w, err)
+	default:
+		writeNode(w, http.StatusCreated, id, userID)
+	}
+}
+
+func apiFsDelete(w http.ResponseWriter, r *http.Request) {
+	node, _, userID, ok := apiFsNode(w, r)
+	if !ok {
+		return
+	}
+	if node.OyaID == nil {
+		apiError(w, http.StatusBadRequest, "root_folder", "the root folder cannot be deleted")
+		return
+	}
+	if err := DeleteNodeRecursive(node.ID, userID); err != nil {
+		apiNodeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
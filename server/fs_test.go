@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFsPaths(t *testing.T) {
+	newTestDB(t)
+	user, _ := newTestUser(t, "alice")
+	srv := newAPIServer(t)
+	for _, prefix := range []string{"/fs", apiPrefix + "/fs"} {
+		t.Run(prefix, func(t *testing.T) {
+			file := prefix + "/Projects/2026/" + "report%20%231.pdf"
+			if resp, _ := apiCall(t, srv, &user, "PUT", file, strings.NewReader("report")); resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("upload without parents: %s, want 404", resp.Status)
+			}
+			if resp, b := apiCall(t, srv, &user, "PUT", file+"?parents=true", strings.NewReader("report")); resp.StatusCode != http.StatusCreated {
+				t.Fatalf("upload: %s %s", resp.Status, b)
+			}
+			if resp, b := apiCall(t, srv, &user, "GET", file, nil); resp.StatusCode != http.StatusOK || string(b) != "report" {
+				t.Fatalf("download: %s %q", resp.Status, b)
+			}
+			resp, b := apiCall(t, srv, &user, "GET", file+"?stat=true", nil)
+			var n Node
+			if resp.StatusCode != http.StatusOK || json.Unmarshal(b, &n) != nil || n.Name != "report #1.pdf" || n.Size != 6 {
+				t.Fatalf("stat: %s %s", resp.Status, b)
+			}
+			resp, b = apiCall(t, srv, &user, "GET", prefix+"/Projects//2026/", nil)
+			if resp.StatusCode != http.StatusOK || json.Unmarshal(b, &n) != nil || len(n.Ko) != 1 || n.Ko[0].Name != "report #1.pdf" {
+				t.Fatalf("listing: %s %s", resp.Status, b)
+			}
+			for _, bad := range []string{"/Projects/%2E%2E", "/a%2Fb", "/%20"} {
+				if resp, _ := apiCall(t, srv, &user, "PUT", prefix+bad+"?parents=true", strings.NewReader("x")); resp.StatusCode != http.StatusBadRequest {
+					t.Errorf("upload to %s: %s, want 400", bad, resp.Status)
+				}
+			}
+			if resp, _ := apiCall(t, srv, &user, "DELETE", prefix+"/Projects", nil); resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("delete: %s", resp.Status)
+			}
+			if resp, _ := apiCall(t, srv, &user, "GET", file, nil); resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("download after delete: %s, want 404", resp.Status)
+			}
+		})
+	}
+	if resp, _ := apiCall(t, srv, nil, "GET", "/fs/", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("anonymous listing: %s, want 401", resp.Status)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	lostAndFound = "lost+found"
+	// Blobs younger than this may belong to an upload whose node row has
+	// not been committed yet, so repair leaves them alone.
+	fsckGracePeriod = time.Hour
+)
+
+type FsckNode struct {
+	ID     uint   `json:"id"`
+	UserID uint   `json:"user_id"`
+	Name   string `json:"name"`
+	Fid    *uint  `json:"fid,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type FsckReport struct {
+	OrphanBlobs    []string   `json:"orphan_blobs"`
+	OrphanThumbs   []string   `json:"orphan_thumbnails"`
+	MissingBlobs   []FsckNode `json:"missing_blobs"`
+	DanglingShares []uint     `json:"dangling_shares"`
+	OrphanedTrees  []FsckNode `json:"orphaned_subtrees"`
+	StalePaths     []FsckNode `json:"stale_paths"`
+	Repaired       bool       `json:"repaired"`
+	Actions        []string   `json:"actions,omitempty"`
+	Errors         []string   `json:"errors,omitempty"`
+}
+
+func (r FsckReport) Clean() bool {
+	return len(r.OrphanBlobs) == 0 && len(r.OrphanThumbs) == 0 && len(r.MissingBlobs) == 0 &&
+		len(r.DanglingShares) == 0 && len(r.OrphanedTrees) == 0 && len(r.StalePaths) == 0
+}
+
+func (r *FsckReport) did(format string, args ...interface{}) {
+	r.Actions = append(r.Actions, fmt.Sprintf(format, args...))
+}
+
+func (r *FsckReport) fail(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// runFsck checks the store and, with repair, fixes what it finds. Files
+// whose blob is missing go to lost+found unless deleteMissing is set.
+func runFsck(repair, deleteMissing bool) (FsckReport, error) {
+	report := FsckReport{
+		OrphanBlobs:    []string{},
+		OrphanThumbs:   []string{},
+		MissingBlobs:   []FsckNode{},
+		DanglingShares: []uint{},
+		OrphanedTrees:  []FsckNode{},
+		StalePaths:     []FsckNode{},
+		Repaired:       repair,
+	}
+	var users []User
+	if err := db.Select("id").Find(&users).Error; err != nil {
+		return report, fmt.Errorf("cannot read users: %w", err)
+	}
+	userExists := make(map[uint]bool, len(users))
+	for _, u := range users {
+		userExists[u.ID] = true
+	}
+	var nodes []Node
+	if err := db.Select("id", "user_id", "fid", "name", "is_dir", "oya_id", "ancestry").Find(&nodes).Error; err != nil {
+		return report, fmt.Errorf("cannot read nodes: %w", err)
+	}
+	byID := make(map[uint]Node, len(nodes))
+	fids := make(map[uint]bool, len(nodes))
+	for _, n := range nodes {
+		byID[n.ID] = n
+		if n.Fid != nil {
+			fids[*n.Fid] = true
+		}
+	}
+
+	// A subtree is orphaned when its top has no valid parent or owner; walking
+	// up also catches parent cycles.
+	orphanRoot := make(map[uint]string)
+	for _, n := range nodes {
+		cur, seen := n, map[uint]bool{}
+		for {
+			if cur.OyaID == nil {
+				if !userExists[cur.UserID] {
+					orphanRoot[cur.ID] = "owner does not exist"
+				} else if !cur.IsDir {
+					orphanRoot[cur.ID] = "file without parent"
+				}
+				break
+			}
+			if seen[cur.ID] {
+				orphanRoot[cur.ID] = "parent cycle"
+				break
+			}
+			seen[cur.ID] = true
+			parent, ok := byID[*cur.OyaID]
+			if !ok {
+				orphanRoot[cur.ID] = "parent does not exist"
+				break
+			}
+			if parent.UserID != cur.UserID {
+				orphanRoot[cur.ID] = "parent belongs to another user"
+				break
+			}
+			if !parent.IsDir {
+				orphanRoot[cur.ID] = "parent is a file"
+				break
+			}
+			cur = parent
+		}
+	}
+	for id, reason := range orphanRoot {
+		n := byID[id]
+		report.OrphanedTrees = append(report.OrphanedTrees, FsckNode{ID: n.ID, UserID: n.UserID, Name: n.Name, Fid: n.Fid, Reason: reason})
+	}
+
+	// Tree paths are derived from the parent links. A node whose parent is
+	// gone starts its own path, as fillAncestry does; cycles have none.
+	paths := make(map[uint]string, len(nodes))
+	var pathOf func(n Node, depth int) string
+	pathOf = func(n Node, depth int) string {
+		if p, ok := paths[n.ID]; ok {
+			return p
+		}
+		if depth > len(nodes) {
+			return ""
+		}
+		p := ancestryOf("", n.ID)
+		if n.OyaID != nil {
+			if parent, ok := byID[*n.OyaID]; ok {
+				if pp := pathOf(parent, depth+1); pp != "" {
+					p = ancestryOf(pp, n.ID)
+				} else {
+					p = ""
+				}
+			}
+		}
+		paths[n.ID] = p
+		return p
+	}
+	for _, n := range nodes {
+		if p := pathOf(n, 0); p != "" && p != n.Ancestry {
+			report.StalePaths = append(report.StalePaths, FsckNode{ID: n.ID, UserID: n.UserID, Name: n.Name, Reason: "tree path is " + n.Ancestry + ", expected " + p})
+		}
+	}
+
+	stored, other, err := blobIDs()
+	if err != nil {
+		return report, fmt.Errorf("cannot list blobs: %w", err)
+	}
+	for _, n := range nodes {
+		if n.Fid == nil {
+			continue
+		}
+		if _, ok := stored[*n.Fid]; !ok {
+			report.MissingBlobs = append(report.MissingBlobs, FsckNode{ID: n.ID, UserID: n.UserID, Name: n.Name, Fid: n.Fid, Reason: "blob not found"})
+		}
+	}
+	recent := make(map[string]bool)
+	for fid, info := range stored {
+		if !fids[fid] {
+			report.OrphanBlobs = append(report.OrphanBlobs, info.Key)
+			recent[info.Key] = time.Since(info.ModTime) < fsckGracePeriod
+		}
+	}
+	for _, info := range other {
+		report.OrphanBlobs = append(report.OrphanBlobs, info.Key)
+		recent[info.Key] = time.Since(info.ModTime) < fsckGracePeriod
+	}
+
+	if entries, err := os.ReadDir(thumbDir); err == nil {
+		for _, e := range entries {
+			id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), ".jpg"), 10, 64)
+			if err != nil || !strings.HasSuffix(e.Name(), ".jpg") || !fids[uint(id)] {
+				report.OrphanThumbs = append(report.OrphanThumbs, e.Name())
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return report, fmt.Errorf("cannot list thumbnail dir: %w", err)
+	}
+
+	var shares []Share
+	if err := db.Find(&shares).Error; err != nil {
+		return report, fmt.Errorf("cannot read shares: %w", err)
+	}
+	for _, s := range shares {
+		n, ok := byID[s.NodeID]
+		if !ok || n.UserID != s.UserID || !userExists[s.UserID] {
+			report.DanglingShares = append(report.DanglingShares, s.ID)
+		}
+	}
+
+	if repair {
+		repairFsck(&report, recent, paths, deleteMissing)
+	}
+	return report, nil
+}
+
+func repairFsck(report *FsckReport, recent map[string]bool, paths map[uint]string, deleteMissing bool) {
+	// Paths first: moving orphaned subtrees below relies on them.
+	for _, n := range report.StalePaths {
+		if err := db.Model(&Node{}).Where("id = ?", n.ID).UpdateColumn("ancestry", paths[n.ID]).Error; err != nil {
+			report.fail("fix tree path of node %d: %v", n.ID, err)
+			continue
+		}
+		report.did("fixed tree path of node %d (%s)", n.ID, n.Name)
+	}
+	// Removals go through removeBlob, so that a running backup keeps the
+	// blobs it is copying until it is done.
+	held := blobsHeld()
+	for _, name := range report.OrphanBlobs {
+		if recent[name] {
+			report.did("kept recent blob %s", name)
+			continue
+		}
+		if fid, err := strconv.ParseUint(name, 10, 64); err == nil {
+			removeBlob(uint(fid))
+			if held {
+				report.did("queued orphan blob %s for removal after the backup", name)
+			} else {
+				report.did("removed orphan blob %s", name)
+			}
+			continue
+		}
+		if held {
+			report.did("kept blob %s while a backup runs", name)
+			continue
+		}
+		if err := store.Delete(name); err != nil {
+			report.fail("remove blob %s: %v", name, err)
+			continue
+		}
+		report.did("removed orphan blob %s", name)
+	}
+	for _, name := range report.OrphanThumbs {
+		if err := os.RemoveAll(filepath.Join(thumbDir, name)); err != nil {
+			report.fail("remove thumbnail %s: %v", name, err)
+			continue
+		}
+		report.did("removed orphan thumbnail %s", name)
+	}
+	for _, id := range report.DanglingShares {
+		if err := db.Delete(&Share{}, id).Error; err != nil {
+			report.fail("delete share %d: %v", id, err)
+			continue
+		}
+		report.did("deleted dangling share %d", id)
+	}
+	for _, n := range report.MissingBlobs {
+		var node Node
+		if err := db.First(&node, n.ID).Error; err != nil {
+			continue
+		}
+		// A file overwritten since the scan has a new blob.
+		if node.Fid == nil || *node.Fid != *n.Fid || !blobMissing(*node.Fid) {
+			report.did("left node %d (%s): its content changed since the check", n.ID, n.Name)
+			continue
+		}
+		if !deleteMissing {
+			moveMissing(report, node)
+			continue
+		}
+		res := db.Where("fid = ?", *n.Fid).Delete(&node)
+		if res.Error != nil {
+			report.fail("delete node %d: %v", n.ID, res.Error)
+			continue
+		}
+		if res.RowsAffected == 0 {
+			report.did("left node %d (%s): its content changed since the check", n.ID, n.Name)
+			continue
+		}
+		removeFromAncestors(db, node)
+		db.Where("node_id = ?", n.ID).Delete(&Share{})
+		recordChange(db, changeDelete, node)
+		report.did("deleted node %d (%s) whose blob is missing", n.ID, n.Name)
+	}
+	for _, n := range report.OrphanedTrees {
+		var user User
+		if err := db.First(&user, n.UserID).Error; err != nil {
+			if err := DeleteNodeRecursive(n.ID, n.UserID); err != nil {
+				report.fail("delete orphaned subtree %d: %v", n.ID, err)
+				continue
+			}
+			report.did("deleted subtree %d (%s) of missing user %d", n.ID, n.Name, n.UserID)
+			continue
+		}
+		lf, err := lostAndFoundFolder(user.ID)
+		if err != nil {
+			report.fail("lost+found for user %d: %v", user.ID, err)
+			continue
+		}
+		var node Node
+		if err := db.First(&node, n.ID).Error; err != nil {
+			continue
+		}
+		if err := moveToLostAndFound(node, lf); err != nil {
+			report.fail("move subtree %d: %v", n.ID, err)
+			continue
+		}
+		report.did("moved subtree %d (%s) to /%s of user %d", n.ID, n.Name, lostAndFound, user.ID)
+	}
+}
+
+func blobMissing(fid uint) bool {
+	_, err := store.Stat(blobKey(fid))
+	return isNotExist(err)
+}
+
+// moveMissing keeps a file whose blob is missing in lost+found, so that its
+// owner sees what was lost.
+func moveMissing(report *FsckReport, node Node) {
+	var user User
+	if err := db.First(&user, node.UserID).Error; err != nil {
+		return
+	}
+	lf, err := lostAndFoundFolder(user.ID)
+	if err != nil {
+		report.fail("lost+found for user %d: %v", user.ID, err)
+		return
+	}
+	if node.OyaID != nil && *node.OyaID == lf {
+		report.did("left node %d (%s) whose blob is missing in /%s of user %d", node.ID, node.Name, lostAndFound, user.ID)
+		return
+	}
+	if err := moveToLostAndFound(node, lf); err != nil {
+		report.fail("move node %d: %v", node.ID, err)
+		return
+	}
+	report.did("moved node %d (%s) whose blob is missing to /%s of user %d", node.ID, node.Name, lostAndFound, user.ID)
+}
+
+func lostAndFoundFolder(userID uint) (uint, error) {
+	root := return_root(userID)
+	if root.ID == 0 {
+		root = Node{UserID: userID, Name: "/", IsDir: true}
+		if err := db.Create(&root).Error; err != nil {
+			return 0, err
+		}
+	}
+	if n, ok := findChildByName(root.ID, lostAndFound, userID); ok && n.IsDir {
+		return n.ID, nil
+	}
+	return UploadNode(lostAndFound, nil, true, &root.ID, userID, conflictOverwrite)
+}
+
+// moveToLostAndFound moves a subtree into lost+found, numbering its name if
+// lost+found already has an entry of that name.
+func moveToLostAndFound(node Node, lf uint) error {
+	locked := []uint{lf}
+	if node.OyaID != nil {
+		locked = append(locked, *node.OyaID)
+	}
+	defer lockFolders(locked...)()
+	var u unitOfWork
+	return u.commit(func(tx *gorm.DB) error {
+		if err := tx.First(&node, node.ID).Error; err != nil {
+			return err
+		}
+		name, err := freeName(tx, lf, node.Name, node.IsDir, node.UserID)
+		if err != nil {
+			return err
+		}
+		if name != node.Name {
+			if err := renameNode(tx, node, name); err != nil {
+				return err
+			}
+			node.Name = name
+		}
+		return moveNode(tx, node, lf)
+	})
+}
+
+func AdminFsck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deleteMissing := r.URL.Query().Get("delete_missing") == "1" || r.URL.Query().Get("delete_missing") == "true"
+	report, err := runFsck(r.Method == http.MethodPost, deleteMissing)
+	if err != nil {
+		http.Error(w, "fsck failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func fsckCommand(args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "fix the problems found instead of only reporting them")
+	deleteMissing := fs.Bool("delete-missing", false, "with -repair, delete files whose blob is missing instead of moving them to lost+found")
+	fs.Parse(args)
+	if *repair {
+		release, err := lockInstance(instanceLock)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot repair:", err)
+			return 1
+		}
+		defer release()
+	}
+	report, err := runFsck(*repair, *deleteMissing)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fsck failed:", err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if len(report.Errors) > 0 || (!*repair && !report.Clean()) {
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFsckRepairSkipsOverwrittenFiles(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	a := uploadTestFile(t, "a.txt", "a", root.ID, user.ID)
+	b := uploadTestFile(t, "b.txt", "b", root.ID, user.ID)
+	for _, id := range []uint{a, b} {
+		if err := store.Delete(blobKey(*nodeByID(t, id).Fid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := runFsck(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.MissingBlobs) != 2 {
+		t.Fatalf("missing blobs: %+v", report.MissingBlobs)
+	}
+
+	// a gets new content between the check and the repair.
+	node := nodeByID(t, a)
+	if err := replaceContent(&node, strings.NewReader("new"), ""); err != nil {
+		t.Fatal(err)
+	}
+	repairFsck(&report, nil, nil, true)
+	if got := readBlob(t, *nodeByID(t, a).Fid); got != "new" {
+		t.Fatalf("a.txt holds %q", got)
+	}
+	var left int64
+	db.Model(&Node{}).Where("id = ?", b).Count(&left)
+	if left != 0 {
+		t.Fatal("b.txt, whose blob is missing, was not deleted")
+	}
+}
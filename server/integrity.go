@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type ScrubIssue struct {
+	NodeID   uint   `json:"node_id"`
+	UserID   uint   `json:"user_id"`
+	Fid      uint   `json:"fid"`
+	Name     string `json:"name"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ScrubReport struct {
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+	Checked    int          `json:"checked"`
+	Bytes      int64        `json:"bytes"`
+	Backfilled int          `json:"backfilled"`
+	Mismatched []ScrubIssue `json:"mismatched"`
+	Missing    []ScrubIssue `json:"missing"`
+	Corrupt    []ScrubIssue `json:"corrupt"` // present but unreadable or failing to decrypt
+	Orphans    []string     `json:"orphans"`
+}
+
+func (r ScrubReport) Clean() bool {
+	return len(r.Mismatched) == 0 && len(r.Missing) == 0 && len(r.Corrupt) == 0 && len(r.Orphans) == 0
+}
+
+var scrubState = struct {
+	sync.Mutex
+	running bool
+	last    *ScrubReport
+}{}
+
+func hashBlob(fid uint) (string, int64, error) {
+	lock := fileLock(fid)
+	lock.RLock()
+	defer lock.RUnlock()
+	b, err := store.Open(blobKey(fid))
+	if err != nil {
+		return "", 0, err
+	}
+	defer b.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, b)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// nodeHash returns the stored content hash, computing it from the blob for
+// files uploaded before hashes were recorded. It may read the whole blob, so
+// keep it out of transactions.
+func nodeHash(n Node) string {
+	if n.Hash != "" || n.Fid == nil {
+		return n.Hash
+	}
+	hash, _, err := hashBlob(*n.Fid)
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+// ensureHash computes and stores the hash of a file uploaded before hashes
+// were recorded, unless its content changed meanwhile. Like nodeHash it
+// reads the whole blob.
+func ensureHash(n *Node) {
+	if n.Hash != "" || n.Fid == nil {
+		return
+	}
+	hash, _, err := hashBlob(*n.Fid)
+	if err != nil {
+		return
+	}
+	if backfillHash(*n, hash) {
+		n.Hash = hash
+	}
+}
+
+// backfillHash records hash for n if n still has its content and no hash.
+func backfillHash(n Node, hash string) bool {
+	res := db.Model(&Node{}).Where("id = ? AND fid = ? AND (hash IS NULL OR hash = '')", n.ID, *n.Fid).UpdateColumn("hash", hash)
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+func setDigestHeaders(w http.ResponseWriter, n Node) {
+	if n.Hash == "" {
+		return
+	}
+	sum, err := hex.DecodeString(n.Hash)
+	if err != nil {
+		return
+	}
+	b64 := base64.StdEncoding.EncodeToString(sum)
+	w.Header().Set("ETag", `"`+n.Hash+`"`)
+	w.Header().Set("Digest", "sha-256="+b64)
+	w.Header().Set("Repr-Digest", "sha-256=:"+b64+":")
+}
+
+// blobIDs lists the fids present in the store. Keys that are not plain fids
+// (leftover temporary files and the like) are returned separately.
+func blobIDs() (map[uint]BlobInfo, []BlobInfo, error) {
+	ids := make(map[uint]BlobInfo)
+	var other []BlobInfo
+	err := store.List(func(info BlobInfo) error {
+		id, err := strconv.ParseUint(info.Key, 10, 64)
+		if err != nil {
+			other = append(other, info)
+			return nil
+		}
+		ids[uint(id)] = info
+		return nil
+	})
+	return ids, other, err
+}
+
+func runScrub() (ScrubReport, error) {
+	report := ScrubReport{
+		StartedAt:  time.Now(),
+		Mismatched: []ScrubIssue{},
+		Missing:    []ScrubIssue{},
+		Corrupt:    []ScrubIssue{},
+		Orphans:    []string{},
+	}
+	onDisk, other, err := blobIDs()
+	if err != nil {
+		return report, fmt.Errorf("cannot list blobs: %w", err)
+	}
+	var batch []Node
+	res := db.Where("fid IS NOT NULL").FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for _, n := range batch {
+			fid := *n.Fid
+			delete(onDisk, fid)
+			issue := ScrubIssue{NodeID: n.ID, UserID: n.UserID, Fid: fid, Name: n.Name, Expected: n.Hash}
+			hash, size, err := hashBlob(fid)
+			if err != nil {
+				issue.Error = err.Error()
+				if isNotExist(err) {
+					report.Missing = append(report.Missing, issue)
+				} else {
+					report.Corrupt = append(report.Corrupt, issue)
+				}
+				continue
+			}
+			report.Checked++
+			report.Bytes += size
+			if n.Hash == "" {
+				if backfillHash(n, hash) {
+					report.Backfilled++
+				}
+				continue
+			}
+			if hash != n.Hash {
+				issue.Actual = hash
+				report.Mismatched = append(report.Mismatched, issue)
+			}
+		}
+		return nil
+	})
+	if res.Error != nil {
+		return report, fmt.Errorf("cannot read nodes: %w", res.Error)
+	}
+	for fid := range onDisk {
+		report.Orphans = append(report.Orphans, blobKey(fid))
+	}
+	for _, info := range other {
+		report.Orphans = append(report.Orphans, info.Key)
+	}
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// startScrub runs a scrub in the background unless one is already running.
+func startScrub() bool {
+	scrubState.Lock()
+	if scrubState.running {
+		scrubState.Unlock()
+		return false
+	}
+	scrubState.running = true
+	scrubState.Unlock()
+	go func() {
+		report, err := runScrub()
+		if err != nil {
+			fmt.Println("scrub failed:", err)
+		} else {
+			fmt.Printf("Scrub finished: %d checked, %d mismatched, %d missing, %d corrupt, %d orphans\n",
+				report.Checked, len(report.Mismatched), len(report.Missing), len(report.Corrupt), len(report.Orphans))
+		}
+		scrubState.Lock()
+		scrubState.running = false
+		if err == nil {
+			scrubState.last = &report
+		}
+		scrubState.Unlock()
+	}()
+	return true
+}
+
+func startScrubScheduler() {
+	v := configValue("scrub_interval", "")
+	if v == "" {
+		return
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		fmt.Println("warning: invalid scrub_interval:", v)
+		return
+	}
+	fmt.Printf("Scheduled scrub every %s\n", interval)
+	go func() {
+		for range time.Tick(interval) {
+			startScrub()
+		}
+	}()
+}
+
+func AdminScrub(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		scrubState.Lock()
+		resp := map[string]interface{}{
+			"running": scrubState.running,
+			"report":  scrubState.last,
+		}
+		scrubState.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	case http.MethodPost:
+		if !startScrub() {
+			http.Error(w, "scrub already running", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"success":true}`))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func scrubCommand(args []string) int {
+	report, err := runScrub()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "scrub failed:", err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if !report.Clean() {
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func nodeByID(t *testing.T, id uint) Node {
+	t.Helper()
+	var n Node
+	if err := db.First(&n, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestScrub(t *testing.T) {
+	newTestEncStore(t)
+	user, root := newTestUser(t, "alice")
+	uploadTestFile(t, "good.txt", "good", root.ID, user.ID)
+	legacy := uploadTestFile(t, "legacy.txt", "legacy", root.ID, user.ID)
+	changed := uploadTestFile(t, "changed.txt", "changed", root.ID, user.ID)
+	missing := nodeByID(t, uploadTestFile(t, "missing.txt", "missing", root.ID, user.ID))
+	corrupt := nodeByID(t, uploadTestFile(t, "corrupt.txt", "corrupt", root.ID, user.ID))
+	db.Model(&Node{}).Where("id = ?", legacy).UpdateColumn("hash", "")
+	db.Model(&Node{}).Where("id = ?", changed).UpdateColumn("hash", sha256Hex("something else"))
+	if err := backend.Delete(blobKey(*missing.Fid)); err != nil {
+		t.Fatal(err)
+	}
+	// Still there, but no longer decrypts.
+	if _, err := backend.Put(blobKey(*corrupt.Fid), strings.NewReader("not what was sealed")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Put("upload-123.tmp", strings.NewReader("leftover")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := runScrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Clean() || report.Checked != 3 || report.Backfilled != 1 {
+		t.Fatalf("report: %+v", report)
+	}
+	if len(report.Mismatched) != 1 || report.Mismatched[0].NodeID != changed || report.Mismatched[0].Actual != sha256Hex("changed") {
+		t.Fatalf("mismatched: %+v", report.Mismatched)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].NodeID != missing.ID {
+		t.Fatalf("missing: %+v", report.Missing)
+	}
+	if len(report.Corrupt) != 1 || report.Corrupt[0].NodeID != corrupt.ID {
+		t.Fatalf("corrupt: %+v", report.Corrupt)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0] != "upload-123.tmp" {
+		t.Fatalf("orphans: %q", report.Orphans)
+	}
+	if got := nodeByID(t, legacy).Hash; got != sha256Hex("legacy") {
+		t.Fatalf("legacy file was backfilled with %q", got)
+	}
+}
+
+func TestIfMatchOnUnhashedFile(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	id := uploadTestFile(t, "legacy.txt", "v1", root.ID, user.ID)
+	db.Model(&Node{}).Where("id = ?", id).UpdateColumn("hash", "")
+	if _, err := uploadFileNode("legacy.txt", strings.NewReader("v2"), &root.ID, user.ID, conflictOverwrite, sha256Hex("v0")); !errors.Is(err, errModified) {
+		t.Fatalf("stale If-Match: %v, want %v", err, errModified)
+	}
+	if got := nodeByID(t, id).Hash; got != sha256Hex("v1") {
+		t.Fatalf("hash was not backfilled before the upload: %q", got)
+	}
+	if _, err := uploadFileNode("legacy.txt", strings.NewReader("v2"), &root.ID, user.ID, conflictOverwrite, sha256Hex("v1")); err != nil {
+		t.Fatalf("matching If-Match: %v", err)
+	}
+	var c Change
+	db.Where("node_id = ?", id).Order("id DESC").First(&c)
+	if c.Kind != changeModify || c.Hash != sha256Hex("v2") {
+		t.Fatalf("journal entry: %+v", c)
+	}
+}
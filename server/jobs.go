@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+	// jobCancelled jobs stopped early on request; what they did so far
+	// stays done.
+	jobCancelled = "cancelled"
+
+	jobRetention = 24 * time.Hour
+)
+
+var errTooManyJobs = errors.New("too many jobs running; wait for one to finish")
+
+type JobStatus struct {
+	ID         string                 `json:"id"`
+	Kind       string                 `json:"kind"`
+	Status     string                 `json:"status"`
+	Error      string                 `json:"error,omitempty"`
+	Result     map[string]interface{} `json:"result,omitempty"`
+	Progress   *JobProgress           `json:"progress,omitempty"`
+	Failures   []JobFailure           `json:"failures,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	FinishedAt *time.Time             `json:"finished_at,omitempty"`
+}
+
+// JobProgress counts files and their bytes for jobs that know up front how
+// much there is to do.
+type JobProgress struct {
+	Items      int64 `json:"items"`
+	ItemsTotal int64 `json:"items_total"`
+	Bytes      int64 `json:"bytes"`
+	BytesTotal int64 `json:"bytes_total"`
+}
+
+// JobFailure is an item a job could not process. The job goes on with the
+// others.
+type JobFailure struct {
+	NodeID uint   `json:"node_id"`
+	Name   string `json:"name"`
+	Error  string `json:"error"`
+}
+
+// Job is a long-running task started by a request and polled by the client.
+// Jobs live in memory only; a restart forgets them.
+type Job struct {
+	mu     sync.Mutex
+	st     JobStatus
+	ID     string
+	UserID uint
+	ctx    context.Context
+	cancel context.CancelFunc
+	// path of a server-side artifact (e.g. an export archive) that is
+	// removed together with the job
+	path string
+}
+
+var jobs = struct {
+	sync.RWMutex
+	m map[string]*Job
+}{m: make(map[string]*Job)}
+
+var jobJanitor sync.Once
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// startJob runs fn in the background. Each user has at most jobs_per_user
+// jobs running at a time.
+func startJob(userID uint, kind string, fn func(j *Job) error) (*Job, error) {
+	jobJanitor.Do(func() { go expireJobs() })
+	id := newJobID()
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &Job{
+		ID:     id,
+		UserID: userID,
+		ctx:    ctx,
+		cancel: cancel,
+		st: JobStatus{
+			ID:        id,
+			Kind:      kind,
+			Status:    jobRunning,
+			Result:    map[string]interface{}{},
+			CreatedAt: time.Now(),
+		},
+	}
+	limit := configInt("jobs_per_user", 4)
+	jobs.Lock()
+	running := 0
+	for _, other := range jobs.m {
+		if other.UserID != userID {
+			continue
+		}
+		other.mu.Lock()
+		if other.st.Status == jobRunning {
+			running++
+		}
+		other.mu.Unlock()
+	}
+	if limit > 0 && running >= limit {
+		jobs.Unlock()
+		cancel()
+		return nil, errTooManyJobs
+	}
+	jobs.m[j.ID] = j
+	jobs.Unlock()
+	go func() {
+		err := runJob(j, fn)
+		j.cancel()
+		j.mu.Lock()
+		now := time.Now()
+		j.st.FinishedAt = &now
+		if errors.Is(err, context.Canceled) {
+			j.st.Status = jobCancelled
+		} else if err != nil {
+			j.st.Status = jobFailed
+			j.st.Error = err.Error()
+			fmt.Printf("%s job %s failed: %v\n", kind, id, err)
+		} else {
+			j.st.Status = jobDone
+		}
+		j.mu.Unlock()
+	}()
+	return j, nil
+}
+
+// runJob turns a panic in fn into the job's error so that one bad job does
+// not take the server down.
+func runJob(j *Job, fn func(j *Job) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return fn(j)
+}
+
+func getJob(userID uint, id string) (*Job, bool) {
+	jobs.RLock()
+	j, ok := jobs.m[id]
+	jobs.RUnlock()
+	if !ok || j.UserID != userID {
+		return nil, false
+	}
+	return j, true
+}
+
+func (j *Job) set(key string, value interface{}) {
+	j.mu.Lock()
+	j.st.Result[key] = value
+	j.mu.Unlock()
+}
+
+// stopped reports a cancellation as context.Canceled; jobs check it between
+// items.
+func (j *Job) stopped() error {
+	return j.ctx.Err()
+}
+
+// Cancel asks a running job to stop. It has no effect on finished jobs.
+func (j *Job) Cancel() {
+	j.cancel()
+}
+
+func (j *Job) setTotal(items, bytes int64) {
+	j.mu.Lock()
+	j.st.Progress = &JobProgress{ItemsTotal: items, BytesTotal: bytes}
+	j.mu.Unlock()
+}
+
+// advance adds finished items to the progress.
+func (j *Job) advance(items, bytes int64) {
+	j.mu.Lock()
+	if j.st.Progress != nil {
+		j.st.Progress.Items += items
+		j.st.Progress.Bytes += bytes
+	}
+	j.mu.Unlock()
+}
+
+func (j *Job) fail(n Node, err error) {
+	j.mu.Lock()
+	j.st.Failures = append(j.st.Failures, JobFailure{NodeID: n.ID, Name: n.Name, Error: err.Error()})
+	j.mu.Unlock()
+}
+
+func (j *Job) setFile(p string) {
+	j.mu.Lock()
+	j.path = p
+	j.mu.Unlock()
+}
+
+func (j *Job) file() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.path
+}
+
+// status returns a copy that is safe to encode while the job runs.
+func (j *Job) status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c := j.st
+	c.Result = make(map[string]interface{}, len(j.st.Result))
+	for k, v := range j.st.Result {
+		c.Result[k] = v
+	}
+	if j.st.Progress != nil {
+		p := *j.st.Progress
+		c.Progress = &p
+	}
+	c.Failures = append([]JobFailure(nil), j.st.Failures...)
+	return c
+}
+
+func expireJobs() {
+	for range time.Tick(time.Hour) {
+		jobs.Lock()
+		for id, j := range jobs.m {
+			j.mu.Lock()
+			expired := j.st.FinishedAt != nil && time.Since(*j.st.FinishedAt) > jobRetention
+			p := j.path
+			j.mu.Unlock()
+			if expired {
+				if p != "" {
+					os.Remove(p)
+				}
+				delete(jobs.m, id)
+			}
+		}
+		jobs.Unlock()
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const ldapTimeout = 10 * time.Second
+
+var (
+	errLDAPNoUser    = errors.New("user not found in directory")
+	errLDAPForbidden = errors.New("user is not in a group allowed to use this server")
+)
+
+// ldapDirectory is the LDAP or Active Directory server accounts can log in
+// against, read from the ldap_* settings.
+type ldapDirectory struct {
+	url           string
+	startTLS      bool
+	insecure      bool
+	bindDN        string
+	bindPassword  string
+	baseDN        string
+	userFilter    string
+	usernameAttr  string
+	groupAttr     string
+	groupBaseDN   string
+	groupFilter   string
+	adminGroups   []string
+	allowedGroups []string
+	linkExisting  bool
+}
+
+// ldapIdentity is a user the directory accepted.
+type ldapIdentity struct {
+	dn       string
+	username string
+	groups   []string
+}
+
+func ldapEnabled() bool {
+	return configValue("ldap_url", "") != ""
+}
+
+func loadLDAPDirectory() ldapDirectory {
+	baseDN := configValue("ldap_base_dn", "")
+	return ldapDirectory{
+		url:           configValue("ldap_url", ""),
+		startTLS:      configValue("ldap_start_tls", "false") == "true",
+		insecure:      configValue("ldap_insecure_skip_verify", "false") == "true",
+		bindDN:        configValue("ldap_bind_dn", ""),
+		bindPassword:  configValue("ldap_bind_password", ""),
+		baseDN:        baseDN,
+		userFilter:    configValue("ldap_user_filter", "(uid={username})"),
+		usernameAttr:  configValue("ldap_username_attribute", "uid"),
+		groupAttr:     configValue("ldap_group_attribute", "memberOf"),
+		groupBaseDN:   configValue("ldap_group_base_dn", baseDN),
+		groupFilter:   configValue("ldap_group_filter", ""),
+		adminGroups:   ldapGroupList(configValue("ldap_admin_groups", "")),
+		allowedGroups: ldapGroupList(configValue("ldap_allowed_groups", "")),
+		linkExisting:  configValue("ldap_link_existing", "false") == "true",
+	}
+}
+
+// ldapGroupList splits a list of group names or DNs. DNs contain commas,
+// so the list is separated by semicolons.
+func ldapGroupList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ";") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (d ldapDirectory) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: d.insecure}
+	if u, err := url.Parse(d.url); err == nil {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	conn, err := ldap.DialURL(d.url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if d.startTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// ldapFilter fills {username} and {dn} into a configured filter.
+func ldapFilter(filter, username, dn string) string {
+	return strings.NewReplacer(
+		"{username}", ldap.EscapeFilter(username),
+		"{dn}", ldap.EscapeFilter(dn),
+	).Replace(filter)
+}
+
+// authenticate finds the user with the search account, then binds as the
+// user to check the password.
+func (d ldapDirectory) authenticate(username, password string) (ldapIdentity, error) {
+	var id ldapIdentity
+	if password == "" {
+		// An empty password would be an unauthenticated bind, which many
+		// servers accept for any DN.
+		return id, errLDAPNoUser
+	}
+	conn, err := d.dial()
+	if err != nil {
+		return id, fmt.Errorf("ldap connect: %w", err)
+	}
+	defer conn.Close()
+	if d.bindDN != "" {
+		if err := conn.Bind(d.bindDN, d.bindPassword); err != nil {
+			return id, fmt.Errorf("ldap search bind: %w", err)
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(d.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout.Seconds()), false, ldapFilter(d.userFilter, username, ""),
+		[]string{d.usernameAttr, d.groupAttr}, nil))
+	if err != nil {
+		return id, fmt.Errorf("ldap user search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return id, errLDAPNoUser
+	}
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return id, errLDAPNoUser
+	}
+	id.dn = entry.DN
+	id.username = entry.GetAttributeValue(d.usernameAttr)
+	if id.username == "" {
+		id.username = username
+	}
+	id.groups = entry.GetAttributeValues(d.groupAttr)
+	if d.groupFilter != "" {
+		// Servers without memberOf: look the groups up, as the search
+		// account again since the user may not be allowed to.
+		if d.bindDN != "" {
+			if err := conn.Bind(d.bindDN, d.bindPassword); err != nil {
+				return id, fmt.Errorf("ldap search bind: %w", err)
+			}
+		}
+		res, err := conn.Search(ldap.NewSearchRequest(d.groupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+			0, int(ldapTimeout.Seconds()), false, ldapFilter(d.groupFilter, id.username, id.dn),
+			[]string{"dn"}, nil))
+		if err != nil {
+			return id, fmt.Errorf("ldap group search: %w", err)
+		}
+		for _, g := range res.Entries {
+			id.groups = append(id.groups, g.DN)
+		}
+	}
+	return id, nil
+}
+
+// ldapInGroups matches configured groups against the user's group DNs,
+// either by the whole DN or by its common name.
+func ldapInGroups(groups, want []string) bool {
+	for _, g := range groups {
+		cn := g
+		if dn, err := ldap.ParseDN(g); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			cn = dn.RDNs[0].Attributes[0].Value
+		}
+		for _, w := range want {
+			if strings.EqualFold(g, w) || strings.EqualFold(cn, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ldapCheckPassword binds as the account's own directory entry, for
+// directory accounts that have no local password to check against.
+func ldapCheckPassword(user User, password string) bool {
+	id, err := loadLDAPDirectory().authenticate(user.Username, password)
+	return err == nil && id.dn == *user.LDAPDN
+}
+
+// ldapLogin checks the credentials against the directory and returns the
+// linked account, creating it on first login.
+func ldapLogin(username, password string) (User, error) {
+	d := loadLDAPDirectory()
+	id, err := d.authenticate(username, password)
+	if err != nil {
+		return User{}, err
+	}
+	if len(d.allowedGroups) > 0 && !ldapInGroups(id.groups, d.allowedGroups) && !ldapInGroups(id.groups, d.adminGroups) {
+		return User{}, errLDAPForbidden
+	}
+	var user User
+	if err := db.Where("ldap_dn = ?", id.dn).Limit(1).Find(&user).Error; err != nil {
+		return User{}, err
+	}
+	if user.ID == 0 {
+		var existing User
+		db.Where("username = ?", id.username).Limit(1).Find(&existing)
+		switch {
+		case existing.ID != 0 && d.linkExisting && existing.LDAPDN == nil && existing.OIDCSubject == nil:
+			user = existing
+			if err := db.Model(&user).Update("ldap_dn", id.dn).Error; err != nil {
+				return User{}, err
+			}
+			fmt.Printf("Linked %s to directory entry %s\n", user.Username, id.dn)
+		case existing.ID != 0:
+			return User{}, errUserExists
+		default:
+			created, err := createAccount(User{Username: id.username, LDAPDN: &id.dn})
+			if err != nil {
+				return User{}, err
+			}
+			user = created
+			fmt.Printf("Created %s from directory entry %s\n", user.Username, id.dn)
+		}
+	}
+	if len(d.adminGroups) > 0 {
+		if admin := ldapInGroups(id.groups, d.adminGroups); admin != user.IsAdmin {
+			user.IsAdmin = admin
+			db.Model(&user).Update("is_admin", admin)
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// stubDirectory is an LDAP server that understands simple binds and
+// searches with equality, presence, and and or filters. Only the search
+// account may search.
+type stubDirectory struct {
+	addr      string
+	passwords map[string]string
+	entries   map[string]map[string][]string
+	mu        sync.Mutex
+	binds     []string
+}
+
+const (
+	testBaseDN   = "dc=example,dc=org"
+	testSearchDN = "cn=search," + testBaseDN
+)
+
+func newStubDirectory(t *testing.T) *stubDirectory {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	d := &stubDirectory{
+		addr:      l.Addr().String(),
+		passwords: map[string]string{testSearchDN: "search-secret"},
+		entries:   make(map[string]map[string][]string),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *stubDirectory) addUser(uid, password string, groups ...string) string {
+	dn := "uid=" + uid + ",ou=people," + testBaseDN
+	d.mu.Lock()
+	d.passwords[dn] = password
+	d.mu.Unlock()
+	d.addEntry(dn, map[string][]string{"uid": {uid}, "memberOf": groups})
+	return dn
+}
+
+func (d *stubDirectory) addEntry(dn string, attrs map[string][]string) {
+	d.mu.Lock()
+	d.entries[dn] = attrs
+	d.mu.Unlock()
+}
+
+func (d *stubDirectory) bindCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.binds)
+}
+
+func (d *stubDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			d.mu.Lock()
+			d.binds = append(d.binds, dn)
+			want, ok := d.passwords[dn]
+			d.mu.Unlock()
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if ok && password != "" && password == want {
+				code, bound = ldap.LDAPResultSuccess, dn
+			}
+			reply(conn, id, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			if bound != testSearchDN {
+				reply(conn, id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				continue
+			}
+			base := strings.ToLower(op.Children[0].Data.String())
+			d.mu.Lock()
+			for dn, attrs := range d.entries {
+				if !strings.HasSuffix(strings.ToLower(dn), base) || !matchFilter(op.Children[6], attrs) {
+					continue
+				}
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+				list := ber.NewSequence("")
+				for name, values := range attrs {
+					attr := ber.NewSequence("")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, v := range values {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+					}
+					attr.AppendChild(set)
+					list.AppendChild(attr)
+				}
+				entry.AppendChild(list)
+				reply(conn, id, entry)
+			}
+			d.mu.Unlock()
+			reply(conn, id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func matchFilter(f *ber.Packet, attrs map[string][]string) bool {
+	values := func(name string) []string {
+		for k, v := range attrs {
+			if strings.EqualFold(k, name) {
+				return v
+			}
+		}
+		return nil
+	}
+	switch f.Tag {
+	case ldap.FilterAnd, ldap.FilterOr:
+		for _, c := range f.Children {
+			if matchFilter(c, attrs) == (f.Tag == ldap.FilterOr) {
+				return f.Tag == ldap.FilterOr
+			}
+		}
+		return f.Tag == ldap.FilterAnd
+	case ldap.FilterPresent:
+		return len(values(f.Data.String())) > 0
+	case ldap.FilterEqualityMatch:
+		for _, v := range values(f.Children[0].Data.String()) {
+			if strings.EqualFold(v, f.Children[1].Data.String()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ldapResult(tag ber.Tag, code int64) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return p
+}
+
+func reply(conn net.Conn, id int64, op *ber.Packet) {
+	msg := ber.NewSequence("")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	msg.AppendChild(op)
+	conn.Write(msg.Bytes())
+}
+
+func newLDAPTest(t *testing.T, settings map[string]string) *stubDirectory {
+	t.Helper()
+	d := newStubDirectory(t)
+	t.Setenv("HANAS_LDAP_URL", "ldap://"+d.addr)
+	t.Setenv("HANAS_LDAP_BASE_DN", testBaseDN)
+	t.Setenv("HANAS_LDAP_BIND_DN", testSearchDN)
+	t.Setenv("HANAS_LDAP_BIND_PASSWORD", "search-secret")
+	for k, v := range settings {
+		t.Setenv(k, v)
+	}
+	newTestDB(t)
+	if _, err := createAccount(User{Username: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestLDAPLogin(t *testing.T) {
+	d := newLDAPTest(t, map[string]string{"HANAS_LDAP_ADMIN_GROUPS": "admins"})
+	dn := d.addUser("alice", "alice-secret", "cn=admins,ou=groups,"+testBaseDN)
+	d.addUser("bob", "bob-secret")
+
+	if _, ok := checkLogin("alice", "wrong"); ok {
+		t.Fatal("login with a wrong password succeeded")
+	}
+	if _, ok := checkLogin("nobody", "alice-secret"); ok {
+		t.Fatal("login of an unknown user succeeded")
+	}
+	before := d.bindCount()
+	if _, ok := checkLogin("alice", ""); ok || d.bindCount() != before {
+		t.Fatalf("login with an empty password: ok %v, %d binds", ok, d.bindCount()-before)
+	}
+
+	alice, ok := checkLogin("alice", "alice-secret")
+	if !ok || alice.LDAPDN == nil || *alice.LDAPDN != dn || !alice.IsAdmin {
+		t.Fatalf("alice = %+v, %v; want linked to %s and an administrator", alice, ok, dn)
+	}
+	if again, ok := checkLogin("alice", "alice-secret"); !ok || again.ID != alice.ID {
+		t.Fatalf("second login = %+v, %v; want the same account", again, ok)
+	}
+	if bob, ok := checkLogin("bob", "bob-secret"); !ok || bob.IsAdmin {
+		t.Fatalf("bob = %+v, %v; want a user", bob, ok)
+	}
+}
+
+func TestLDAPGroupSearch(t *testing.T) {
+	d := newLDAPTest(t, map[string]string{
+		"HANAS_LDAP_GROUP_FILTER":   "(&(objectClass=groupOfNames)(member={dn}))",
+		"HANAS_LDAP_ALLOWED_GROUPS": "staff",
+	})
+	dn := d.addUser("alice", "alice-secret")
+	d.addUser("bob", "bob-secret")
+	d.addEntry("cn=staff,ou=groups,"+testBaseDN, map[string][]string{"objectClass": {"groupOfNames"}, "member": {dn}})
+
+	if _, ok := checkLogin("alice", "alice-secret"); !ok {
+		t.Fatal("alice, a member of staff, cannot log in")
+	}
+	if _, ok := checkLogin("bob", "bob-secret"); ok {
+		t.Fatal("bob, who is not in staff, logged in")
+	}
+}
+
+func TestLDAPLocalAccounts(t *testing.T) {
+	d := newLDAPTest(t, nil)
+	d.addUser("carol", "directory-secret")
+	d.addUser("dave", "directory-secret")
+	hash, _ := hashPassword("local-secret")
+	createAccount(User{Username: "carol", Password: hash})
+	createAccount(User{Username: "dave"})
+
+	if _, ok := checkLogin("carol", "local-secret"); !ok {
+		t.Fatal("carol cannot log in with the local password")
+	}
+	if _, ok := checkLogin("carol", "directory-secret"); ok {
+		t.Fatal("carol logged in with the directory password of an unlinked account")
+	}
+	if _, ok := checkLogin("dave", "directory-secret"); ok {
+		t.Fatal("the directory took over dave's account")
+	}
+}
+
+func TestLDAPDoesNotTakeOverProviderAccounts(t *testing.T) {
+	d := newLDAPTest(t, map[string]string{"HANAS_LDAP_LINK_EXISTING": "true"})
+	d.addUser("erin", "directory-secret")
+	subject := "https://idp.example issuer-subject"
+	erin, err := createAccount(User{Username: "erin", OIDCSubject: &subject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := checkLogin("erin", "directory-secret"); ok {
+		t.Fatal("the directory took over a single sign-on account")
+	}
+	if _, err := ldapLogin("erin", "directory-secret"); !errors.Is(err, errUserExists) {
+		t.Fatalf("linking a single sign-on account: %v, want %v", err, errUserExists)
+	}
+	var after User
+	db.First(&after, erin.ID)
+	if after.LDAPDN != nil {
+		t.Fatalf("erin was linked to %s", *after.LDAPDN)
+	}
+}
+
+func TestLDAPDeleteAccount(t *testing.T) {
+	d := newLDAPTest(t, nil)
+	d.addUser("alice", "alice-secret")
+	alice, ok := checkLogin("alice", "alice-secret")
+	if !ok {
+		t.Fatal("alice could not log in")
+	}
+	if w := deleteAccount(t, alice, "", ""); w.Code != http.StatusBadRequest || !accountExists(t, alice.ID) {
+		t.Fatalf("no password: %d", w.Code)
+	}
+	if w := deleteAccount(t, alice, "", "wrong"); w.Code != http.StatusUnauthorized || !accountExists(t, alice.ID) {
+		t.Fatalf("wrong password: %d", w.Code)
+	}
+	if w := deleteAccount(t, alice, "", "alice-secret"); w.Code != http.StatusOK || accountExists(t, alice.ID) {
+		t.Fatalf("directory password: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const maxListLimit = 1000
+
+var (
+	errListSort   = errors.New("sort must be name, size, modified or type")
+	errListOrder  = errors.New("order must be asc or desc")
+	errListLimit  = errors.New("limit must be a positive number")
+	errListCursor = errors.New("invalid cursor")
+)
+
+// listOptions shape a folder listing. Without a limit every child is
+// returned, as before listings had pages.
+type listOptions struct {
+	sort         string
+	desc         bool
+	foldersFirst bool
+	kind         string
+	exts         []string
+	limit        int
+	after        *listCursor
+}
+
+// listCursor is the sort key of the last child of a page. The next page
+// starts after it, so entries added or removed in between do not shift it.
+type listCursor struct {
+	ID        uint      `json:"i"`
+	Name      string    `json:"n"`
+	IsDir     bool      `json:"d,omitempty"`
+	Size      int64     `json:"s,omitempty"`
+	UpdatedAt time.Time `json:"t"`
+}
+
+func parseListOptions(q url.Values) (listOptions, error) {
+	opts := listOptions{sort: "name", foldersFirst: q.Get("folders_first") != "false", kind: q.Get("type")}
+	if s := q.Get("sort"); s != "" {
+		if s != "name" && s != "size" && s != "modified" && s != "type" {
+			return opts, errListSort
+		}
+		opts.sort = s
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.desc = true
+	default:
+		return opts, errListOrder
+	}
+	for _, e := range splitList(q.Get("ext")) {
+		opts.exts = append(opts.exts, strings.ToLower(strings.TrimPrefix(e, ".")))
+	}
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return opts, errListLimit
+		}
+		opts.limit = min(n, maxListLimit)
+	}
+	if c := q.Get("cursor"); c != "" {
+		b, err := base64.RawURLEncoding.DecodeString(c)
+		var cur listCursor
+		if err != nil || json.Unmarshal(b, &cur) != nil {
+			return opts, errListCursor
+		}
+		opts.after = &cur
+	}
+	return opts, nil
+}
+
+func cursorOf(n Node) string {
+	b, _ := json.Marshal(listCursor{ID: n.ID, Name: n.Name, IsDir: n.IsDir, Size: n.Size, UpdatedAt: n.UpdatedAt})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// naturalKey maps a name to a key whose byte order is the order people
+// count in: "file2" before "file10", letters without case, ties broken by
+// the name's bytes. Digit runs become their length and digits, other runs
+// their lower case; hex keeps the order and makes it safe to store.
+func naturalKey(name string) string {
+	var k []byte
+	for i := 0; i < len(name); {
+		j := i
+		if isDigit(name[i]) {
+			for j < len(name) && isDigit(name[j]) {
+				j++
+			}
+			digits := strings.TrimLeft(name[i:j], "0")
+			k = append(k, 1, byte(min(len(digits), 255)))
+			k = append(k, digits...)
+		} else {
+			for j < len(name) && !isDigit(name[j]) {
+				j++
+			}
+			k = append(k, 2)
+			k = append(k, strings.ToLower(name[i:j])...)
+			k = append(k, 0)
+		}
+		i = j
+	}
+	k = append(k, 0)
+	k = append(k, name...)
+	return hex.EncodeToString(k)
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// BeforeSave keeps the sort columns in step with the name.
+func (n *Node) BeforeSave(tx *gorm.DB) error {
+	n.SortName = naturalKey(n.Name)
+	n.SortExt = strings.ToLower(filepath.Ext(n.Name))
+	return nil
+}
+
+// migrateSortKeys fills the sort columns of nodes from before they existed.
+func migrateSortKeys() {
+	var nodes []Node
+	fixed := 0
+	err := db.Select("id", "name").Where("sort_name = ''").FindInBatches(&nodes, 1000, func(tx *gorm.DB, _ int) error {
+		for _, n := range nodes {
+			err := db.Model(&Node{}).Where("id = ?", n.ID).UpdateColumns(map[string]interface{}{
+				"sort_name": naturalKey(n.Name),
+				"sort_ext":  strings.ToLower(filepath.Ext(n.Name)),
+			}).Error
+			if err != nil {
+				return err
+			}
+			fixed++
+		}
+		return nil
+	}).Error
+	if err != nil {
+		fmt.Println("warning: failed to compute sort keys:", err)
+	} else if fixed > 0 {
+		fmt.Printf("Computed the sort keys of %d nodes\n", fixed)
+	}
+}
+
+// sortColumn is one column of a listing's order and the cursor's value in
+// it.
+type sortColumn struct {
+	name  string
+	desc  bool
+	value interface{}
+}
+
+// columns is the listing order of the options. Folders come first unless
+// turned off, and the ID breaks ties so that cursors are exact.
+func (o listOptions) columns(c listCursor) []sortColumn {
+	var cols []sortColumn
+	if o.foldersFirst {
+		cols = append(cols, sortColumn{"is_dir", true, c.IsDir})
+	}
+	switch o.sort {
+	case "size":
+		cols = append(cols, sortColumn{"size", o.desc, c.Size})
+	case "modified":
+		cols = append(cols, sortColumn{"updated_at", o.desc, c.UpdatedAt})
+	case "type":
+		cols = append(cols, sortColumn{"sort_ext", o.desc, strings.ToLower(filepath.Ext(c.Name))})
+	}
+	return append(cols, sortColumn{"sort_name", o.desc, naturalKey(c.Name)}, sortColumn{"id", false, c.ID})
+}
+
+// orderBy and after turn the columns into the ORDER BY clause and the
+// keyset condition for the entries after the cursor.
+func orderBy(cols []sortColumn) string {
+	var parts []string
+	for _, c := range cols {
+		if c.desc {
+			parts = append(parts, c.name+" DESC")
+		} else {
+			parts = append(parts, c.name)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func after(cols []sortColumn) (string, []interface{}) {
+	var ors []string
+	var args []interface{}
+	for i, c := range cols {
+		var ands []string
+		for _, p := range cols[:i] {
+			ands = append(ands, p.name+" = ?")
+			args = append(args, p.value)
+		}
+		op := " > ?"
+		if c.desc {
+			op = " < ?"
+		}
+		ands = append(ands, c.name+op)
+		args = append(args, c.value)
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	return strings.Join(ors, " OR "), args
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns that use ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// listChildren loads one page of a folder's children into node.Ko. Order,
+// cursor and limit are left to the database, so a page reads only its own
+// rows.
+func listChildren(node *Node, userID uint, opts listOptions) error {
+	node.Ko = nil
+	node.NextCursor = ""
+	if !node.IsDir {
+		return nil
+	}
+	q := db.Where("oya_id = ? AND user_id = ?", node.ID, userID)
+	switch opts.kind {
+	case "":
+	case "folder":
+		q = q.Where("is_dir = ?", true)
+	case "file":
+		q = q.Where("is_dir = ?", false)
+	default:
+		q = q.Where("is_dir = ? AND (mime_type = ? OR mime_type LIKE ? ESCAPE '\\')", false, opts.kind, likeEscaper.Replace(opts.kind)+"/%")
+	}
+	if len(opts.exts) > 0 {
+		var conds []string
+		var args []interface{}
+		for _, e := range opts.exts {
+			conds = append(conds, "name LIKE ? ESCAPE '\\'")
+			args = append(args, "%."+likeEscaper.Replace(e))
+		}
+		q = q.Where("is_dir = ?", false).Where(strings.Join(conds, " OR "), args...)
+	}
+	var cur listCursor
+	if opts.after != nil {
+		cur = *opts.after
+	}
+	cols := opts.columns(cur)
+	if opts.after != nil {
+		cond, args := after(cols)
+		q = q.Where(cond, args...)
+	}
+	q = q.Order(orderBy(cols))
+	if opts.limit > 0 {
+		q = q.Limit(opts.limit + 1)
+	}
+	var children []Node
+	if err := q.Find(&children).Error; err != nil {
+		return err
+	}
+	if opts.limit > 0 && len(children) > opts.limit {
+		children = children[:opts.limit]
+		node.NextCursor = cursorOf(children[len(children)-1])
+	}
+	node.Ko = children
+	return nil
+}
+
+// listingETag changes with the folder's children and their shares: a
+// child added, removed, renamed, replaced or grown below changes the
+// counts, the latest change time or the sizes.
+func listingETag(node Node, userID uint, query string) string {
+	var kids struct {
+		Children int64
+		Latest   string
+		Sizes    int64
+		Files    int64
+		Weighted float64
+	}
+	var shares struct {
+		Shares   int64
+		MaxShare uint
+	}
+	db.Model(&Node{}).Select("count(*) AS children, coalesce(max(updated_at), '') AS latest, "+
+		"coalesce(sum(size), 0) AS sizes, coalesce(sum(file_count), 0) AS files, total(id * size) AS weighted").
+		Where("oya_id = ? AND user_id = ?", node.ID, userID).Scan(&kids)
+	db.Model(&Share{}).Select("count(*) AS shares, coalesce(max(id), 0) AS max_share").
+		Where("user_id = ? AND (node_id = ? OR node_id IN (?))", userID, node.ID,
+			db.Model(&Node{}).Select("id").Where("oya_id = ? AND user_id = ?", node.ID, userID)).
+		Scan(&shares)
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d %s %d %d %g %d %d %s %d %d %d %s", node.ID, kids.Children, kids.Latest, kids.Sizes,
+		kids.Files, kids.Weighted, shares.Shares, shares.MaxShare,
+		node.UpdatedAt.Format(time.RFC3339Nano), node.Size, node.StoredSize, node.FileCount, query)
+	return `W/"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+func etagMatches(r *http.Request, etag string) bool {
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if t = strings.TrimSpace(t); t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeListing answers a listing request with one page of children, or with
+// 304 when the client's copy is still current.
+func writeListing(w http.ResponseWriter, r *http.Request, node Node, userID uint, opts listOptions) error {
+	etag := listingETag(node, userID, r.URL.RawQuery)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if err := listChildren(&node, userID, opts); err != nil {
+		return err
+	}
+	nodeView(&node, userID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(node.to_json())
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func uploadTestFile(t *testing.T, name, content string, oyaID uint, userID uint) uint {
+	t.Helper()
+	id, err := UploadNode(name, strings.NewReader(content), false, &oyaID, userID, conflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// listAll walks a folder page by page and returns the names in order.
+func listAll(t *testing.T, folder Node, userID uint, query string) []string {
+	t.Helper()
+	q, _ := url.ParseQuery(query)
+	var names []string
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("listing does not end")
+		}
+		opts, err := parseListOptions(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := folder
+		if err := listChildren(&n, userID, opts); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range n.Ko {
+			names = append(names, k.Name)
+		}
+		if n.NextCursor == "" {
+			return names
+		}
+		q.Set("cursor", n.NextCursor)
+	}
+}
+
+func TestNaturalKey(t *testing.T) {
+	names := []string{"a", "A", "a1", "a01", "a2", "a10", "a10b", "ab", "b", "file 9.txt", "file 10.txt", "File 10.txt", "1", "02", "10"}
+	sorted := slices.Clone(names)
+	slices.SortFunc(sorted, func(a, b string) int { return strings.Compare(naturalKey(a), naturalKey(b)) })
+	want := []string{"1", "02", "10", "A", "a", "a01", "a1", "a2", "a10", "a10b", "ab", "b", "file 9.txt", "File 10.txt", "file 10.txt"}
+	if !slices.Equal(sorted, want) {
+		t.Fatalf("natural order is %q, want %q", sorted, want)
+	}
+}
+
+func TestListingPages(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	for i, name := range []string{"file10.txt", "File2.txt", "file1.txt", "notes.md", "b.txt"} {
+		uploadTestFile(t, name, strings.Repeat("x", (i+1)*10), root.ID, user.ID)
+	}
+	if _, err := UploadNode("docs", nil, true, &root.ID, user.ID, conflictFail); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"limit=2", []string{"docs", "b.txt", "file1.txt", "File2.txt", "file10.txt", "notes.md"}},
+		{"limit=4&order=desc", []string{"docs", "notes.md", "file10.txt", "File2.txt", "file1.txt", "b.txt"}},
+		{"limit=1&folders_first=false&order=desc", []string{"notes.md", "file10.txt", "File2.txt", "file1.txt", "docs", "b.txt"}},
+		{"limit=3&sort=size&type=file", []string{"file10.txt", "File2.txt", "file1.txt", "notes.md", "b.txt"}},
+		{"limit=2&sort=type&order=desc", []string{"docs", "file10.txt", "File2.txt", "file1.txt", "b.txt", "notes.md"}},
+		{"limit=2&sort=modified&type=file", []string{"file10.txt", "File2.txt", "file1.txt", "notes.md", "b.txt"}},
+		{"ext=md", []string{"notes.md"}},
+	} {
+		if got := listAll(t, root, user.ID, tc.query); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestListingExtensionWildcards(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	for _, name := range []string{"a.x", "b.xy", "c.x_", "d.%"} {
+		uploadTestFile(t, name, "content", root.ID, user.ID)
+	}
+	for query, want := range map[string][]string{
+		"ext=_":   nil,
+		"ext=x":   {"a.x"},
+		"ext=x_":  {"c.x_"},
+		"ext=%25": {"d.%"},
+	} {
+		if got := listAll(t, root, user.ID, query); !slices.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestListingETag(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	docs, err := UploadNode("docs", nil, true, &root.ID, user.ID, conflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := UploadNode("other", nil, true, &root.ID, user.ID, conflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := func() string {
+		var n Node
+		db.First(&n, docs)
+		return listingETag(n, user.ID, "")
+	}
+	before := etag()
+	uploadTestFile(t, "elsewhere.txt", "content", other, user.ID)
+	if etag() != before {
+		t.Fatal("a change in another folder changed the ETag")
+	}
+	id := uploadTestFile(t, "here.txt", "content", docs, user.ID)
+	added := etag()
+	if added == before {
+		t.Fatal("adding a child kept the ETag")
+	}
+	var n Node
+	db.First(&n, id)
+	if _, err := moveNodeAs(n, docs, "renamed.txt", user.ID, conflictFail); err != nil {
+		t.Fatal(err)
+	}
+	if etag() == added {
+		t.Fatal("renaming a child kept the ETag")
+	}
+}
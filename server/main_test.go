@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// newTestDB opens a fresh database and local store in a temporary
+// directory, configured by the HANAS_ variables the test has set.
+func newTestDB(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	// Tests log in far more often, and need to be quicker, than people do.
+	t.Setenv("HANAS_AUTH_RATE_LIMIT", "100000")
+	t.Setenv("HANAS_ACCOUNT_RATE_LIMIT", "100000")
+	t.Setenv("HANAS_BCRYPT_COST", "4")
+	limitsOnce, policyOnce = sync.Once{}, sync.Once{}
+	openDB()
+	if err := initJWTSecret(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		db = nil
+	})
+}
+
+// checkRange reads n bytes at off from the blob key and compares them with
+// content, which may end earlier.
+func checkRange(t *testing.T, s BlobStore, key string, content []byte, off, n int64) {
+	t.Helper()
+	b, err := s.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.Seek(off, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(io.LimitReader(b, n))
+	if err != nil {
+		t.Fatalf("read %d bytes at %d: %v", n, off, err)
+	}
+	want := content[min(off, int64(len(content))):min(off+n, int64(len(content)))]
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes at %d: got %d bytes that differ from the content", n, off, len(got))
+	}
+}
+
+// newTestUser creates an account and returns it with its root folder.
+func newTestUser(t *testing.T, username string) (User, Node) {
+	t.Helper()
+	user, err := createAccount(User{Username: username})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, return_root(user.ID)
+}
+
+func blobExists(t *testing.T, fid uint) bool {
+	t.Helper()
+	_, err := backend.Stat(blobKey(fid))
+	if err != nil && !isNotExist(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+// newAPIServer serves the API routes of registerAPI.
+func newAPIServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	registerAPI(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// apiCall sends a request to srv, logged in as user unless that is nil, and
+// returns the response with its body read.
+func apiCall(t *testing.T, srv *httptest.Server, user *User, method, path string, body io.Reader) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != nil {
+		rec := httptest.NewRecorder()
+		if err := startSession(rec, *user); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, b
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/glebarez/go-sqlite"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Names are unique per folder by a unique index; writers hold the folder
+// lock from the name check to commit.
+
+const nameIndex = "idx_nodes_oya_name"
+
+// New names are stored in NFC and must be valid on Windows, macOS and
+// Linux.
+const (
+	maxNameBytes = 255
+	// forbiddenNameChars are reserved in Windows file names.
+	forbiddenNameChars = `/\<>:"|?*`
+)
+
+// reservedNames are device names on Windows, with or without extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Conflict policies for a name that is already taken.
+const (
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+	conflictSkip      = "skip"
+	conflictFail      = "fail"
+)
+
+var (
+	errInvalidName    = errors.New("invalid name")
+	errConflictPolicy = errors.New("conflict must be overwrite, rename, skip or fail")
+	// errSkipped ends a unit whose entry already exists under the skip
+	// policy; callers report the existing entry instead.
+	errSkipped = errors.New("skipped: destination already contains an entry with same name")
+)
+
+// cleanName normalizes a new name and checks it.
+func cleanName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return name, fmt.Errorf("%w: not valid UTF-8", errInvalidName)
+	}
+	name = norm.NFC.String(name)
+	switch {
+	case strings.TrimSpace(name) == "":
+		return name, fmt.Errorf("%w: name must not be empty", errInvalidName)
+	case name == "." || name == "..":
+		return name, fmt.Errorf("%w: . and .. are reserved", errInvalidName)
+	case len(name) > maxNameBytes:
+		return name, fmt.Errorf("%w: name is longer than %d bytes", errInvalidName, maxNameBytes)
+	case strings.HasSuffix(name, " ") || strings.HasSuffix(name, "."):
+		return name, fmt.Errorf("%w: name must not end in a space or dot", errInvalidName)
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return name, fmt.Errorf("%w: name must not contain control characters", errInvalidName)
+		}
+		if strings.ContainsRune(forbiddenNameChars, c) {
+			return name, fmt.Errorf("%w: name must not contain %q", errInvalidName, c)
+		}
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		return name, fmt.Errorf("%w: %s is a reserved device name on Windows", errInvalidName, base)
+	}
+	return name, nil
+}
+
+// conflictPolicy reads a conflict policy, falling back to the older
+// overwrite flag when none is given.
+func conflictPolicy(value string, overwrite bool) (string, error) {
+	switch value {
+	case "":
+		if overwrite {
+			return conflictOverwrite, nil
+		}
+		return conflictFail, nil
+	case conflictOverwrite, conflictRename, conflictSkip, conflictFail:
+		return value, nil
+	}
+	return "", errConflictPolicy
+}
+
+// folderLock is the lock of one folder. It is dropped from nodeLocks once
+// nobody holds or waits for it.
+type folderLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockFolders serializes changes to the entries of the given folders. The
+// locks are taken in ID order so that two requests cannot deadlock.
+func lockFolders(ids ...uint) (unlock func()) {
+	ids = slices.Compact(slices.Sorted(slices.Values(ids)))
+	locks := make([]*folderLock, len(ids))
+	nodeLocks.Lock()
+	for i, id := range ids {
+		lock, exists := nodeLocks.m[id]
+		if !exists {
+			lock = &folderLock{}
+			nodeLocks.m[id] = lock
+		}
+		lock.refs++
+		locks[i] = lock
+	}
+	nodeLocks.Unlock()
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+		nodeLocks.Lock()
+		for i, id := range ids {
+			if locks[i].refs--; locks[i].refs == 0 {
+				delete(nodeLocks.m, id)
+			}
+		}
+		nodeLocks.Unlock()
+	}
+}
+
+// isNameTaken reports whether err is a violation of the unique name index,
+// i.e. a request that got past the checks without holding the folder lock.
+// The result code does not say which index failed, and nodes.fid is unique
+// too; only the message names the columns.
+func isNameTaken(err error) bool {
+	var e *sqlite.Error
+	return errors.As(err, &e) && e.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE &&
+		strings.Contains(e.Error(), "nodes.oya_id, nodes.name")
+}
+
+// freeName returns name, or the first free "name (n).ext" shortened to
+// maxNameBytes.
+func freeName(tx *gorm.DB, oyaID uint, name string, isDir bool, userID uint) (string, error) {
+	ext := filepath.Ext(name)
+	if ext == name || isDir {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 1; ; i++ {
+		_, taken, err := childByName(tx, &oyaID, candidate, userID)
+		if err != nil || !taken {
+			return candidate, err
+		}
+		suffix := fmt.Sprintf(" (%d)%s", i, ext)
+		if len(suffix) > maxNameBytes/2 {
+			// An extension this long is kept as part of the base.
+			base, ext = name, ""
+			suffix = fmt.Sprintf(" (%d)", i)
+		}
+		candidate = truncateName(base, maxNameBytes-len(suffix)) + suffix
+	}
+}
+
+// truncateName cuts name to at most n bytes without splitting a character.
+func truncateName(name string, n int) string {
+	if len(name) <= n {
+		return name
+	}
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+	return name[:n]
+}
+
+// migrateUniqueNames renames duplicate siblings from older databases and
+// creates the unique index.
+func migrateUniqueNames() {
+	if db.Migrator().HasIndex(&Node{}, nameIndex) {
+		return
+	}
+	var dups []Node
+	err := db.Where("oya_id IS NOT NULL AND EXISTS (SELECT 1 FROM nodes o WHERE o.oya_id = nodes.oya_id AND o.name = nodes.name AND o.id < nodes.id)").
+		Order("id").Find(&dups).Error
+	if err != nil {
+		fmt.Println("warning: failed to look for duplicate names:", err)
+		return
+	}
+	for _, n := range dups {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			name, err := freeName(tx, *n.OyaID, n.Name, n.IsDir, n.UserID)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Renaming node %d from %q to %q: its folder has another entry of that name\n", n.ID, n.Name, name)
+			return renameNode(tx, n, name)
+		})
+		if err != nil {
+			fmt.Println("warning: failed to rename duplicate:", err)
+			return
+		}
+	}
+	if err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + nameIndex + " ON nodes (oya_id, name)").Error; err != nil {
+		fmt.Println("warning: failed to create unique name index:", err)
+	}
+}
+
+// migrateNFCNames normalizes existing names to NFC once, numbering any that
+// conflict.
+func migrateNFCNames() {
+	if configValue("node_names", "") == "nfc" {
+		return
+	}
+	var nodes []Node
+	if err := db.Where("oya_id IS NOT NULL").Find(&nodes).Error; err != nil {
+		fmt.Println("warning: failed to normalize names:", err)
+		return
+	}
+	renamed := 0
+	for _, n := range nodes {
+		if norm.NFC.IsNormalString(n.Name) {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			name, err := freeName(tx, *n.OyaID, norm.NFC.String(n.Name), n.IsDir, n.UserID)
+			if err != nil {
+				return err
+			}
+			return renameNode(tx, n, name)
+		})
+		if err != nil {
+			fmt.Println("warning: failed to normalize names:", err)
+			return
+		}
+		renamed++
+	}
+	if renamed > 0 {
+		fmt.Printf("Normalized the names of %d nodes\n", renamed)
+	}
+	db.Where("key = ?", "node_names").Delete(&Config{})
+	db.Create(&Config{Key: "node_names", Value: "nfc"})
+}
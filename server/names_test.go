@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+func TestLockFolders(t *testing.T) {
+	unlock := lockFolders(2, 1)
+	acquired := make(chan struct{})
+	go func() {
+		defer lockFolders(1, 3)()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("folder 1 was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-acquired
+	// The goroutine unlocks after closing the channel.
+	for i := 0; ; i++ {
+		nodeLocks.Lock()
+		n := len(nodeLocks.m)
+		nodeLocks.Unlock()
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("%d folder locks are left after unlocking", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrentUploadsOfOneName(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	for _, policy := range []string{conflictFail, conflictRename} {
+		name := policy + ".txt"
+		const n = 8
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, errs[i] = UploadNode(name, strings.NewReader("content"), false, &root.ID, user.ID, policy)
+			}()
+		}
+		wg.Wait()
+		created := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				created++
+			case !errors.Is(err, errConflict) || policy != conflictFail:
+				t.Fatalf("%s: upload failed: %v", policy, err)
+			}
+		}
+		var nodes []Node
+		db.Where("oya_id = ? AND name LIKE ?", root.ID, policy+"%").Find(&nodes)
+		want := 1
+		if policy == conflictRename {
+			want = n
+		}
+		if created != want || len(nodes) != want {
+			t.Fatalf("%s: %d uploads succeeded and %d nodes exist, want %d", policy, created, len(nodes), want)
+		}
+	}
+	blobs := 0
+	backend.List(func(BlobInfo) error { blobs++; return nil })
+	if blobs != 1+8 {
+		t.Fatalf("%d blobs are stored, want one per node", blobs)
+	}
+}
+
+func TestConcurrentMovesOfOneNode(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	src := newFolder(t, "src", root.ID, user.ID)
+	f := uploadTestFile(t, "f.txt", "12345", src, user.ID)
+	stale := nodeByID(t, f)
+	const n = 8
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		dst := newFolder(t, fmt.Sprintf("dst%d", i), root.ID, user.ID)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = moveNodeAs(stale, dst, "f.txt", user.ID, conflictFail)
+		}()
+	}
+	wg.Wait()
+	moved := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			moved++
+		case !errors.Is(err, errMoved):
+			t.Fatalf("move failed: %v", err)
+		}
+	}
+	if moved != 1 {
+		t.Fatalf("the node was moved %d times", moved)
+	}
+	node := nodeByID(t, f)
+	if got, want := node.Ancestry, fmt.Sprintf("/%d/%d/%d/", root.ID, *node.OyaID, f); got != want {
+		t.Fatalf("ancestry is %s, want %s", got, want)
+	}
+	if fixed, err := recalcSizes(false); err != nil || fixed != 0 {
+		t.Fatalf("%d folder totals were off: %v", fixed, err)
+	}
+}
+
+func TestNameTakenIsConflict(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	if _, err := UploadNode("a.txt", strings.NewReader("first"), false, &root.ID, user.ID, conflictFail); err != nil {
+		t.Fatal(err)
+	}
+	// Insert past the name check, as a request without the folder lock
+	// would: the unique index turns it into a conflict and the blob goes.
+	var u unitOfWork
+	content, _ := stageContent(&u, "a.txt", strings.NewReader("second"))
+	err := u.commit(func(tx *gorm.DB) error {
+		return tx.Create(&Node{UserID: user.ID, Name: "a.txt", OyaID: &root.ID, Fid: content.Fid}).Error
+	})
+	if !errors.Is(err, errConflict) {
+		t.Fatalf("commit = %v, want %v", err, errConflict)
+	}
+	if blobExists(t, *content.Fid) {
+		t.Fatal("staged blob is left after the conflict")
+	}
+
+	// Other unique violations are not about names.
+	first := nodeByID(t, uploadTestFile(t, "b.txt", "b", root.ID, user.ID))
+	err = db.Create(&Node{UserID: user.ID, Name: "c.txt", OyaID: &root.ID, Fid: first.Fid}).Error
+	if err == nil || isNameTaken(err) {
+		t.Fatalf("shared fid: %v, taken %v", err, isNameTaken(err))
+	}
+	if _, err := createAccount(User{Username: "alice"}); err == nil || isNameTaken(err) {
+		t.Fatalf("duplicate user: %v", err)
+	}
+}
+
+func TestFreeNameKeepsLength(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	long := strings.Repeat("가", maxNameBytes/3) + ".txt"
+	for len(long) > maxNameBytes {
+		long = long[len("가"):]
+	}
+	for _, name := range []string{long, strings.Repeat("a", maxNameBytes), "a." + strings.Repeat("b", maxNameBytes-2)} {
+		seen := map[string]bool{}
+		for range 12 {
+			id, err := UploadNode(name, strings.NewReader(""), false, &root.ID, user.ID, conflictRename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := nodeName(id)
+			if len(got) > maxNameBytes || !utf8.ValidString(got) || seen[got] {
+				t.Fatalf("renamed to %q (%d bytes)", got, len(got))
+			}
+			if _, err := cleanName(got); err != nil {
+				t.Fatalf("renamed to an invalid name: %v", err)
+			}
+			seen[got] = true
+		}
+	}
+}
+
+func TestClaimNamePolicies(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	upload := func(name string, isDir bool, oyaID uint) uint {
+		t.Helper()
+		var r *strings.Reader
+		if !isDir {
+			r = strings.NewReader(name)
+		}
+		id, err := UploadNode(name, r, isDir, &oyaID, user.ID, conflictFail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	file := upload("a.txt", false, root.ID)
+	dir := upload("my.dir", true, root.ID)
+	inner := upload("inner.txt", false, dir)
+	claim := func(name string, isDir bool, policy string, keep uint) (string, uint, error) {
+		t.Helper()
+		var u unitOfWork
+		var got string
+		var skipID uint
+		err := u.commit(func(tx *gorm.DB) (err error) {
+			got, skipID, err = claimName(&u, tx, root.ID, name, isDir, user.ID, policy, keep)
+			return err
+		})
+		return got, skipID, err
+	}
+
+	for _, policy := range []string{conflictOverwrite, conflictRename, conflictSkip, conflictFail} {
+		if name, _, err := claim("free.txt", false, policy, 0); name != "free.txt" || err != nil {
+			t.Fatalf("%s of a free name = %q, %v", policy, name, err)
+		}
+		if name, _, err := claim("a.txt", false, policy, file); name != "a.txt" || err != nil {
+			t.Fatalf("%s of the node's own name = %q, %v", policy, name, err)
+		}
+	}
+	if _, _, err := claim("a.txt", false, conflictFail, 0); !errors.Is(err, errConflict) {
+		t.Fatalf("fail = %v, want %v", err, errConflict)
+	}
+	if _, id, err := claim("a.txt", false, conflictSkip, 0); !errors.Is(err, errSkipped) || id != file {
+		t.Fatalf("skip = %d, %v; want %d, %v", id, err, file, errSkipped)
+	}
+	if name, _, _ := claim("a.txt", false, conflictRename, 0); name != "a (1).txt" {
+		t.Fatalf("rename of a file = %q, want a (1).txt", name)
+	}
+	upload("a (1).txt", false, root.ID)
+	if name, _, _ := claim("a.txt", false, conflictRename, 0); name != "a (2).txt" {
+		t.Fatalf("rename with a (1).txt taken = %q, want a (2).txt", name)
+	}
+	if name, _, _ := claim("my.dir", true, conflictRename, 0); name != "my.dir (1)" {
+		t.Fatalf("rename of a folder = %q, want my.dir (1)", name)
+	}
+
+	// Overwriting a folder with something from inside it would delete the
+	// source.
+	if _, _, err := claim("my.dir", false, conflictOverwrite, inner); !errors.Is(err, errIntoSelf) {
+		t.Fatalf("overwrite of an ancestor = %v, want %v", err, errIntoSelf)
+	}
+	var old Node
+	db.First(&old, file)
+	if _, _, err := claim("a.txt", false, conflictOverwrite, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(&Node{}, file).Error; err == nil || blobExists(t, *old.Fid) {
+		t.Fatal("overwrite left the replaced file or its blob")
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	for name, want := range map[string]string{
+		"report.pdf":                        "report.pdf",
+		"café":                             "café",
+		"":                                  "",
+		" ":                                 "",
+		"..":                                "",
+		"a/b":                               "",
+		"a:b":                               "",
+		"trailing.":                         "",
+		"trailing ":                         "",
+		"tab\there":                         "",
+		"CON":                               "",
+		"lpt1.txt":                          "",
+		"CONSOLE":                           "CONSOLE",
+		string([]byte{0xff}):                "",
+		strings.Repeat("a", maxNameBytes+1): "",
+	} {
+		got, err := cleanName(name)
+		if want == "" {
+			if !errors.Is(err, errInvalidName) {
+				t.Errorf("cleanName(%q) = %q, %v; want %v", name, got, err, errInvalidName)
+			}
+		} else if got != want || err != nil {
+			t.Errorf("cleanName(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	for _, c := range []struct {
+		value     string
+		overwrite bool
+		want      string
+	}{
+		{"", false, conflictFail},
+		{"", true, conflictOverwrite},
+		{"rename", true, conflictRename},
+		{"skip", false, conflictSkip},
+	} {
+		if got, err := conflictPolicy(c.value, c.overwrite); got != c.want || err != nil {
+			t.Errorf("conflictPolicy(%q, %v) = %q, %v; want %q", c.value, c.overwrite, got, err, c.want)
+		}
+	}
+	if _, err := conflictPolicy("replace", false); !errors.Is(err, errConflictPolicy) {
+		t.Errorf("conflictPolicy(replace) = %v, want %v", err, errConflictPolicy)
+	}
+}
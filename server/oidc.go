@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcClient is set up on first use, so an unreachable provider does not
+// stop startup.
+type oidcClient struct {
+	issuer        string
+	provider      *oidc.Provider
+	verifier      *oidc.IDTokenVerifier
+	oauth         oauth2.Config
+	usernameClaim string
+	groupsClaim   string
+	adminGroups   []string
+	allowedGroups []string
+	linkExisting  bool
+}
+
+// oidcLogin is a login that went to the provider and has not come back yet.
+type oidcLogin struct {
+	verifier string
+	nonce    string
+	next     string
+	redirect string
+	expires  time.Time
+	// linkUser is the logged-in account that asked to be linked to the
+	// provider account.
+	linkUser uint
+}
+
+var (
+	oidcState = struct {
+		sync.Mutex
+		client *oidcClient
+	}{}
+	oidcLogins = struct {
+		sync.Mutex
+		m map[string]oidcLogin
+	}{m: make(map[string]oidcLogin)}
+
+	errOIDCDisabled  = errors.New("single sign-on is not configured")
+	errOIDCForbidden = errors.New("your account is not in a group allowed to use this server")
+	errOIDCUsername  = errors.New("username is taken by a local account")
+	errOIDCLinked    = errors.New("the provider account or the local account is already linked")
+)
+
+func oidcEnabled() bool {
+	return configValue("oidc_issuer", "") != ""
+}
+
+func passwordLoginEnabled() bool {
+	return configValue("password_login", "true") != "false"
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func getOIDC(ctx context.Context) (*oidcClient, error) {
+	oidcState.Lock()
+	defer oidcState.Unlock()
+	if oidcState.client != nil {
+		return oidcState.client, nil
+	}
+	issuer := configValue("oidc_issuer", "")
+	if issuer == "" {
+		return nil, errOIDCDisabled
+	}
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	clientID := configValue("oidc_client_id", "")
+	c := &oidcClient{
+		issuer:   issuer,
+		provider: provider,
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		oauth: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: configValue("oidc_client_secret", ""),
+			Endpoint:     provider.Endpoint(),
+			Scopes:       strings.Fields(configValue("oidc_scopes", "openid profile email")),
+		},
+		usernameClaim: configValue("oidc_username_claim", "preferred_username"),
+		groupsClaim:   configValue("oidc_groups_claim", "groups"),
+		adminGroups:   splitList(configValue("oidc_admin_groups", "")),
+		allowedGroups: splitList(configValue("oidc_allowed_groups", "")),
+		linkExisting:  configValue("oidc_link_existing", "false") == "true",
+	}
+	oidcState.client = c
+	fmt.Printf("Using identity provider %s\n", issuer)
+	return c, nil
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// oidcRedirectURL is oidc_redirect_url, or the callback on the host the
+// request came in on.
+func oidcRedirectURL(r *http.Request) string {
+	if u := configValue("oidc_redirect_url", ""); u != "" {
+		return u
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/auth/oidc/callback"
+}
+
+// OIDCLogin redirects to the identity provider. A logged-in user posting
+// link=1 links the provider account instead.
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if throttled(w, r, throttleAuth, getLimits().authRate) {
+		return
+	}
+	c, err := getOIDC(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	state := randomString(24)
+	login := oidcLogin{
+		verifier: oauth2.GenerateVerifier(),
+		nonce:    randomString(24),
+		next:     next,
+		redirect: oidcRedirectURL(r),
+		expires:  time.Now().Add(oidcLoginTimeout),
+	}
+	if r.FormValue("link") == "1" {
+		if !c.linkExisting {
+			http.Error(w, "linking accounts is disabled", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authenticate(r) || isTokenRequest(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		login.linkUser, _ = getUserIDFromRequest(r)
+	}
+	oidcLogins.Lock()
+	for k, l := range oidcLogins.m {
+		if time.Now().After(l.expires) {
+			delete(oidcLogins.m, k)
+		}
+	}
+	oidcLogins.m[state] = login
+	oidcLogins.Unlock()
+	// The state is also kept in a cookie so that a callback only completes
+	// in the browser that started the login.
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc_state",
+		Value:    state,
+		Path:     "/auth/oidc/",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	cfg := c.oauth
+	cfg.RedirectURL = login.redirect
+	http.Redirect(w, r, cfg.AuthCodeURL(state, oauth2.S256ChallengeOption(login.verifier), oidc.Nonce(login.nonce)), http.StatusFound)
+}
+
+// OIDCCallback finishes the code flow, validates the ID token and logs the
+// user in, creating the account on first login.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if throttled(w, r, throttleAuth, getLimits().authRate) {
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "login failed: "+e+" "+q.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+	c, err := getOIDC(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	state := q.Get("state")
+	cookie, err := r.Cookie("oidc_state")
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, "login state mismatch", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oidc_state", Value: "", Path: "/auth/oidc/", MaxAge: -1, HttpOnly: true})
+	oidcLogins.Lock()
+	login, ok := oidcLogins.m[state]
+	delete(oidcLogins.m, state)
+	oidcLogins.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	cfg := c.oauth
+	cfg.RedirectURL = login.redirect
+	tok, err := cfg.Exchange(r.Context(), q.Get("code"), oauth2.VerifierOption(login.verifier))
+	if err != nil {
+		http.Error(w, "code exchange failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rawID, ok := tok.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "no id_token in token response", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := c.verifier.Verify(r.Context(), rawID)
+	if err != nil {
+		http.Error(w, "invalid id_token: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if idToken.Nonce != login.nonce {
+		http.Error(w, "invalid id_token: nonce mismatch", http.StatusUnauthorized)
+		return
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "invalid id_token claims", http.StatusUnauthorized)
+		return
+	}
+	user, err := c.provision(idToken.Subject, claims, login.linkUser)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errOIDCForbidden) {
+			status = http.StatusForbidden
+		} else if errors.Is(err, errOIDCUsername) || errors.Is(err, errOIDCLinked) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if err := startSession(w, user); err != nil {
+		http.Error(w, "failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, login.next, http.StatusFound)
+}
+
+// claimStrings reads a claim that may be a single string or a list.
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return splitList(v)
+	case []interface{}:
+		var out []string
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func inGroups(groups, want []string) bool {
+	for _, g := range groups {
+		for _, w := range want {
+			if g == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var unsafeUsername = regexp.MustCompile(`[^\p{L}\p{N}._@-]+`)
+
+// provision finds or creates the account of subject. A local account is
+// only linked when its logged-in user asked, as linkUser.
+func (c *oidcClient) provision(subject string, claims map[string]interface{}, linkUser uint) (User, error) {
+	groups := claimStrings(claims, c.groupsClaim)
+	if len(c.allowedGroups) > 0 && !inGroups(groups, c.allowedGroups) && !inGroups(groups, c.adminGroups) {
+		return User{}, errOIDCForbidden
+	}
+	link := c.issuer + " " + subject
+	var user User
+	if err := db.Where("oidc_subject = ?", link).Limit(1).Find(&user).Error; err != nil {
+		return User{}, err
+	}
+	if linkUser != 0 {
+		if user.ID != 0 && user.ID != linkUser {
+			return User{}, errOIDCLinked
+		}
+		if user.ID == 0 {
+			if err := db.First(&user, linkUser).Error; err != nil {
+				return User{}, err
+			}
+			if user.OIDCSubject != nil {
+				return User{}, errOIDCLinked
+			}
+			if err := db.Model(&user).Update("oidc_subject", link).Error; err != nil {
+				return User{}, err
+			}
+			fmt.Printf("Linked %s to identity provider subject %s\n", user.Username, subject)
+		}
+	}
+	if user.ID == 0 {
+		username, _ := claims[c.usernameClaim].(string)
+		if username == "" {
+			username, _ = claims["email"].(string)
+		}
+		if username == "" {
+			username = subject
+		}
+		username = unsafeUsername.ReplaceAllString(username, "_")
+		var existing User
+		db.Where("username = ?", username).Limit(1).Find(&existing)
+		if existing.ID != 0 {
+			return User{}, errOIDCUsername
+		}
+		created, err := createAccount(User{Username: username, OIDCSubject: &link})
+		if err != nil {
+			return User{}, err
+		}
+		user = created
+		fmt.Printf("Created %s from identity provider subject %s\n", username, subject)
+	}
+	if len(c.adminGroups) > 0 {
+		if admin := inGroups(groups, c.adminGroups); admin != user.IsAdmin {
+			user.IsAdmin = admin
+			db.Model(&user).Update("is_admin", admin)
+		}
+	}
+	return user, nil
+}
+
+// AuthMethods tells login pages which ways to sign in are available.
+func AuthMethods(w http.ResponseWriter, r *http.Request) {
+	resp := AuthMethodsInfo{Password: passwordLoginEnabled(), LDAP: ldapEnabled(), OIDC: oidcEnabled()}
+	if resp.OIDC {
+		resp.OIDCLoginURL = "/auth/oidc/login"
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type AuthMethodsInfo struct {
+	Password     bool   `json:"password"`
+	LDAP         bool   `json:"ldap"`
+	OIDC         bool   `json:"oidc"`
+	OIDCLoginURL string `json:"oidc_login_url,omitempty"`
+}
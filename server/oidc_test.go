@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeIdP is an OpenID provider that logs in whoever has the claims set in
+// next, without asking.
+type fakeIdP struct {
+	*httptest.Server
+	key  *rsa.PrivateKey
+	mu   sync.Mutex
+	next jwt.MapClaims
+	// codes maps issued codes to the nonce and PKCE challenge they were
+	// issued for.
+	codes map[string][2]string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeIdP{key: key, codes: make(map[string][2]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "alg": "RS256", "use": "sig", "kid": "test",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := randomString(12)
+		p.mu.Lock()
+		p.codes[code] = [2]string{q.Get("nonce"), q.Get("code_challenge")}
+		p.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		issued, ok := p.codes[r.Form.Get("code")]
+		delete(p.codes, r.Form.Get("code"))
+		claims := jwt.MapClaims{}
+		for k, v := range p.next {
+			claims[k] = v
+		}
+		p.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != issued[1] {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims["iss"] = p.URL
+		claims["aud"] = "hanas"
+		claims["nonce"] = issued[0]
+		claims["iat"] = time.Now().Unix()
+		claims["exp"] = time.Now().Add(time.Minute).Unix()
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tok.Header["kid"] = "test"
+		signed, err := tok.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"access_token": "access", "token_type": "Bearer", "expires_in": 60, "id_token": signed,
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// oidcTest runs the login endpoints against a fake provider, with the
+// given extra settings.
+type oidcTest struct {
+	idp *fakeIdP
+	app *httptest.Server
+}
+
+func newOIDCTest(t *testing.T, settings map[string]string) *oidcTest {
+	t.Helper()
+	idp := newFakeIdP(t)
+	t.Setenv("HANAS_OIDC_ISSUER", idp.URL)
+	t.Setenv("HANAS_OIDC_CLIENT_ID", "hanas")
+	t.Setenv("HANAS_OIDC_CLIENT_SECRET", "secret")
+	for k, v := range settings {
+		t.Setenv(k, v)
+	}
+	newTestDB(t)
+	oidcState.client = nil
+	t.Cleanup(func() { oidcState.client = nil })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/oidc/login", OIDCLogin)
+	mux.HandleFunc("/auth/oidc/callback", OIDCCallback)
+	app := httptest.NewServer(mux)
+	t.Cleanup(app.Close)
+	// Someone else is the first account, which would be an administrator.
+	if _, err := createAccount(User{Username: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	return &oidcTest{idp: idp, app: app}
+}
+
+// login goes through the provider as the owner of claims, in a browser
+// logged in as user unless that is nil. It returns the final response of
+// the server and the browser's cookies.
+func (o *oidcTest) login(t *testing.T, method, query string, user *User, claims jwt.MapClaims) (*http.Response, *cookiejar.Jar) {
+	t.Helper()
+	o.idp.mu.Lock()
+	o.idp.next = claims
+	o.idp.mu.Unlock()
+	jar, _ := cookiejar.New(nil)
+	appURL, _ := url.Parse(o.app.URL)
+	if user != nil {
+		rec := httptest.NewRecorder()
+		if err := startSession(rec, *user); err != nil {
+			t.Fatal(err)
+		}
+		jar.SetCookies(appURL, rec.Result().Cookies())
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// Stop at the page the login returns to.
+			if req.URL.Host == appURL.Host && req.URL.Path != "/auth/oidc/callback" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	req, _ := http.NewRequest(method, o.app.URL+"/auth/oidc/login"+query, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp, jar
+}
+
+func sessionUser(t *testing.T, jar *cookiejar.Jar, app string) (uint, bool) {
+	t.Helper()
+	u, _ := url.Parse(app)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range jar.Cookies(u) {
+		r.AddCookie(c)
+	}
+	if !authenticate(r) {
+		return 0, false
+	}
+	id, err := getUserIDFromRequest(r)
+	return id, err == nil
+}
+
+func findUser(t *testing.T, username string) User {
+	t.Helper()
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		t.Fatalf("user %s: %v", username, err)
+	}
+	return user
+}
+
+func TestOIDCLoginCreatesAccount(t *testing.T) {
+	o := newOIDCTest(t, map[string]string{"HANAS_OIDC_ADMIN_GROUPS": "admins"})
+	resp, jar := o.login(t, http.MethodGet, "?next=/files", nil, jwt.MapClaims{
+		"sub": "s1", "preferred_username": "alice", "groups": []string{"admins"},
+	})
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/files" {
+		t.Fatalf("login: %d to %q, want 302 to /files", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	alice := findUser(t, "alice")
+	if alice.OIDCSubject == nil || *alice.OIDCSubject != o.idp.URL+" s1" || !alice.IsAdmin {
+		t.Fatalf("alice = %+v, want linked to s1 and an administrator", alice)
+	}
+	if id, ok := sessionUser(t, jar, o.app.URL); !ok || id != alice.ID {
+		t.Fatalf("session user = %d, %v, want %d", id, ok, alice.ID)
+	}
+
+	// The next login finds the account by subject, whatever the name is
+	// now, and takes the role away with the group.
+	o.login(t, http.MethodGet, "", nil, jwt.MapClaims{"sub": "s1", "preferred_username": "renamed"})
+	var n int64
+	db.Model(&User{}).Count(&n)
+	if alice = findUser(t, "alice"); alice.IsAdmin || n != 2 {
+		t.Fatalf("after second login: admin %v, %d users; want not admin, 2 users", alice.IsAdmin, n)
+	}
+}
+
+func TestOIDCDoesNotTakeOverLocalAccount(t *testing.T) {
+	o := newOIDCTest(t, map[string]string{"HANAS_OIDC_LINK_EXISTING": "true"})
+	if _, err := createAccount(User{Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	resp, jar := o.login(t, http.MethodGet, "", nil, jwt.MapClaims{
+		"sub": "intruder", "preferred_username": "bob", "email": "bob@example.com",
+	})
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("login as bob: %d, want 409", resp.StatusCode)
+	}
+	if bob := findUser(t, "bob"); bob.OIDCSubject != nil {
+		t.Fatalf("bob was linked to %s", *bob.OIDCSubject)
+	}
+	if _, ok := sessionUser(t, jar, o.app.URL); ok {
+		t.Fatal("login as bob started a session")
+	}
+}
+
+func TestOIDCLinkAccount(t *testing.T) {
+	o := newOIDCTest(t, map[string]string{"HANAS_OIDC_LINK_EXISTING": "true"})
+	bob, _ := createAccount(User{Username: "bob"})
+	carol, _ := createAccount(User{Username: "carol"})
+	claims := jwt.MapClaims{"sub": "s2", "preferred_username": "robert"}
+
+	if resp, _ := o.login(t, http.MethodPost, "?link=1", nil, claims); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("link without a session: %d, want 401", resp.StatusCode)
+	}
+	if resp, _ := o.login(t, http.MethodGet, "?link=1", &bob, claims); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("link with GET: %d, want 405", resp.StatusCode)
+	}
+	resp, jar := o.login(t, http.MethodPost, "?link=1", &bob, claims)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("link: %d, want 302", resp.StatusCode)
+	}
+	if bob = findUser(t, "bob"); bob.OIDCSubject == nil || *bob.OIDCSubject != o.idp.URL+" s2" {
+		t.Fatalf("bob = %+v, want linked to s2", bob)
+	}
+	if id, _ := sessionUser(t, jar, o.app.URL); id != bob.ID {
+		t.Fatalf("session user = %d, want bob", id)
+	}
+	if resp, _ := o.login(t, http.MethodGet, "", nil, claims); resp.StatusCode != http.StatusFound {
+		t.Fatalf("login after linking: %d, want 302", resp.StatusCode)
+	}
+
+	if resp, _ := o.login(t, http.MethodPost, "?link=1", &carol, claims); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("linking the provider account again: %d, want 409", resp.StatusCode)
+	}
+	if carol = findUser(t, "carol"); carol.OIDCSubject != nil {
+		t.Fatalf("carol was linked to %s", *carol.OIDCSubject)
+	}
+}
+
+func TestOIDCLinkDisabled(t *testing.T) {
+	o := newOIDCTest(t, nil)
+	bob, _ := createAccount(User{Username: "bob"})
+	resp, _ := o.login(t, http.MethodPost, "?link=1", &bob, jwt.MapClaims{"sub": "s3"})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("link while disabled: %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestOIDCDeleteAccountNeedsRecentLogin(t *testing.T) {
+	o := newOIDCTest(t, nil)
+	_, jar := o.login(t, http.MethodGet, "", nil, jwt.MapClaims{"sub": "s4", "preferred_username": "dora"})
+	dora := findUser(t, "dora")
+
+	// A session from an hour ago.
+	key := currentSigningKey()
+	old := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UserID: dora.ID, Username: dora.Username,
+		RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now().Add(-time.Hour))}})
+	old.Header["kid"] = key.ID
+	stale, err := old.SignedString([]byte(key.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appURL, _ := url.Parse(o.app.URL)
+	fresh := ""
+	for _, c := range jar.Cookies(appURL) {
+		if c.Name == "token" {
+			fresh = c.Value
+		}
+	}
+	for _, tc := range []struct {
+		cookie string
+		want   int
+	}{
+		{stale, http.StatusUnauthorized},
+		{fresh, http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/delete-account", strings.NewReader(`{}`))
+		r.AddCookie(&http.Cookie{Name: "token", Value: tc.cookie})
+		w := httptest.NewRecorder()
+		authMiddleware(DeleteAccount)(w, r)
+		if w.Code != tc.want {
+			t.Fatalf("delete-account: %d %s, want %d", w.Code, w.Body, tc.want)
+		}
+	}
+	if accountExists(t, dora.ID) {
+		t.Fatal("dora's account is still there")
+	}
+}
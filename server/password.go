@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt ignores everything after the first 72 bytes.
+const maxPasswordBytes = 72
+
+// PasswordReset is a one-time token an administrator hands to a user who
+// forgot their password. Only the SHA-256 of the token is stored.
+type PasswordReset struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"-"`
+	Hash      string    `gorm:"uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// NewPasswordReset is returned once when a reset is issued.
+type NewPasswordReset struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+var (
+	errWeakPassword    = errors.New("password does not meet the password policy")
+	errWrongPassword   = errors.New("current password is incorrect")
+	errNoLocalPassword = errors.New("this account signs in through single sign-on or LDAP and has no password here")
+	errResetToken      = errors.New("invalid or expired reset token")
+)
+
+// passwordPolicy is read once; like the other settings it needs a restart.
+type passwordPolicy struct {
+	minLength int
+	cost      int
+	resetTTL  time.Duration
+	// breached holds upper-case SHA-1 hex digests, the format of the
+	// Have I Been Pwned downloads.
+	breached map[string]bool
+}
+
+var (
+	policyOnce   sync.Once
+	loadedPolicy passwordPolicy
+)
+
+func getPasswordPolicy() passwordPolicy {
+	policyOnce.Do(func() {
+		loadedPolicy = passwordPolicy{
+			minLength: configInt("password_min_length", 8),
+			cost:      configInt("bcrypt_cost", 14),
+			resetTTL:  time.Duration(configInt("password_reset_ttl", 86400)) * time.Second,
+		}
+		if loadedPolicy.cost < bcrypt.MinCost || loadedPolicy.cost > bcrypt.MaxCost {
+			fmt.Printf("warning: bcrypt_cost must be between %d and %d, using 14\n", bcrypt.MinCost, bcrypt.MaxCost)
+			loadedPolicy.cost = 14
+		}
+		if path := configValue("password_breach_list", ""); path != "" {
+			breached, err := loadBreachList(path)
+			if err != nil {
+				fmt.Println("warning: failed to load password breach list:", err)
+			} else {
+				fmt.Printf("Loaded %d breached passwords from %s\n", len(breached), path)
+			}
+			loadedPolicy.breached = breached
+		}
+	})
+	return loadedPolicy
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// loadBreachList reads one password per line. Lines that are a SHA-1 hex
+// digest, optionally followed by ":count", are taken as already hashed.
+func loadBreachList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	breached := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		digest, _, _ := strings.Cut(line, ":")
+		if _, err := hex.DecodeString(digest); err == nil && len(digest) == 2*sha1.Size {
+			breached[strings.ToUpper(digest)] = true
+		} else {
+			breached[sha1Hex(line)] = true
+		}
+	}
+	return breached, sc.Err()
+}
+
+// checkPasswordPolicy tells why a new password is not acceptable.
+func checkPasswordPolicy(username, password string) error {
+	p := getPasswordPolicy()
+	if utf8.RuneCountInString(password) < p.minLength {
+		return fmt.Errorf("%w: it must be at least %d characters", errWeakPassword, p.minLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("%w: it must be at most %d bytes", errWeakPassword, maxPasswordBytes)
+	}
+	if strings.EqualFold(password, username) {
+		return fmt.Errorf("%w: it must not be the username", errWeakPassword)
+	}
+	if p.breached[sha1Hex(password)] {
+		return fmt.Errorf("%w: it appears in a list of breached passwords", errWeakPassword)
+	}
+	return nil
+}
+
+// rehashPassword stores a new hash after a successful login when the hash
+// was made with a different bcrypt_cost.
+func rehashPassword(user User, password string) {
+	cost, err := bcrypt.Cost([]byte(user.Password))
+	if err != nil || cost == getPasswordPolicy().cost {
+		return
+	}
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return
+	}
+	if err := db.Model(&User{}).Where("id = ? AND password = ?", user.ID, user.Password).Update("password", hashed).Error; err != nil {
+		fmt.Println("warning: failed to rehash password:", err)
+	}
+}
+
+// setPassword replaces the password and bumps the token version, which logs
+// out every session issued before.
+func setPassword(user *User, password string) error {
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password")
+	}
+	user.Password = hashed
+	user.TokenVersion++
+	return db.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"password":      user.Password,
+		"token_version": user.TokenVersion,
+	}).Error
+}
+
+// changePassword checks the current password and sets the new one.
+func changePassword(r *http.Request, user *User, req PasswordChangeRequest) error {
+	if user.Password == "" {
+		return errNoLocalPassword
+	}
+	if !checkPasswordHash(req.CurrentPassword, user.Password) {
+		recordFailure(r, throttleAuth, user.Username)
+		return errWrongPassword
+	}
+	if err := checkPasswordPolicy(user.Username, req.NewPassword); err != nil {
+		return err
+	}
+	if err := setPassword(user, req.NewPassword); err != nil {
+		return err
+	}
+	audit("password_changed", user.Username, clientIP(r), "")
+	return nil
+}
+
+// issuePasswordReset replaces any earlier reset of the user.
+func issuePasswordReset(user User) (NewPasswordReset, error) {
+	var nr NewPasswordReset
+	if user.Password == "" {
+		return nr, errNoLocalPassword
+	}
+	db.Where("user_id = ?", user.ID).Delete(&PasswordReset{})
+	nr.Token = randomString(32)
+	nr.ExpiresAt = time.Now().Add(getPasswordPolicy().resetTTL)
+	reset := PasswordReset{UserID: user.ID, Hash: hashAccessToken(nr.Token), ExpiresAt: nr.ExpiresAt}
+	if err := db.Create(&reset).Error; err != nil {
+		return nr, fmt.Errorf("failed to create reset: %w", err)
+	}
+	return nr, nil
+}
+
+// redeemPasswordReset sets the password of the user the token was issued
+// for. The token works once.
+func redeemPasswordReset(r *http.Request, req PasswordResetRequest) (User, error) {
+	var resets []PasswordReset
+	db.Where("hash = ?", hashAccessToken(req.Token)).Limit(1).Find(&resets)
+	if len(resets) == 0 || time.Now().After(resets[0].ExpiresAt) {
+		recordFailure(r, throttleAuth, "")
+		return User{}, errResetToken
+	}
+	var user User
+	if err := db.First(&user, resets[0].UserID).Error; err != nil {
+		return User{}, errResetToken
+	}
+	if err := checkPasswordPolicy(user.Username, req.NewPassword); err != nil {
+		return User{}, err
+	}
+	// Claim the token before using it so that it is only redeemed once.
+	claim := db.Where("hash = ? AND expires_at > ?", resets[0].Hash, time.Now()).Delete(&PasswordReset{})
+	if claim.Error != nil {
+		return User{}, claim.Error
+	}
+	if claim.RowsAffected != 1 {
+		recordFailure(r, throttleAuth, "")
+		return User{}, errResetToken
+	}
+	if err := setPassword(&user, req.NewPassword); err != nil {
+		return User{}, err
+	}
+	db.Where("user_id = ?", user.ID).Delete(&PasswordReset{})
+	recordSuccess(r, user.Username)
+	audit("password_reset", user.Username, clientIP(r), "")
+	return user, nil
+}
+
+func passwordErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errWrongPassword):
+		return http.StatusUnauthorized
+	case errors.Is(err, errWeakPassword), errors.Is(err, errNoLocalPassword), errors.Is(err, errResetToken):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// ChangePassword handles POST /account/password. The session it is called
+// from gets a new cookie; all others are logged out.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if isTokenRequest(r) {
+		http.Error(w, "Forbidden: passwords are changed from a login session", http.StatusForbidden)
+		return
+	}
+	userID, _ := getUserIDFromRequest(r)
+	var req PasswordChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if throttled(w, r, throttleAuth, getLimits().authRate, user.Username) {
+		return
+	}
+	if err := changePassword(r, &user, req); err != nil {
+		http.Error(w, err.Error(), passwordErrorStatus(err))
+		return
+	}
+	if err := startSession(w, user); err != nil {
+		http.Error(w, "failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"success":true}`))
+}
+
+// ResetPassword handles POST /password-reset with a token from an
+// administrator.
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if throttled(w, r, throttleAuth, getLimits().authRate) {
+		return
+	}
+	if _, err := redeemPasswordReset(r, req); err != nil {
+		http.Error(w, err.Error(), passwordErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"success":true}`))
+}
+
+// AdminPasswordReset handles POST /admin/users/<id>/password-reset.
+func AdminPasswordReset(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/users/")
+	idStr, action, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil || action != "password-reset" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var user User
+	if err := db.First(&user, id).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	nr, err := issuePasswordReset(user)
+	if err != nil {
+		http.Error(w, err.Error(), passwordErrorStatus(err))
+		return
+	}
+	audit("password_reset_issued", user.Username, clientIP(r), "by "+r.Header.Get("X-Username"))
+	writeJSON(w, http.StatusCreated, nr)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPasswordResetClaim(t *testing.T) {
+	newTestDB(t)
+	user, _ := newPasswordUser(t, "alice", "old-password")
+	r := httptest.NewRequest("POST", "/password-reset", nil)
+	first, err := issuePasswordReset(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nr, err := issuePasswordReset(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := redeemPasswordReset(r, PasswordResetRequest{Token: first.Token, NewPassword: "new-password"}); !errors.Is(err, errResetToken) {
+		t.Fatalf("replaced token: %v, want %v", err, errResetToken)
+	}
+	// A rejected password leaves the token usable.
+	if _, err := redeemPasswordReset(r, PasswordResetRequest{Token: nr.Token, NewPassword: "short"}); !errors.Is(err, errWeakPassword) {
+		t.Fatalf("weak password: %v, want %v", err, errWeakPassword)
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan error, 8)
+	for range cap(results) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := redeemPasswordReset(r, PasswordResetRequest{Token: nr.Token, NewPassword: "new-password"})
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+	redeemed := 0
+	for err := range results {
+		switch {
+		case err == nil:
+			redeemed++
+		case !errors.Is(err, errResetToken):
+			t.Errorf("concurrent redemption: %v", err)
+		}
+	}
+	if redeemed != 1 {
+		t.Fatalf("the token was redeemed %d times", redeemed)
+	}
+	var after User
+	db.First(&after, user.ID)
+	if !checkPasswordHash("new-password", after.Password) || after.TokenVersion != user.TokenVersion+1 {
+		t.Fatalf("after the reset: token version %d, new password set %v", after.TokenVersion, checkPasswordHash("new-password", after.Password))
+	}
+	var left int64
+	db.Model(&PasswordReset{}).Where("user_id = ?", user.ID).Count(&left)
+	if left != 0 {
+		t.Fatalf("%d resets are left", left)
+	}
+}
+
+func TestPasswordResetExpiry(t *testing.T) {
+	newTestDB(t)
+	user, _ := newPasswordUser(t, "alice", "old-password")
+	nr, err := issuePasswordReset(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&PasswordReset{}).Where("user_id = ?", user.ID).Update("expires_at", time.Now().Add(-time.Second))
+	r := httptest.NewRequest("POST", "/password-reset", nil)
+	if _, err := redeemPasswordReset(r, PasswordResetRequest{Token: nr.Token, NewPassword: "new-password"}); !errors.Is(err, errResetToken) {
+		t.Fatalf("expired token: %v, want %v", err, errResetToken)
+	}
+	subject := "https://idp.example subject"
+	sso, err := createAccount(User{Username: "erin", OIDCSubject: &subject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuePasswordReset(sso); !errors.Is(err, errNoLocalPassword) {
+		t.Fatalf("reset for a single sign-on account: %v, want %v", err, errNoLocalPassword)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	newTestDB(t)
+	user, _ := newPasswordUser(t, "alice", "old-password")
+	r := httptest.NewRequest("POST", "/account/password", nil)
+	for _, tc := range []struct {
+		current, next string
+		want          error
+	}{
+		{"wrong", "new-password", errWrongPassword},
+		{"old-password", "short", errWeakPassword},
+		{"old-password", "ALICE", errWeakPassword},
+		{"old-password", "new-password", nil},
+	} {
+		if err := changePassword(r, &user, PasswordChangeRequest{CurrentPassword: tc.current, NewPassword: tc.next}); !errors.Is(err, tc.want) {
+			t.Errorf("%s to %s: %v, want %v", tc.current, tc.next, err, tc.want)
+		}
+	}
+	var after User
+	db.First(&after, user.ID)
+	if !checkPasswordHash("new-password", after.Password) || after.TokenVersion != 1 {
+		t.Fatalf("password not changed: token version %d", after.TokenVersion)
+	}
+}
+
+func TestPasswordBreachList(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "breached.txt")
+	content := "password123\n" + sha1Hex("letmein-please") + ":42\n\n"
+	if err := os.WriteFile(list, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HANAS_PASSWORD_BREACH_LIST", list)
+	newTestDB(t)
+	for password, weak := range map[string]bool{"password123": true, "letmein-please": true, "Password123": false} {
+		if err := checkPasswordPolicy("alice", password); errors.Is(err, errWeakPassword) != weak {
+			t.Errorf("%s: %v", password, err)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rateWindow    = time.Minute
+	sweepInterval = 10 * time.Minute
+	throttleChunk = 32 << 10
+)
+
+// AuditLog records security events such as lockouts.
+type AuditLog struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	CreatedAt time.Time `gorm:"autoCreateTime;index" json:"created_at"`
+	Event     string    `gorm:"not null;index" json:"event"`
+	Username  string    `json:"username,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+func audit(event, username, ip, detail string) {
+	fmt.Printf("audit: %s user=%q ip=%s %s\n", event, username, ip, detail)
+	if err := db.Create(&AuditLog{Event: event, Username: username, IP: ip, Detail: detail}).Error; err != nil {
+		fmt.Println("warning: failed to write audit log:", err)
+	}
+}
+
+// limits are read once; like the other settings they need a restart.
+type limits struct {
+	authRate       int
+	accountRate    int
+	shareRate      int
+	threshold      int
+	lockout        time.Duration
+	maxLockout     time.Duration
+	trustProxy     bool
+	shareBandwidth int64
+	shareTotal     int64
+}
+
+var (
+	limitsOnce   sync.Once
+	loadedLimits limits
+)
+
+func getLimits() limits {
+	limitsOnce.Do(func() {
+		loadedLimits = limits{
+			authRate:       configInt("auth_rate_limit", 20),
+			accountRate:    configInt("account_rate_limit", 10),
+			shareRate:      configInt("share_rate_limit", 120),
+			threshold:      configInt("lockout_threshold", 5),
+			lockout:        time.Duration(configInt("lockout_duration", 60)) * time.Second,
+			maxLockout:     time.Duration(configInt("lockout_max_duration", 3600)) * time.Second,
+			trustProxy:     configValue("trust_proxy", "false") == "true",
+			shareBandwidth: configSize("share_bandwidth", 0),
+			shareTotal:     configSize("share_bandwidth_total", 0),
+		}
+		if loadedLimits.shareTotal > 0 {
+			shareBucket = newByteLimiter(loadedLimits.shareTotal)
+		}
+	})
+	return loadedLimits
+}
+
+func configInt(key string, def int) int {
+	n, err := strconv.Atoi(configValue(key, strconv.Itoa(def)))
+	if err != nil {
+		fmt.Printf("warning: invalid %s, using %d\n", key, def)
+		return def
+	}
+	return n
+}
+
+// configSize reads a byte count with an optional K, M or G suffix.
+func configSize(key string, def int64) int64 {
+	s := strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(configValue(key, "")), "B"))
+	if s == "" {
+		return def
+	}
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		mult = 1 << 10
+	case 'M':
+		mult = 1 << 20
+	case 'G':
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		fmt.Printf("warning: invalid %s, using %d\n", key, def)
+		return def
+	}
+	return n * mult
+}
+
+// clientIP is the peer address, or the address the reverse proxy saw when
+// trust_proxy is set.
+func clientIP(r *http.Request) string {
+	if getLimits().trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			parts := strings.Split(fwd, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// attempts tracks one client IP or account: requests in the current window
+// for an IP, a token bucket for an account, and consecutive failures, which
+// lock it out for longer each time.
+type attempts struct {
+	windowStart time.Time
+	requests    int
+	tokens      float64
+	refilled    time.Time
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+	seen        time.Time
+}
+
+var throttle = struct {
+	sync.Mutex
+	m         map[string]*attempts
+	lastSweep time.Time
+}{m: make(map[string]*attempts)}
+
+// throttleEntry must be called with throttle held.
+func throttleEntry(key string, now time.Time) *attempts {
+	if now.Sub(throttle.lastSweep) > sweepInterval {
+		for k, a := range throttle.m {
+			if now.Sub(a.seen) > getLimits().maxLockout && now.After(a.lockedUntil) {
+				delete(throttle.m, k)
+			}
+		}
+		throttle.lastSweep = now
+	}
+	a, ok := throttle.m[key]
+	if !ok {
+		a = &attempts{}
+		throttle.m[key] = a
+	}
+	a.seen = now
+	return a
+}
+
+// Throttling keys are kept apart per kind, so that mistyped share links do
+// not lock anyone out of logging in.
+const (
+	throttleAuth  = "auth"
+	throttleShare = "share"
+)
+
+func ipKey(kind string, r *http.Request) string {
+	return kind + " ip:" + clientIP(r)
+}
+
+func accountKey(username string) string {
+	return throttleAuth + " user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+// allowRequest counts a request and checks lockouts. It returns how long
+// to wait if refused.
+func allowRequest(r *http.Request, kind string, limit int, usernames ...string) time.Duration {
+	now := time.Now()
+	throttle.Lock()
+	defer throttle.Unlock()
+	ip := throttleEntry(ipKey(kind, r), now)
+	var accounts []*attempts
+	for _, u := range usernames {
+		if u != "" {
+			accounts = append(accounts, throttleEntry(accountKey(u), now))
+		}
+	}
+	for _, a := range append([]*attempts{ip}, accounts...) {
+		if now.Before(a.lockedUntil) {
+			return a.lockedUntil.Sub(now)
+		}
+	}
+	if now.Sub(ip.windowStart) >= rateWindow {
+		ip.windowStart = now
+		ip.requests = 0
+	}
+	ip.requests++
+	if limit > 0 && ip.requests > limit {
+		return ip.windowStart.Add(rateWindow).Sub(now)
+	}
+	// Attempts on one account from many addresses get past the limit per
+	// IP, so each account has a bucket of its own as well.
+	perAccount := getLimits().accountRate
+	if perAccount <= 0 {
+		return 0
+	}
+	rate := float64(perAccount) / rateWindow.Seconds()
+	for _, a := range accounts {
+		if a.refilled.IsZero() {
+			a.tokens = float64(perAccount)
+		} else {
+			a.tokens = math.Min(float64(perAccount), a.tokens+now.Sub(a.refilled).Seconds()*rate)
+		}
+		a.refilled = now
+		if a.tokens < 1 {
+			return time.Duration((1 - a.tokens) / rate * float64(time.Second))
+		}
+	}
+	for _, a := range accounts {
+		a.tokens--
+	}
+	return 0
+}
+
+// recordFailure counts a failed attempt and locks out at
+// lockout_threshold, doubling for repeats.
+func recordFailure(r *http.Request, kind, username string) {
+	l := getLimits()
+	if l.threshold <= 0 {
+		return
+	}
+	now := time.Now()
+	ip := clientIP(r)
+	keys := []string{ipKey(kind, r)}
+	if username != "" {
+		keys = append(keys, accountKey(username))
+	}
+	throttle.Lock()
+	var locked []string
+	for _, k := range keys {
+		a := throttleEntry(k, now)
+		a.failures++
+		if a.failures < l.threshold {
+			continue
+		}
+		d := time.Duration(float64(l.lockout) * math.Pow(2, float64(a.lockouts)))
+		if d > l.maxLockout || d <= 0 {
+			d = l.maxLockout
+		}
+		a.lockedUntil = now.Add(d)
+		a.lockouts++
+		a.failures = 0
+		locked = append(locked, fmt.Sprintf("%s locked for %s", k, d))
+	}
+	throttle.Unlock()
+	for _, detail := range locked {
+		audit("lockout", username, ip, detail)
+	}
+}
+
+// recordSuccess clears the login failures of the account and the client.
+func recordSuccess(r *http.Request, username string) {
+	throttle.Lock()
+	defer throttle.Unlock()
+	for _, k := range []string{ipKey(throttleAuth, r), accountKey(username)} {
+		if a, ok := throttle.m[k]; ok {
+			a.failures = 0
+			a.lockouts = 0
+		}
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "too many requests, try again later", http.StatusTooManyRequests)
+}
+
+// throttled rejects the request with 429 and Retry-After if the client or
+// one of the accounts is over its limit.
+func throttled(w http.ResponseWriter, r *http.Request, kind string, limit int, usernames ...string) bool {
+	if wait := allowRequest(r, kind, limit, usernames...); wait > 0 {
+		tooManyRequests(w, wait)
+		return true
+	}
+	return false
+}
+
+// bcryptSlots bounds how many password hashes run at once so that a flood
+// of logins cannot take every CPU.
+var bcryptSlots = make(chan struct{}, runtime.NumCPU())
+
+// byteLimiter is a token bucket over bytes per second.
+type byteLimiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+var shareBucket *byteLimiter
+
+func newByteLimiter(perSecond int64) *byteLimiter {
+	return &byteLimiter{rate: float64(perSecond), tokens: float64(perSecond), last: time.Now()}
+}
+
+// wait blocks until n bytes may be sent.
+func (b *byteLimiter) wait(n int) {
+	b.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.Unlock()
+	time.Sleep(d)
+}
+
+// throttledWriter paces a response through the per-download and the shared
+// limiters.
+type throttledWriter struct {
+	http.ResponseWriter
+	limiters []*byteLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		for _, l := range t.limiters {
+			l.wait(len(chunk))
+		}
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// shareWriter applies share_bandwidth and share_bandwidth_total to an
+// anonymous download.
+func shareWriter(w http.ResponseWriter) http.ResponseWriter {
+	l := getLimits()
+	var limiters []*byteLimiter
+	if l.shareBandwidth > 0 {
+		limiters = append(limiters, newByteLimiter(l.shareBandwidth))
+	}
+	if shareBucket != nil {
+		limiters = append(limiters, shareBucket)
+	}
+	if len(limiters) == 0 {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, limiters: limiters}
+}
+
+// AdminAudit lists the most recent audit entries.
+func AdminAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = min(l, 1000)
+	}
+	q := db.Order("id DESC").Limit(limit)
+	if event := r.URL.Query().Get("event"); event != "" {
+		q = q.Where("event = ?", event)
+	}
+	entries := []AuditLog{}
+	if err := q.Find(&entries).Error; err != nil {
+		http.Error(w, "failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
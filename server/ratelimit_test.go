@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newThrottleTest opens a database for the audit log and applies the given
+// limits over the lenient ones of newTestDB, with no attempts counted yet.
+func newThrottleTest(t *testing.T, settings map[string]string) {
+	t.Helper()
+	newTestDB(t)
+	for k, v := range settings {
+		t.Setenv(k, v)
+	}
+	limitsOnce = sync.Once{}
+	throttle.Lock()
+	throttle.m = make(map[string]*attempts)
+	throttle.Unlock()
+}
+
+func requestFrom(ip string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	r.RemoteAddr = ip + ":4321"
+	return r
+}
+
+func TestAuthRateLimitPerIP(t *testing.T) {
+	newThrottleTest(t, map[string]string{"HANAS_AUTH_RATE_LIMIT": "3"})
+	for i := range 3 {
+		if wait := allowRequest(requestFrom("192.0.2.1"), throttleAuth, getLimits().authRate); wait != 0 {
+			t.Fatalf("request %d refused for %s", i+1, wait)
+		}
+	}
+	if wait := allowRequest(requestFrom("192.0.2.1"), throttleAuth, getLimits().authRate); wait <= 0 || wait > rateWindow {
+		t.Fatalf("request over the limit: wait %s", wait)
+	}
+	if wait := allowRequest(requestFrom("192.0.2.2"), throttleAuth, getLimits().authRate); wait != 0 {
+		t.Fatalf("another address was refused for %s", wait)
+	}
+	w := httptest.NewRecorder()
+	if !throttled(w, requestFrom("192.0.2.1"), throttleAuth, getLimits().authRate) || w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("throttled response: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestAccountRateLimit(t *testing.T) {
+	newThrottleTest(t, map[string]string{"HANAS_ACCOUNT_RATE_LIMIT": "3"})
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}
+	for _, ip := range ips[:3] {
+		if wait := allowRequest(requestFrom(ip), throttleAuth, getLimits().authRate, "Carol"); wait != 0 {
+			t.Fatalf("attempt from %s refused for %s", ip, wait)
+		}
+	}
+	wait := allowRequest(requestFrom(ips[3]), throttleAuth, getLimits().authRate, " carol")
+	if wait <= 0 || wait > rateWindow/3 {
+		t.Fatalf("fourth attempt on the account: wait %s", wait)
+	}
+	if wait := allowRequest(requestFrom(ips[3]), throttleAuth, getLimits().authRate, "dave"); wait != 0 {
+		t.Fatalf("another account was refused for %s", wait)
+	}
+	if wait := allowRequest(requestFrom(ips[3]), throttleAuth, getLimits().authRate); wait != 0 {
+		t.Fatalf("a request naming no account was refused for %s", wait)
+	}
+	// A token comes back after a third of the window.
+	throttle.Lock()
+	throttle.m[accountKey("carol")].refilled = time.Now().Add(-rateWindow / 3)
+	throttle.Unlock()
+	if wait := allowRequest(requestFrom(ips[3]), throttleAuth, getLimits().authRate, "carol"); wait != 0 {
+		t.Fatalf("attempt after the refill refused for %s", wait)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	newThrottleTest(t, map[string]string{"HANAS_LOCKOUT_THRESHOLD": "2", "HANAS_LOCKOUT_DURATION": "60"})
+	recordFailure(requestFrom("192.0.2.1"), throttleAuth, "bob")
+	if wait := allowRequest(requestFrom("192.0.2.9"), throttleAuth, 0, "bob"); wait != 0 {
+		t.Fatalf("locked out after one failure for %s", wait)
+	}
+	recordFailure(requestFrom("192.0.2.1"), throttleAuth, "bob")
+	if wait := allowRequest(requestFrom("192.0.2.9"), throttleAuth, 0, "bob"); wait <= 50*time.Second || wait > time.Minute {
+		t.Fatalf("account lockout from another address: wait %s", wait)
+	}
+	if wait := allowRequest(requestFrom("192.0.2.1"), throttleAuth, 0); wait <= 0 {
+		t.Fatal("the failing address is not locked out")
+	}
+	if wait := allowRequest(requestFrom("192.0.2.1"), throttleShare, 0); wait != 0 {
+		t.Fatalf("share links are locked out for %s", wait)
+	}
+	var lockouts int64
+	db.Model(&AuditLog{}).Where("event = ? AND username = ?", "lockout", "bob").Count(&lockouts)
+	if lockouts != 2 {
+		t.Fatalf("%d lockouts audited, want the address and the account", lockouts)
+	}
+
+	// Repeats lock out for twice as long.
+	throttle.Lock()
+	throttle.m[accountKey("bob")].lockedUntil = time.Now()
+	throttle.Unlock()
+	recordFailure(requestFrom("192.0.2.5"), throttleAuth, "bob")
+	recordFailure(requestFrom("192.0.2.6"), throttleAuth, "bob")
+	if wait := allowRequest(requestFrom("192.0.2.7"), throttleAuth, 0, "bob"); wait <= 110*time.Second || wait > 2*time.Minute {
+		t.Fatalf("second lockout: wait %s", wait)
+	}
+
+	throttle.Lock()
+	throttle.m[accountKey("bob")].lockedUntil = time.Now()
+	throttle.Unlock()
+	recordFailure(requestFrom("192.0.2.8"), throttleAuth, "bob")
+	recordSuccess(requestFrom("192.0.2.8"), "bob")
+	recordFailure(requestFrom("192.0.2.8"), throttleAuth, "bob")
+	if wait := allowRequest(requestFrom("192.0.2.8"), throttleAuth, 0, "bob"); wait != 0 {
+		t.Fatalf("a success did not reset the failures: wait %s", wait)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	// legacyKeyID verifies sessions signed with the jwt_secret config
+	// value, which predates key IDs.
+	legacyKeyID = "legacy"
+	// Keys are reread this often so that a rotation done with the command
+	// reaches a running server.
+	signingKeyReload = time.Minute
+	// An unknown kid rereads the keys at most this often.
+	signingKeyMissReload = 5 * time.Second
+
+	maxFid = 100000000
+)
+
+// SigningKey signs session tokens. The newest key signs; retired keys still
+// verify tokens until jwt_rotation_grace has passed.
+type SigningKey struct {
+	ID        string    `gorm:"primaryKey"`
+	Secret    string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+	RetiredAt *time.Time
+}
+
+var signingKeys = struct {
+	sync.Mutex
+	keys     map[string]SigningKey
+	current  SigningKey
+	loadedAt time.Time
+}{}
+
+func jwtGrace() time.Duration {
+	return time.Duration(configInt("jwt_rotation_grace", 86400)) * time.Second
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+func newSigningKey(tx *gorm.DB) (SigningKey, error) {
+	id, err := randomBytes(8)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	secret, err := randomBytes(32)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	key := SigningKey{ID: hex.EncodeToString(id), Secret: base64.StdEncoding.EncodeToString(secret)}
+	return key, tx.Create(&key).Error
+}
+
+// initJWTSecret makes sure there is a signing key; an old jwt_secret is
+// kept as a retired key.
+func initJWTSecret() error {
+	var count int64
+	db.Model(&SigningKey{}).Where("retired_at IS NULL").Count(&count)
+	if count == 0 {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var configs []Config
+			tx.Where("key = ?", "jwt_secret").Limit(1).Find(&configs)
+			if len(configs) > 0 {
+				now := time.Now()
+				if err := tx.Create(&SigningKey{ID: legacyKeyID, Secret: configs[0].Value, RetiredAt: &now}).Error; err != nil {
+					return err
+				}
+				if err := tx.Delete(&configs[0]).Error; err != nil {
+					return err
+				}
+				fmt.Println("Retired the old JWT secret")
+			}
+			_, err := newSigningKey(tx)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create jwt signing key: %w", err)
+		}
+		fmt.Println("Generated new JWT signing key")
+	}
+	return loadSigningKeys()
+}
+
+// loadSigningKeys must not be called with signingKeys held.
+func loadSigningKeys() error {
+	var rows []SigningKey
+	if err := db.Order("created_at").Find(&rows).Error; err != nil {
+		return err
+	}
+	grace := jwtGrace()
+	keys := make(map[string]SigningKey)
+	var current SigningKey
+	for _, k := range rows {
+		if k.RetiredAt == nil {
+			current = k
+		} else if time.Since(*k.RetiredAt) > grace {
+			continue
+		}
+		keys[k.ID] = k
+	}
+	if current.ID == "" {
+		return fmt.Errorf("no current jwt signing key")
+	}
+	signingKeys.Lock()
+	signingKeys.keys = keys
+	signingKeys.current = current
+	signingKeys.loadedAt = time.Now()
+	signingKeys.Unlock()
+	return nil
+}
+
+func currentSigningKey() SigningKey {
+	signingKeys.Lock()
+	stale := time.Since(signingKeys.loadedAt) > signingKeyReload
+	signingKeys.Unlock()
+	if stale {
+		if err := loadSigningKeys(); err != nil {
+			fmt.Println("warning: failed to reload jwt signing keys:", err)
+		}
+	}
+	signingKeys.Lock()
+	defer signingKeys.Unlock()
+	return signingKeys.current
+}
+
+// signingKeyFor finds the key a token names, rereading the keys if it was
+// rotated elsewhere.
+func signingKeyFor(kid string) (SigningKey, bool) {
+	signingKeys.Lock()
+	key, ok := signingKeys.keys[kid]
+	since := time.Since(signingKeys.loadedAt)
+	signingKeys.Unlock()
+	if (!ok && since > signingKeyMissReload) || since > signingKeyReload {
+		if err := loadSigningKeys(); err != nil {
+			fmt.Println("warning: failed to reload jwt signing keys:", err)
+		}
+		signingKeys.Lock()
+		key, ok = signingKeys.keys[kid]
+		signingKeys.Unlock()
+	}
+	if ok && key.RetiredAt != nil && time.Since(*key.RetiredAt) > jwtGrace() {
+		return key, false
+	}
+	return key, ok
+}
+
+// jwtKeyFunc picks the verification key from the token's kid.
+func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = legacyKeyID
+	}
+	key, ok := signingKeyFor(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return []byte(key.Secret), nil
+}
+
+// rotateSigningKey retires the current key, starts signing with a new one
+// and forgets keys whose grace period is over.
+func rotateSigningKey() (SigningKey, error) {
+	var key SigningKey
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&SigningKey{}).Where("retired_at IS NULL").Update("retired_at", now).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("retired_at < ?", now.Add(-jwtGrace())).Delete(&SigningKey{}).Error; err != nil {
+			return err
+		}
+		var err error
+		key, err = newSigningKey(tx)
+		return err
+	})
+	if err != nil {
+		return key, err
+	}
+	return key, loadSigningKeys()
+}
+
+// AdminRotateJWT handles POST /admin/jwt/rotate.
+func AdminRotateJWT(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := rotateSigningKey()
+	if err != nil {
+		http.Error(w, "failed to rotate signing key", http.StatusInternalServerError)
+		return
+	}
+	audit("jwt_key_rotated", r.Header.Get("X-Username"), clientIP(r), "kid "+key.ID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"kid": key.ID, "grace_seconds": int(jwtGrace().Seconds())})
+}
+
+// rotateJWTCommand is the offline form of /admin/jwt/rotate. A running
+// server picks the new key up within signingKeyReload.
+func rotateJWTCommand(args []string) int {
+	fs := flag.NewFlagSet("rotate-jwt-key", flag.ExitOnError)
+	fs.Parse(args)
+	if err := initJWTSecret(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	key, err := rotateSigningKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot rotate signing key:", err)
+		return 1
+	}
+	audit("jwt_key_rotated", "", "", "kid "+key.ID)
+	fmt.Printf("Now signing with key %s; sessions signed with the old key stay valid for %s\n", key.ID, jwtGrace())
+	return 0
+}
+
+// shareTokenBytes is how much randomness goes into a share token.
+func shareTokenBytes() int {
+	n := configInt("share_token_bytes", 16)
+	if n < 12 || n > 64 {
+		fmt.Println("warning: share_token_bytes must be between 12 and 64, using 16")
+		return 16
+	}
+	return n
+}
+
+func generateShareToken() string {
+	b, err := randomBytes(shareTokenBytes())
+	if err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// regenerateSharesCommand replaces short or weak share tokens, or all with
+// -all.
+func regenerateSharesCommand(args []string) int {
+	fs := flag.NewFlagSet("regenerate-share-tokens", flag.ExitOnError)
+	all := fs.Bool("all", false, "replace every share token, not only short ones")
+	fs.Parse(args)
+	minLen := base64.RawURLEncoding.EncodedLen(shareTokenBytes())
+	var shares []Share
+	if err := db.Find(&shares).Error; err != nil {
+		fmt.Fprintln(os.Stderr, "cannot read shares:", err)
+		return 1
+	}
+	replaced, failed := 0, 0
+	for _, s := range shares {
+		if !*all && len(s.Token) >= minLen && !strings.HasSuffix(s.Token, "=") {
+			continue
+		}
+		if err := db.Model(&Share{}).Where("id = ?", s.ID).Update("token", generateShareToken()).Error; err != nil {
+			fmt.Fprintf(os.Stderr, "share %d: %v\n", s.ID, err)
+			failed++
+			continue
+		}
+		replaced++
+	}
+	fmt.Printf("Replaced %d of %d share tokens\n", replaced, len(shares))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// randomFid picks a blob name that cannot be guessed from the upload time.
+func randomFid() (uint, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(maxFid))
+	if err != nil {
+		return 0, err
+	}
+	return uint(n.Int64()), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// sessionValid reports whether a request with the session cookie token is
+// authenticated.
+func sessionValid(token string) bool {
+	r := httptest.NewRequest("GET", "/me", nil)
+	r.Header.Set("Cookie", "token="+token)
+	return authenticate(r)
+}
+
+func tokenKid(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	newTestDB(t)
+	user, _ := newTestUser(t, "alice")
+	old, err := generateToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKid := tokenKid(t, old)
+	if oldKid == "" || oldKid != currentSigningKey().ID {
+		t.Fatalf("token kid %q, current key %q", oldKid, currentSigningKey().ID)
+	}
+	key, err := rotateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := generateToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenKid(t, fresh) != key.ID || key.ID == oldKid {
+		t.Fatalf("after rotation: kid %q, new key %q, old key %q", tokenKid(t, fresh), key.ID, oldKid)
+	}
+	if !sessionValid(old) || !sessionValid(fresh) {
+		t.Fatal("a session is rejected within the grace period")
+	}
+
+	// Once the grace period is over the old key is gone.
+	db.Model(&SigningKey{}).Where("id = ?", oldKid).Update("retired_at", time.Now().Add(-jwtGrace()-time.Minute))
+	if err := loadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if sessionValid(old) {
+		t.Fatal("a session signed with an expired key is accepted")
+	}
+	if !sessionValid(fresh) {
+		t.Fatal("a session signed with the current key is rejected")
+	}
+	if _, err := rotateSigningKey(); err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	db.Model(&SigningKey{}).Where("id = ?", oldKid).Count(&n)
+	if n != 0 {
+		t.Fatal("the expired key was not deleted on the next rotation")
+	}
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UserID: user.ID, Username: user.Username})
+	forged.Header["kid"] = "unknown"
+	signed, _ := forged.SignedString([]byte("guess"))
+	if sessionValid(signed) {
+		t.Fatal("a token with an unknown kid is accepted")
+	}
+}
+
+func TestLegacyJWTSecret(t *testing.T) {
+	newTestDB(t)
+	user, _ := newTestUser(t, "alice")
+	db.Where("1 = 1").Delete(&SigningKey{})
+	if err := db.Create(&Config{Key: "jwt_secret", Value: "old-secret"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := initJWTSecret(); err != nil {
+		t.Fatal(err)
+	}
+	legacy := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UserID: user.ID, Username: user.Username})
+	signed, err := legacy.SignedString([]byte("old-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sessionValid(signed) {
+		t.Fatal("a session from before key IDs is rejected within the grace period")
+	}
+	var n int64
+	db.Model(&Config{}).Where("key = ?", "jwt_secret").Count(&n)
+	if n != 0 || currentSigningKey().ID == legacyKeyID {
+		t.Fatal("the old secret is still in use")
+	}
+}
+
+func TestShareTokens(t *testing.T) {
+	newTestDB(t)
+	seen := make(map[string]bool)
+	for range 100 {
+		tok := generateShareToken()
+		b, err := base64.RawURLEncoding.DecodeString(tok)
+		if err != nil || len(b) != 16 || seen[tok] {
+			t.Fatalf("share token %q: %d bytes, %v", tok, len(b), err)
+		}
+		seen[tok] = true
+	}
+	for value, want := range map[string]int{"32": 32, "8": 16, "100": 16} {
+		t.Setenv("HANAS_SHARE_TOKEN_BYTES", value)
+		if got := shareTokenBytes(); got != want {
+			t.Errorf("share_token_bytes %s: %d, want %d", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Folder sizes are totals kept up to date by adding each change's
+// difference to the ancestors.
+
+// fileMeta reads size, storage size and MIME type of a stored file.
+func fileMeta(n *Node) {
+	n.Size, n.StoredSize = blobSizes(n.Fid)
+	n.MimeType = detectMime(n.Name, n.Fid)
+}
+
+// detectMime goes by the extension and sniffs the content when that does
+// not tell.
+func detectMime(name string, fid *uint) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	if fid == nil {
+		return ""
+	}
+	b, err := store.Open(blobKey(*fid))
+	if err != nil {
+		return ""
+	}
+	defer b.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(b, head)
+	if n == 0 {
+		return ""
+	}
+	return http.DetectContentType(head[:n])
+}
+
+// totals is what a node contributes to the folders above it.
+func totals(n Node) (size, stored, files int64) {
+	if n.IsDir {
+		return n.Size, n.StoredSize, n.FileCount
+	}
+	return n.Size, n.StoredSize, 1
+}
+
+// addToAncestors adds to the totals of every folder above the node with the
+// given ancestry. UpdateColumns keeps the folders' modification times.
+func addToAncestors(tx *gorm.DB, ancestry string, size, stored, files int64) error {
+	ids := ancestorIDs(ancestry)
+	if len(ids) == 0 || (size == 0 && stored == 0 && files == 0) {
+		return nil
+	}
+	return tx.Model(&Node{}).Where("id IN ?", ids).UpdateColumns(map[string]interface{}{
+		"size":        gorm.Expr("size + ?", size),
+		"stored_size": gorm.Expr("stored_size + ?", stored),
+		"file_count":  gorm.Expr("file_count + ?", files),
+	}).Error
+}
+
+// removeFromAncestors takes a node that is going away out of the totals.
+func removeFromAncestors(tx *gorm.DB, n Node) error {
+	size, stored, files := totals(n)
+	return addToAncestors(tx, n.Ancestry, -size, -stored, -files)
+}
+
+// recalcSizes recomputes every size from the store and reports how many
+// nodes were off. Folders are summed from their files in memory.
+func recalcSizes(stat bool) (int, error) {
+	var nodes []Node
+	if err := db.Select("id", "fid", "name", "is_dir", "ancestry", "size", "stored_size", "file_count", "mime_type").Find(&nodes).Error; err != nil {
+		return 0, err
+	}
+	type sums struct{ size, stored, files int64 }
+	folders := make(map[uint]*sums)
+	for _, n := range nodes {
+		if n.IsDir {
+			folders[n.ID] = &sums{}
+		}
+	}
+	fixed := 0
+	for i := range nodes {
+		n := &nodes[i]
+		if n.IsDir {
+			continue
+		}
+		if stat {
+			m := *n
+			m.Size, m.StoredSize = blobSizes(n.Fid)
+			if m.MimeType == "" {
+				m.MimeType = detectMime(n.Name, n.Fid)
+			}
+			if m.Size != n.Size || m.StoredSize != n.StoredSize || m.MimeType != n.MimeType {
+				err := db.Model(&Node{}).Where("id = ?", n.ID).UpdateColumns(map[string]interface{}{
+					"size": m.Size, "stored_size": m.StoredSize, "mime_type": m.MimeType,
+				}).Error
+				if err != nil {
+					return fixed, err
+				}
+				*n = m
+				fixed++
+			}
+		}
+		for _, id := range ancestorIDs(n.Ancestry) {
+			if s, ok := folders[id]; ok {
+				s.size += n.Size
+				s.stored += n.StoredSize
+				s.files++
+			}
+		}
+	}
+	for _, n := range nodes {
+		s, ok := folders[n.ID]
+		if !ok || (s.size == n.Size && s.stored == n.StoredSize && s.files == n.FileCount) {
+			continue
+		}
+		err := db.Model(&Node{}).Where("id = ?", n.ID).UpdateColumns(map[string]interface{}{
+			"size": s.size, "stored_size": s.stored, "file_count": s.files,
+		}).Error
+		if err != nil {
+			return fixed, err
+		}
+		fixed++
+	}
+	return fixed, nil
+}
+
+// migrateSizes fills in the sizes once for databases from before they were
+// stored.
+func migrateSizes() {
+	if configValue("node_sizes", "") == "stored" {
+		return
+	}
+	fmt.Println("Computing stored file sizes...")
+	fixed, err := recalcSizes(true)
+	if err != nil {
+		fmt.Println("warning: failed to compute file sizes:", err)
+		return
+	}
+	fmt.Printf("Computed the size of %d nodes\n", fixed)
+	db.Where("key = ?", "node_sizes").Delete(&Config{})
+	db.Create(&Config{Key: "node_sizes", Value: "stored"})
+}
+
+// recalcSizesCommand repairs sizes that drifted, e.g. after migrate-storage
+// or rotate-key changed how much space files take up.
+func recalcSizesCommand(args []string) int {
+	fs := flag.NewFlagSet("recalc-sizes", flag.ExitOnError)
+	foldersOnly := fs.Bool("folders-only", false, "only re-add folder totals from the stored file sizes, without reading the store")
+	fs.Parse(args)
+	fixed, err := recalcSizes(!*foldersOnly)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "recalc failed:", err)
+		return 1
+	}
+	fmt.Printf("Corrected %d nodes\n", fixed)
+	return 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// checkTotals fails unless the folder holds size bytes in files files.
+func checkTotals(t *testing.T, step string, folder uint, size, files int64) {
+	t.Helper()
+	n := nodeByID(t, folder)
+	if n.Size != size || n.FileCount != files {
+		t.Fatalf("%s: %s has %d bytes in %d files, want %d in %d", step, n.Name, n.Size, n.FileCount, size, files)
+	}
+}
+
+func TestFolderTotals(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	a := newFolder(t, "a", root.ID, user.ID)
+	b := newFolder(t, "b", a, user.ID)
+	f := uploadTestFile(t, "f.txt", "12345", b, user.ID)
+	uploadTestFile(t, "g.txt", "123", a, user.ID)
+	checkTotals(t, "upload", b, 5, 1)
+	checkTotals(t, "upload", a, 8, 2)
+	checkTotals(t, "upload", root.ID, 8, 2)
+
+	file := nodeByID(t, f)
+	if err := replaceContent(&file, strings.NewReader("1234567890"), ""); err != nil {
+		t.Fatal(err)
+	}
+	checkTotals(t, "overwrite", b, 10, 1)
+	checkTotals(t, "overwrite", root.ID, 13, 2)
+
+	c, err := copyNodeTo(nodeByID(t, b), root.ID, user.ID, conflictRename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTotals(t, "copy", c, 10, 1)
+	checkTotals(t, "copy", a, 13, 2)
+	checkTotals(t, "copy", root.ID, 23, 3)
+
+	if _, err := moveNodeAs(nodeByID(t, b), c, "b", user.ID, conflictFail); err != nil {
+		t.Fatal(err)
+	}
+	checkTotals(t, "move", a, 3, 1)
+	checkTotals(t, "move", c, 20, 2)
+	checkTotals(t, "move", root.ID, 23, 3)
+
+	if err := DeleteNodeRecursive(b, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	checkTotals(t, "delete", c, 10, 1)
+	checkTotals(t, "delete", root.ID, 13, 2)
+
+	if fixed, err := recalcSizes(false); err != nil || fixed != 0 {
+		t.Fatalf("recalculating fixed %d nodes: %v", fixed, err)
+	}
+	db.Model(&Node{}).Where("id IN ?", []uint{a, root.ID}).UpdateColumns(map[string]interface{}{"size": 99, "file_count": 7})
+	if fixed, err := recalcSizes(false); err != nil || fixed != 2 {
+		t.Fatalf("recalculating drifted totals fixed %d nodes: %v", fixed, err)
+	}
+	checkTotals(t, "recalculate", a, 3, 1)
+	checkTotals(t, "recalculate", root.ID, 13, 2)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BlobInfo struct {
+	Key  string
+	Size int64
+	// Stored is what the blob takes up in the backend, which differs from
+	// Size when it is compressed or encrypted.
+	Stored  int64
+	ModTime time.Time
+}
+
+// Blob is an open stored object. Seek followed by Read fetches only the
+// requested range, which is what http.ServeContent relies on.
+type Blob interface {
+	io.ReadSeekCloser
+	Info() BlobInfo
+}
+
+// BlobStore is where file contents live. Keys are node fids in decimal.
+// Missing keys are reported with errors matching fs.ErrNotExist.
+type BlobStore interface {
+	// Put stores r under key, replacing any previous content atomically.
+	Put(key string, r io.Reader) (int64, error)
+	Open(key string) (Blob, error)
+	Stat(key string) (BlobInfo, error)
+	Delete(key string) error
+	List(fn func(BlobInfo) error) error
+}
+
+var store BlobStore
+
+// backend is the store below compression and encryption, holding blobs as
+// they are stored.
+var backend BlobStore
+
+// localPather is implemented by stores that can hand out a filesystem path
+// holding the blob's content as is.
+type localPather interface {
+	localPath(key string) (string, bool)
+}
+
+// blobCopier copies a blob inside the store; errCopyUnsupported means
+// stream it instead.
+type blobCopier interface {
+	Copy(src, dst string) (int64, error)
+}
+
+var errCopyUnsupported = errors.New("blob cannot be copied in place")
+
+func blobKey(fid uint) string {
+	return strconv.FormatUint(uint64(fid), 10)
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+type localStore struct {
+	dir string
+}
+
+type localBlob struct {
+	*os.File
+	info BlobInfo
+}
+
+func (b localBlob) Info() BlobInfo { return b.info }
+
+func (s localStore) path(key string) string {
+	return filepath.Join(s.dir, key)
+}
+
+func (s localStore) localPath(key string) (string, bool) {
+	return s.path(key), true
+}
+
+func (s localStore) Put(key string, r io.Reader) (int64, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return 0, fmt.Errorf("cannot create data dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(s.dir, key+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+// Copy clones the file where the filesystem supports it and otherwise lets
+// the kernel copy it; see cloneFile.
+func (s localStore) Copy(src, dst string) (int64, error) {
+	in, err := os.Open(s.path(src))
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(s.dir, dst+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	n, err := cloneFile(tmp, in)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(dst))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s localStore) Open(key string) (Blob, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return localBlob{File: f, info: BlobInfo{Key: key, Size: st.Size(), Stored: st.Size(), ModTime: st.ModTime()}}, nil
+}
+
+func (s localStore) Stat(key string) (BlobInfo, error) {
+	st, err := os.Stat(s.path(key))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: st.Size(), Stored: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (s localStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s localStore) List(fn func(BlobInfo) error) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		info := BlobInfo{Key: e.Name()}
+		if fi, err := e.Info(); err == nil {
+			info.Size = fi.Size()
+			info.Stored = fi.Size()
+			info.ModTime = fi.ModTime()
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localFile returns a filesystem path for the blob, copying it to a
+// temporary file when the store is not local. Tools like ffmpeg need one.
+func localFile(key string) (string, func(), error) {
+	if lp, ok := store.(localPather); ok {
+		if p, ok := lp.localPath(key); ok {
+			return p, func() {}, nil
+		}
+	}
+	b, err := store.Open(key)
+	if err != nil {
+		return "", nil, err
+	}
+	defer b.Close()
+	tmp, err := os.CreateTemp("", "hanas-blob-*")
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = io.Copy(tmp, b)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+}
+
+// copyBlob copies the content of a blob to a new one. The store copies in
+// place when it can; otherwise the content is streamed through. No lock is
+// needed: overwrites write a new blob, and the source is only removed once
+// no node refers to it.
+func copyBlob(fid uint, hash string) (uint, string, error) {
+	if c, ok := store.(blobCopier); ok && hash != "" {
+		newFid, release, err := reserveFid()
+		if err != nil {
+			return 0, "", err
+		}
+		_, err = c.Copy(blobKey(fid), blobKey(newFid))
+		release()
+		if err == nil {
+			return newFid, hash, nil
+		}
+		if !errors.Is(err, errCopyUnsupported) {
+			return 0, "", fmt.Errorf("cannot copy file: %w", err)
+		}
+	}
+	b, err := store.Open(blobKey(fid))
+	if err != nil {
+		return 0, "", err
+	}
+	defer b.Close()
+	return UploadFile(b)
+}
+
+func newStore(kind string) (BlobStore, error) {
+	switch kind {
+	case "", "local":
+		return localStore{dir: configValue("storage_dir", dataDir)}, nil
+	case "s3":
+		return newS3Store()
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", kind)
+}
+
+// wrapStore layers compression and encryption over a backend. Compression
+// comes first because encrypted bytes do not compress.
+func wrapStore(s BlobStore) (BlobStore, error) {
+	es, err := newEncStore(s)
+	if err != nil {
+		return nil, err
+	}
+	return newCompStore(es)
+}
+
+func openStore() {
+	s, err := newStore(configValue("storage", "local"))
+	if err != nil {
+		panic(err)
+	}
+	backend = s
+	if store, err = wrapStore(s); err != nil {
+		panic(err)
+	}
+}
+
+func migrateBlob(from, to BlobStore, key string) (int64, error) {
+	b, err := from.Open(key)
+	if err != nil {
+		return 0, err
+	}
+	defer b.Close()
+	h := sha256.New()
+	n, err := to.Put(key, io.TeeReader(b, h))
+	if err != nil {
+		return n, err
+	}
+	// Read the copy back so a flaky target is caught before the source
+	// is deleted.
+	c, err := to.Open(key)
+	if err != nil {
+		return n, err
+	}
+	defer c.Close()
+	h2 := sha256.New()
+	if _, err := io.Copy(h2, c); err != nil {
+		return n, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hex.EncodeToString(h2.Sum(nil)) {
+		return n, fmt.Errorf("verification failed")
+	}
+	return n, nil
+}
+
+func migrateStorageCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	fromKind := fs.String("from", configValue("storage", "local"), "backend to copy from (local or s3)")
+	toKind := fs.String("to", "", "backend to copy to (local or s3)")
+	del := fs.Bool("delete", false, "delete each blob from the source after it was copied and verified")
+	fs.Parse(args)
+	if *toKind == "" || *toKind == *fromKind {
+		fmt.Fprintln(os.Stderr, "usage: hanas migrate-storage [-from local] -to s3 [-delete]")
+		return 1
+	}
+	from, err := newStore(*fromKind)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	to, err := newStore(*toKind)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var nodes []Node
+	if err := db.Select("fid").Where("fid IS NOT NULL").Find(&nodes).Error; err != nil {
+		fmt.Fprintln(os.Stderr, "cannot read nodes:", err)
+		return 1
+	}
+	var copied, failed int
+	var bytes int64
+	for _, n := range nodes {
+		key := blobKey(*n.Fid)
+		lock := fileLock(*n.Fid)
+		lock.RLock()
+		size, err := migrateBlob(from, to, key)
+		if err == nil && *del {
+			err = from.Delete(key)
+		}
+		lock.RUnlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "blob %s: %v\n", key, err)
+			failed++
+			continue
+		}
+		copied++
+		bytes += size
+	}
+	fmt.Printf("Migrated %d blobs (%d bytes) from %s to %s, %d failed\n", copied, bytes, *fromKind, *toKind, failed)
+	if failed > 0 {
+		return 2
+	}
+	if !strings.EqualFold(configValue("storage", "local"), *toKind) {
+		fmt.Printf("Set HANAS_STORAGE=%s (or the storage config key) to serve from the new backend\n", *toKind)
+	}
+	return 0
+}
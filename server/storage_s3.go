@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize bounds multipart buffers for puts of unknown size; it allows
+// objects up to 156 GiB.
+const s3PartSize = 16 << 20
+
+// s3Store keeps blobs in an S3-compatible bucket (AWS S3, MinIO, ...).
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+type s3Blob struct {
+	*minio.Object
+	info BlobInfo
+}
+
+func (b s3Blob) Info() BlobInfo { return b.info }
+
+func newS3Store() (*s3Store, error) {
+	endpoint := configValue("s3_endpoint", "")
+	bucket := configValue("s3_bucket", "")
+	if endpoint == "" || bucket == "" {
+		return nil, fmt.Errorf("s3 storage needs s3_endpoint and s3_bucket")
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(configValue("s3_access_key", ""), configValue("s3_secret_key", ""), ""),
+		Secure: configValue("s3_secure", "true") == "true",
+		Region: configValue("s3_region", ""),
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Store{client: client, bucket: bucket, prefix: strings.Trim(configValue("s3_prefix", ""), "/")}
+	ok, err := client.BucketExists(context.Background(), bucket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach s3 bucket %s: %w", bucket, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("s3 bucket %s does not exist", bucket)
+	}
+	return s, nil
+}
+
+func (s *s3Store) object(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return path.Join(s.prefix, key)
+}
+
+func (s *s3Store) wrap(key string, err error) error {
+	if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+		return &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+func (s *s3Store) Put(key string, r io.Reader) (int64, error) {
+	info, err := s.client.PutObject(context.Background(), s.bucket, s.object(key), r, -1, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    s3PartSize,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *s3Store) Open(key string) (Blob, error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.object(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.wrap(key, err)
+	}
+	return s3Blob{Object: obj, info: info}, nil
+}
+
+func (s *s3Store) Stat(key string) (BlobInfo, error) {
+	st, err := s.client.StatObject(context.Background(), s.bucket, s.object(key), minio.StatObjectOptions{})
+	if err != nil {
+		return BlobInfo{}, s.wrap(key, err)
+	}
+	return BlobInfo{Key: key, Size: st.Size, Stored: st.Size, ModTime: st.LastModified}, nil
+}
+
+// Copy has the bucket copy the object. ComposeObject splits objects over
+// the 5 GB limit of a single server-side copy into parts.
+func (s *s3Store) Copy(src, dst string) (int64, error) {
+	info, err := s.client.ComposeObject(context.Background(),
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.object(dst)},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.object(src)})
+	if err != nil {
+		return 0, s.wrap(src, err)
+	}
+	return info.Size, nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.object(key), minio.RemoveObjectOptions{})
+}
+
+func (s *s3Store) List(fn func(BlobInfo) error) error {
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if err := fn(BlobInfo{Key: strings.TrimPrefix(obj.Key, prefix), Size: obj.Size, Stored: obj.Size, ModTime: obj.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
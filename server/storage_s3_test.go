@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"testing"
+)
+
+// testS3Store uses the bucket given by HANAS_TEST_S3_ENDPOINT, _BUCKET,
+// _ACCESS_KEY, _SECRET_KEY and _SECURE, e.g. a throwaway MinIO.
+func testS3Store(t *testing.T) *s3Store {
+	t.Helper()
+	endpoint := os.Getenv("HANAS_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("HANAS_TEST_S3_ENDPOINT is not set")
+	}
+	t.Setenv("HANAS_S3_ENDPOINT", endpoint)
+	for _, key := range []string{"BUCKET", "ACCESS_KEY", "SECRET_KEY", "SECURE", "REGION"} {
+		t.Setenv("HANAS_S3_"+key, os.Getenv("HANAS_TEST_S3_"+key))
+	}
+	if os.Getenv("HANAS_TEST_S3_SECURE") == "" {
+		t.Setenv("HANAS_S3_SECURE", "true")
+	}
+	t.Setenv("HANAS_S3_PREFIX", "hanas-test-"+randomHex(t, 8))
+	s, err := newS3Store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.List(func(info BlobInfo) error { return s.Delete(info.Key) })
+	})
+	return s
+}
+
+func randomHex(t *testing.T, n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func TestS3RoundTrip(t *testing.T) {
+	s := testS3Store(t)
+	// Larger than a part, so the put is a multipart upload.
+	content := make([]byte, s3PartSize+1000)
+	rand.Read(content)
+	n, err := s.Put("1", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(content)) {
+		t.Fatalf("Put wrote %d bytes, want %d", n, len(content))
+	}
+	info, err := s.Stat("1")
+	if err != nil || info.Size != int64(len(content)) {
+		t.Fatalf("Stat = %+v, %v", info, err)
+	}
+
+	b, err := s.Open("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Seek(s3PartSize-10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 20)
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if !bytes.Equal(got, content[s3PartSize-10:s3PartSize+10]) {
+		t.Fatal("ranged read across the part boundary returned wrong bytes")
+	}
+
+	if _, err := s.Copy("1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]bool{}
+	if err := s.List(func(info BlobInfo) error { keys[info.Key] = true; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !keys["1"] || !keys["2"] {
+		t.Fatalf("List = %v, want 1 and 2", keys)
+	}
+
+	if err := s.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open("1"); !isNotExist(err) {
+		t.Fatalf("Open after Delete: %v, want not exist", err)
+	}
+}
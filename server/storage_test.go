@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readBlob(t *testing.T, fid uint) string {
+	t.Helper()
+	b, err := store.Open(blobKey(fid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	content, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestCloneFileFallback(t *testing.T) {
+	// Temporary directories are rarely on a filesystem with reflinks, so
+	// this mostly covers the copy it falls back to.
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789"), 100000)
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := cloneFile(out, in)
+	out.Close()
+	if err != nil || n != int64(len(content)) {
+		t.Fatalf("cloned %d bytes: %v", n, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "dst")); !bytes.Equal(got, content) {
+		t.Fatal("the clone differs from the source")
+	}
+}
+
+func TestCopyBlob(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	src := nodeByID(t, uploadTestFile(t, "a.txt", "content", root.ID, user.ID))
+	fid, hash, err := copyBlob(*src.Fid, src.Hash)
+	if err != nil || fid == *src.Fid || hash != src.Hash {
+		t.Fatalf("copy in place: fid %d, hash %q: %v", fid, hash, err)
+	}
+	if got := readBlob(t, fid); got != "content" {
+		t.Fatalf("the copy holds %q", got)
+	}
+	// Without a hash to carry over the content is streamed and hashed.
+	fid, hash, err = copyBlob(*src.Fid, "")
+	if err != nil || hash != src.Hash || readBlob(t, fid) != "content" {
+		t.Fatalf("streamed copy: hash %q: %v", hash, err)
+	}
+	entries, _ := os.ReadDir(dataDir)
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == ".tmp" {
+			t.Fatalf("%s was left behind", e.Name())
+		}
+	}
+}
+
+func TestCopyEncryptedBlob(t *testing.T) {
+	s := newTestEncStore(t)
+	user, root := newTestUser(t, "alice")
+	src := nodeByID(t, uploadTestFile(t, "a.txt", "secret", root.ID, user.ID))
+	fid, hash, err := copyBlob(*src.Fid, src.Hash)
+	if err != nil || hash != src.Hash {
+		t.Fatalf("copy: hash %q: %v", hash, err)
+	}
+	if !s.encrypted(blobKey(fid)) || readBlob(t, fid) != "secret" {
+		t.Fatal("the copy is not encrypted or does not decrypt")
+	}
+	var keys []DataKey
+	db.Where("blob_key IN ?", []string{blobKey(*src.Fid), blobKey(fid)}).Find(&keys)
+	if len(keys) != 2 || keys[0].ID == keys[1].ID {
+		t.Fatalf("the copy does not have a key of its own: %+v", keys)
+	}
+}
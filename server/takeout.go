@@ -0,0 +1,447 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exportDir       = "./exports"
+	takeoutVersion  = 1
+	takeoutManifest = "manifest.json"
+	takeoutFiles    = "files/"
+)
+
+type TakeoutEntry struct {
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"is_dir"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Size      int64     `json:"size,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	Shared    bool      `json:"shared,omitempty"`
+}
+
+type TakeoutManifest struct {
+	Version    int            `json:"version"`
+	Username   string         `json:"username"`
+	ExportedAt time.Time      `json:"exported_at"`
+	Root       string         `json:"root"`
+	Entries    []TakeoutEntry `json:"entries"`
+}
+
+func exportTree(zw *zip.Writer, m *TakeoutManifest, shared map[uint]bool, dir Node, rel string, j *Job) error {
+	var children []Node
+	if err := db.Where("oya_id = ? AND user_id = ?", dir.ID, dir.UserID).Order("name").Find(&children).Error; err != nil {
+		return err
+	}
+	for _, c := range children {
+		if err := j.stopped(); err != nil {
+			return err
+		}
+		p := path.Join(rel, c.Name)
+		e := TakeoutEntry{Path: p, IsDir: c.IsDir, UpdatedAt: c.UpdatedAt, Shared: shared[c.ID]}
+		hdr := &zip.FileHeader{Name: takeoutFiles + p, Modified: c.UpdatedAt}
+		if c.IsDir {
+			hdr.Name += "/"
+			if _, err := zw.CreateHeader(hdr); err != nil {
+				return err
+			}
+			m.Entries = append(m.Entries, e)
+			if err := exportTree(zw, m, shared, c, p, j); err != nil {
+				return err
+			}
+			continue
+		}
+		hdr.Method = zip.Deflate
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		size, err := exportBlob(fw, *c.Fid)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		e.Size = size
+		e.Hash = nodeHash(c)
+		m.Entries = append(m.Entries, e)
+		j.set("files", len(m.Entries))
+	}
+	return nil
+}
+
+func exportBlob(w io.Writer, fid uint) (int64, error) {
+	lock := fileLock(fid)
+	lock.RLock()
+	defer lock.RUnlock()
+	b, err := store.Open(blobKey(fid))
+	if err != nil {
+		return 0, err
+	}
+	defer b.Close()
+	return io.Copy(w, b)
+}
+
+func runExport(j *Job, userID uint, root Node) error {
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		return err
+	}
+	var shares []Share
+	db.Where("user_id = ?", userID).Find(&shares)
+	shared := make(map[uint]bool, len(shares))
+	for _, s := range shares {
+		shared[s.NodeID] = true
+	}
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return err
+	}
+	archive := filepath.Join(exportDir, j.ID+".zip")
+	j.setFile(archive)
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	m := TakeoutManifest{
+		Version:    takeoutVersion,
+		Username:   user.Username,
+		ExportedAt: time.Now(),
+		Root:       nodePath(root),
+		Entries:    []TakeoutEntry{},
+	}
+	if err := exportTree(zw, &m, shared, root, "", j); err != nil {
+		return err
+	}
+	mw, err := zw.Create(takeoutManifest)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	j.set("entries", len(m.Entries))
+	return nil
+}
+
+// cleanTakeoutPath rejects archive paths that would escape the import folder.
+func cleanTakeoutPath(p string) (string, bool) {
+	if p == "" || strings.HasPrefix(p, "/") || strings.Contains(p, "\\") {
+		return "", false
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", false
+		}
+	}
+	return p, true
+}
+
+// cleanTakeoutNames checks each name of an archive path like any other new
+// name and returns the path with the names normalized.
+func cleanTakeoutNames(p string) (string, error) {
+	names := strings.Split(p, "/")
+	for i, name := range names {
+		var err error
+		if names[i], err = cleanName(name); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(names, "/"), nil
+}
+
+// runImport recreates an archive below target. Existing folders are merged
+// into; for other entries of the same name the conflict policy decides.
+func runImport(j *Job, userID uint, target uint, archive string, policy string) error {
+	defer os.Remove(archive)
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return fmt.Errorf("not a takeout archive: %w", err)
+	}
+	defer zr.Close()
+	// archive/zip fails reads past an entry's declared size, so the
+	// declared sizes bound what the import writes.
+	maxEntries, maxSize := configInt("import_max_entries", 100000), configSize("import_max_size", 10<<30)
+	if len(zr.File) > maxEntries {
+		return fmt.Errorf("archive has %d entries, more than the %d allowed", len(zr.File), maxEntries)
+	}
+	var total uint64
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+		total += f.UncompressedSize64
+	}
+	if total > uint64(maxSize) {
+		return fmt.Errorf("archive extracts to %d bytes, more than the %d allowed", total, maxSize)
+	}
+	mf, ok := files[takeoutManifest]
+	if !ok {
+		return fmt.Errorf("archive has no %s", takeoutManifest)
+	}
+	var m TakeoutManifest
+	rc, err := mf.Open()
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(rc).Decode(&m)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.Version != takeoutVersion {
+		return fmt.Errorf("unsupported takeout version %d", m.Version)
+	}
+	// Sorting by path puts every folder before its contents.
+	sort.Slice(m.Entries, func(a, b int) bool { return m.Entries[a].Path < m.Entries[b].Path })
+	folders := map[string]uint{"": target}
+	var failed []string
+	nFolders, nFiles, nShares, nSkipped := 0, 0, 0, 0
+	for _, e := range m.Entries {
+		if err := j.stopped(); err != nil {
+			return err
+		}
+		p, ok := cleanTakeoutPath(e.Path)
+		if !ok {
+			failed = append(failed, e.Path+": invalid path")
+			continue
+		}
+		clean, err := cleanTakeoutNames(p)
+		if err != nil {
+			failed = append(failed, p+": "+err.Error())
+			continue
+		}
+		dir, name := path.Split(clean)
+		parentID, ok := folders[strings.TrimSuffix(dir, "/")]
+		if !ok {
+			failed = append(failed, p+": parent folder was not imported")
+			continue
+		}
+		var nodeID uint
+		if e.IsDir {
+			if existing, ok := findChildByName(parentID, name, userID); ok && existing.IsDir {
+				nodeID = existing.ID
+			} else {
+				nodeID, err = UploadNode(name, nil, true, &parentID, userID, policy)
+			}
+			if errors.Is(err, errSkipped) {
+				nSkipped++
+				continue
+			}
+			if err != nil {
+				failed = append(failed, p+": "+err.Error())
+				continue
+			}
+			folders[clean] = nodeID
+			nFolders++
+		} else {
+			zf, ok := files[takeoutFiles+p]
+			if !ok {
+				failed = append(failed, p+": missing from archive")
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				failed = append(failed, p+": "+err.Error())
+				continue
+			}
+			nodeID, err = UploadNode(name, rc, false, &parentID, userID, policy)
+			rc.Close()
+			if errors.Is(err, errSkipped) {
+				nSkipped++
+				continue
+			}
+			if err != nil {
+				failed = append(failed, p+": "+err.Error())
+				continue
+			}
+			var n Node
+			if db.First(&n, nodeID).Error == nil && e.Hash != "" && n.Hash != e.Hash {
+				failed = append(failed, p+": checksum mismatch")
+			}
+			nFiles++
+		}
+		db.Model(&Node{}).Where("id = ?", nodeID).UpdateColumn("updated_at", e.UpdatedAt)
+		if e.Shared {
+			var existing Share
+			if db.First(&existing, "node_id = ? AND user_id = ?", nodeID, userID).Error != nil {
+				if db.Create(&Share{Token: generateShareToken(), NodeID: nodeID, UserID: userID}).Error == nil {
+					nShares++
+				}
+			}
+		}
+		j.set("imported", nFolders+nFiles)
+	}
+	j.set("folders", nFolders)
+	j.set("files", nFiles)
+	j.set("shares", nShares)
+	j.set("skipped", nSkipped)
+	if len(failed) > 0 {
+		j.set("errors", failed)
+	}
+	return nil
+}
+
+func writeJob(w http.ResponseWriter, code int, j *Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(j.status())
+}
+
+// Export handles POST /export to start an export and GET /export/<id> and
+// /export/<id>/download to follow it.
+func Export(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/export"), "/")
+	if rest == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			NodeID uint `json:"node_id"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+		}
+		var root Node
+		if req.NodeID == 0 {
+			root = rootFor(r, userID)
+		} else if err := db.First(&root, "id = ? AND user_id = ?", req.NodeID, userID).Error; err != nil || !root.IsDir {
+			http.Error(w, "folder not found", http.StatusNotFound)
+			return
+		}
+		if denyOutsideFolder(w, r, root) {
+			return
+		}
+		j, err := startJob(userID, "export", func(j *Job) error { return runExport(j, userID, root) })
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		writeJob(w, http.StatusAccepted, j)
+		return
+	}
+	id, download := strings.CutSuffix(rest, "/download")
+	j, ok := getJob(userID, id)
+	if !ok || j.status().Kind != "export" {
+		http.Error(w, "export not found", http.StatusNotFound)
+		return
+	}
+	if !download {
+		writeJob(w, http.StatusOK, j)
+		return
+	}
+	st := j.status()
+	if st.Status != jobDone {
+		http.Error(w, "export is not ready", http.StatusConflict)
+		return
+	}
+	f, err := os.Open(j.file())
+	if err != nil {
+		http.Error(w, "export archive not found", http.StatusGone)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"hanas-export-%s.zip\"", st.CreatedAt.UTC().Format("20060102")))
+	http.ServeContent(w, r, "export.zip", *st.FinishedAt, f)
+}
+
+// Import handles POST /import with a takeout archive and GET /import/<id>.
+func Import(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/import"), "/"); id != "" {
+		j, ok := getJob(userID, id)
+		if !ok || j.status().Kind != "import" {
+			http.Error(w, "import not found", http.StatusNotFound)
+			return
+		}
+		writeJob(w, http.StatusOK, j)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseMultipartForm(1024 << 20); err != nil {
+		http.Error(w, "failed to parse multipart form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "missing file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	var target Node
+	if oyaStr := r.FormValue("oya_id"); oyaStr == "" {
+		target = rootFor(r, userID)
+	} else if id, _ := strconv.Atoi(oyaStr); db.First(&target, "id = ? AND user_id = ?", id, userID).Error != nil || !target.IsDir {
+		http.Error(w, "parent folder not found", http.StatusNotFound)
+		return
+	}
+	if denyOutsideFolder(w, r, target) {
+		return
+	}
+	conflict := r.FormValue("conflict")
+	if conflict == "" {
+		conflict = conflictRename
+	}
+	policy, err := conflictPolicy(conflict, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The multipart temp file goes away with the request, so keep a copy
+	// for the job.
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		http.Error(w, "failed to store archive", http.StatusInternalServerError)
+		return
+	}
+	tmp, err := os.CreateTemp(exportDir, "import-*.zip")
+	if err != nil {
+		http.Error(w, "failed to store archive", http.StatusInternalServerError)
+		return
+	}
+	_, err = io.Copy(tmp, file)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		http.Error(w, "failed to store archive", http.StatusInternalServerError)
+		return
+	}
+	j, err := startJob(userID, "import", func(j *Job) error { return runImport(j, userID, target.ID, tmp.Name(), policy) })
+	if err != nil {
+		os.Remove(tmp.Name())
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJob(w, http.StatusAccepted, j)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTakeout writes an archive with the given files and folders, each
+// listed in the manifest as well as any extra entries.
+func newTakeout(t *testing.T, files map[string]string, folders []string, extra ...TakeoutEntry) string {
+	t.Helper()
+	archive := filepath.Join(t.TempDir(), "takeout.zip")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	m := TakeoutManifest{Version: takeoutVersion, Username: "alice", ExportedAt: time.Now()}
+	for _, p := range folders {
+		m.Entries = append(m.Entries, TakeoutEntry{Path: p, IsDir: true})
+	}
+	for p, content := range files {
+		w, err := zw.Create(takeoutFiles + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+		m.Entries = append(m.Entries, TakeoutEntry{Path: p, Size: int64(len(content)), Hash: sha256Hex(content)})
+	}
+	m.Entries = append(m.Entries, extra...)
+	w, err := zw.Create(takeoutManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func importTakeout(t *testing.T, userID, target uint, archive, policy string) JobStatus {
+	t.Helper()
+	j, err := startJob(userID, "import", func(j *Job) error { return runImport(j, userID, target, archive, policy) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return waitJob(t, j)
+}
+
+// treeOf lists the paths below folder with the content of each file.
+func treeOf(t *testing.T, folder uint) []string {
+	t.Helper()
+	var walk func(id uint, prefix string) []string
+	walk = func(id uint, prefix string) []string {
+		var kids []Node
+		db.Where("oya_id = ?", id).Find(&kids)
+		var out []string
+		for _, k := range kids {
+			if k.IsDir {
+				out = append(out, prefix+k.Name+"/")
+				out = append(out, walk(k.ID, prefix+k.Name+"/")...)
+			} else {
+				out = append(out, prefix+k.Name+"="+readBlob(t, *k.Fid))
+			}
+		}
+		return out
+	}
+	out := walk(folder, "")
+	sort.Strings(out)
+	return out
+}
+
+func TestTakeoutRoundTrip(t *testing.T) {
+	newTestDB(t)
+	alice, aliceRoot := newTestUser(t, "alice")
+	docs := newFolder(t, "docs", aliceRoot.ID, alice.ID)
+	uploadTestFile(t, "a.txt", "aaa", docs, alice.ID)
+	shared := uploadTestFile(t, "b.txt", "bb", aliceRoot.ID, alice.ID)
+	newFolder(t, "empty", aliceRoot.ID, alice.ID)
+	if err := db.Create(&Share{Token: generateShareToken(), NodeID: shared, UserID: alice.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	j, err := startJob(alice.ID, "export", func(j *Job) error { return runExport(j, alice.ID, aliceRoot) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := waitJob(t, j); st.Status != jobDone || st.Result["entries"] != 4 {
+		t.Fatalf("export: %+v", st)
+	}
+	archive := filepath.Join(t.TempDir(), "export.zip")
+	if err := os.Rename(j.file(), archive); err != nil {
+		t.Fatal(err)
+	}
+
+	bob, bobRoot := newTestUser(t, "bob")
+	st := importTakeout(t, bob.ID, bobRoot.ID, archive, conflictRename)
+	if st.Status != jobDone || st.Result["folders"] != 2 || st.Result["files"] != 2 || st.Result["shares"] != 1 || st.Result["errors"] != nil {
+		t.Fatalf("import: %+v", st)
+	}
+	want := []string{"b.txt=bb", "docs/", "docs/a.txt=aaa", "empty/"}
+	if got := treeOf(t, bobRoot.ID); !slices.Equal(got, want) {
+		t.Fatalf("imported %q, want %q", got, want)
+	}
+	var shares int64
+	db.Model(&Share{}).Where("user_id = ?", bob.ID).Count(&shares)
+	if shares != 1 {
+		t.Fatalf("bob has %d shares", shares)
+	}
+}
+
+func TestTakeoutImportConflicts(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	docs := newFolder(t, "docs", root.ID, user.ID)
+	uploadTestFile(t, "a.txt", "old", docs, user.ID)
+	files := map[string]string{"docs/a.txt": "new", "docs/b.txt": "b"}
+	for _, tc := range []struct {
+		policy string
+		want   []string
+	}{
+		{conflictSkip, []string{"docs/", "docs/a.txt=old", "docs/b.txt=b"}},
+		{conflictRename, []string{"docs/", "docs/a (1).txt=new", "docs/a.txt=old", "docs/b (1).txt=b", "docs/b.txt=b"}},
+		{conflictOverwrite, []string{"docs/", "docs/a (1).txt=new", "docs/a.txt=new", "docs/b (1).txt=b", "docs/b.txt=b"}},
+	} {
+		st := importTakeout(t, user.ID, root.ID, newTakeout(t, files, []string{"docs"}), tc.policy)
+		if st.Status != jobDone || st.Result["errors"] != nil {
+			t.Fatalf("%s: %+v", tc.policy, st)
+		}
+		// The folder is merged into, never renamed or skipped.
+		if got := treeOf(t, root.ID); !slices.Equal(got, tc.want) {
+			t.Fatalf("%s: %q, want %q", tc.policy, got, tc.want)
+		}
+	}
+}
+
+func TestTakeoutImportSkipThenMerge(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	uploadTestFile(t, "a", "old", root.ID, user.ID)
+	newFolder(t, "b", root.ID, user.ID)
+	// a is skipped; b exists and is merged into all the same.
+	st := importTakeout(t, user.ID, root.ID, newTakeout(t, map[string]string{"b/inside.txt": "in"}, []string{"a", "b"}), conflictSkip)
+	if st.Status != jobDone || st.Result["skipped"] != 1 || st.Result["files"] != 1 || st.Result["errors"] != nil {
+		t.Fatalf("import: %+v", st)
+	}
+	if got := treeOf(t, root.ID); !slices.Equal(got, []string{"a=old", "b/", "b/inside.txt=in"}) {
+		t.Fatalf("imported %q", got)
+	}
+}
+
+func TestTakeoutImportNames(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	files := map[string]string{
+		"CON.txt":                "x",
+		"what?.txt":              "x",
+		strings.Repeat("n", 256): "x",
+		"trailing./inside.txt":   "x",
+		"cafe\u0301/e\u0301.txt": "nfd",
+	}
+	st := importTakeout(t, user.ID, root.ID, newTakeout(t, files, []string{"trailing.", "cafe\u0301"}), conflictFail)
+	errs, _ := st.Result["errors"].([]string)
+	if st.Status != jobDone || len(errs) != 5 || st.Result["files"] != 1 || st.Result["folders"] != 1 {
+		t.Fatalf("import: %+v", st)
+	}
+	for _, e := range errs {
+		if !strings.Contains(e, errInvalidName.Error()) && !strings.HasSuffix(e, "parent folder was not imported") {
+			t.Errorf("unexpected error %q", e)
+		}
+	}
+	if got := treeOf(t, root.ID); !slices.Equal(got, []string{"caf\u00e9/", "caf\u00e9/\u00e9.txt=nfd"}) {
+		t.Fatalf("imported %q", got)
+	}
+}
+
+func TestTakeoutImportRejects(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	st := importTakeout(t, user.ID, root.ID, newTakeout(t, map[string]string{"ok.txt": "ok"}, nil,
+		TakeoutEntry{Path: "../escape.txt"},
+		TakeoutEntry{Path: "/abs.txt"},
+		TakeoutEntry{Path: "missing/x.txt"},
+		TakeoutEntry{Path: "gone.txt", Size: 1},
+	), conflictRename)
+	errs, _ := st.Result["errors"].([]string)
+	if st.Status != jobDone || len(errs) != 4 || st.Result["files"] != 1 {
+		t.Fatalf("import: %+v", st)
+	}
+	for i, want := range []string{"invalid path", "invalid path", "missing from archive", "parent folder was not imported"} {
+		if !strings.HasSuffix(errs[i], want) {
+			t.Errorf("error %d is %q, want %q", i, errs[i], want)
+		}
+	}
+	if got := treeOf(t, root.ID); !slices.Equal(got, []string{"ok.txt=ok"}) {
+		t.Fatalf("imported %q", got)
+	}
+
+	t.Setenv("HANAS_IMPORT_MAX_ENTRIES", "2")
+	st = importTakeout(t, user.ID, root.ID, newTakeout(t, map[string]string{"a": "a", "b": "b"}, nil), conflictRename)
+	if st.Status != jobFailed || !strings.Contains(st.Error, "entries") {
+		t.Fatalf("too many entries: %+v", st)
+	}
+	t.Setenv("HANAS_IMPORT_MAX_ENTRIES", "100")
+	t.Setenv("HANAS_IMPORT_MAX_SIZE", "1K")
+	st = importTakeout(t, user.ID, root.ID, newTakeout(t, map[string]string{"big": strings.Repeat("x", 2000)}, nil), conflictRename)
+	if st.Status != jobFailed || !strings.Contains(st.Error, "bytes") {
+		t.Fatalf("too large: %+v", st)
+	}
+	if got := treeOf(t, root.ID); len(got) != 1 {
+		t.Fatalf("a refused import left %q", got)
+	}
+}
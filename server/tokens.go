@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scopeRead   = "read"
+	scopeUpload = "upload"
+	scopeFull   = "full"
+
+	accessTokenPrefix = "hnp_"
+	// last_used_at is only written this often so that a busy script does
+	// not turn every request into a database write.
+	tokenTouchInterval = time.Minute
+)
+
+// AccessToken is a personal access token for scripts. Only the SHA-256 of
+// the secret is stored; the secret itself is shown once on creation.
+type AccessToken struct {
+	ID         uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"-"`
+	Name       string     `gorm:"not null" json:"name"`
+	Hash       string     `gorm:"uniqueIndex;not null" json:"-"`
+	Hint       string     `json:"hint"`
+	Scope      string     `gorm:"not null" json:"scope"`
+	FolderID   *uint      `json:"folder_id,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// NewAccessToken is returned once when a token is created.
+type NewAccessToken struct {
+	AccessToken
+	Token string `json:"token"`
+}
+
+type AccessTokenRequest struct {
+	Name      string     `json:"name"`
+	Scope     string     `json:"scope"`
+	FolderID  *uint      `json:"folder_id,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+var (
+	errTokenName   = errors.New("name required")
+	errTokenScope  = errors.New("scope must be read, upload or full")
+	errTokenFolder = errors.New("folder not found")
+	errTokenExpiry = errors.New("expires_at is in the past")
+)
+
+func hashAccessToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func createAccessToken(userID uint, req AccessTokenRequest) (NewAccessToken, error) {
+	var nt NewAccessToken
+	if strings.TrimSpace(req.Name) == "" {
+		return nt, errTokenName
+	}
+	if req.Scope == "" {
+		req.Scope = scopeFull
+	}
+	if req.Scope != scopeRead && req.Scope != scopeUpload && req.Scope != scopeFull {
+		return nt, errTokenScope
+	}
+	if req.FolderID != nil {
+		var folder Node
+		if err := db.First(&folder, "id = ? AND user_id = ?", *req.FolderID, userID).Error; err != nil || !folder.IsDir {
+			return nt, errTokenFolder
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nt, errTokenExpiry
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nt, err
+	}
+	nt.Token = accessTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	nt.AccessToken = AccessToken{
+		UserID:    userID,
+		Name:      req.Name,
+		Hash:      hashAccessToken(nt.Token),
+		Hint:      nt.Token[len(nt.Token)-4:],
+		Scope:     req.Scope,
+		FolderID:  req.FolderID,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := db.Create(&nt.AccessToken).Error; err != nil {
+		return nt, fmt.Errorf("failed to create token: %w", err)
+	}
+	return nt, nil
+}
+
+// authenticateToken accepts an Authorization: Bearer token and passes its
+// scope and folder on to handlers in X-Token-Scope and X-Token-Folder.
+func authenticateToken(r *http.Request, secret string) bool {
+	var tokens []AccessToken
+	db.Where("hash = ?", hashAccessToken(secret)).Limit(1).Find(&tokens)
+	if len(tokens) == 0 {
+		return false
+	}
+	t := tokens[0]
+	now := time.Now()
+	if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+		return false
+	}
+	var user User
+	if err := db.First(&user, t.UserID).Error; err != nil {
+		return false
+	}
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > tokenTouchInterval {
+		db.Model(&AccessToken{}).Where("id = ?", t.ID).UpdateColumn("last_used_at", now)
+	}
+	r.Header.Set("X-User-ID", fmt.Sprintf("%d", user.ID))
+	r.Header.Set("X-Username", user.Username)
+	r.Header.Set("X-Token-Scope", t.Scope)
+	if t.FolderID != nil {
+		r.Header.Set("X-Token-Folder", fmt.Sprintf("%d", *t.FolderID))
+	}
+	return true
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, secret, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(secret), true
+}
+
+func isTokenRequest(r *http.Request) bool {
+	return r.Header.Get("X-Token-Scope") != ""
+}
+
+// uploadRoute lists what an upload-only token may call besides /me.
+func uploadRoute(r *http.Request) bool {
+	p := r.URL.Path
+	switch {
+	case r.Method == http.MethodGet && (p == "/me" || p == apiPrefix+"/me"):
+		return true
+	case r.Method == http.MethodPost && (p == "/upload" || p == "/upload/files"):
+		return true
+	case r.Method == http.MethodPost && strings.HasPrefix(p, apiPrefix+"/nodes/") && strings.HasSuffix(p, "/children"):
+		return true
+	case r.Method == http.MethodPut && strings.HasPrefix(strings.TrimPrefix(p, apiPrefix), fsPrefix):
+		return true
+	}
+	return false
+}
+
+// uploadPolicy turns overwrite into rename for upload-only tokens: they
+// add files but must not replace or delete what is there.
+func uploadPolicy(r *http.Request, policy string) string {
+	if policy == conflictOverwrite && r.Header.Get("X-Token-Scope") == scopeUpload {
+		return conflictRename
+	}
+	return policy
+}
+
+// scopeAllows checks a token's scope against the request. Sessions may do
+// anything.
+func scopeAllows(r *http.Request) bool {
+	switch r.Header.Get("X-Token-Scope") {
+	case "", scopeFull:
+		return true
+	case scopeRead:
+		return r.Method == http.MethodGet || r.Method == http.MethodHead
+	case scopeUpload:
+		return uploadRoute(r)
+	}
+	return false
+}
+
+// tokenFolder returns the folder the request's token is restricted to.
+func tokenFolder(r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(r.Header.Get("X-Token-Folder"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// nodeAllowed reports whether the request may touch a node: a token
+// restricted to a folder only reaches that folder and what is below it.
+func nodeAllowed(r *http.Request, node Node) bool {
+	folder, ok := tokenFolder(r)
+	if !ok {
+		return true
+	}
+	return node.ID == folder || isAncestor(folder, node.ID, node.UserID)
+}
+
+// rootFor is the folder a request starts from: the user's root, or the
+// folder a token is restricted to.
+func rootFor(r *http.Request, userID uint) Node {
+	if folder, ok := tokenFolder(r); ok {
+		var node Node
+		db.First(&node, "id = ? AND user_id = ?", folder, userID)
+		return node
+	}
+	return return_root(userID)
+}
+
+func denyOutsideFolder(w http.ResponseWriter, r *http.Request, nodes ...Node) bool {
+	for _, n := range nodes {
+		if !nodeAllowed(r, n) {
+			http.Error(w, "Forbidden: token is restricted to another folder", http.StatusForbidden)
+			return true
+		}
+	}
+	return false
+}
+
+func tokenErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errTokenFolder):
+		return http.StatusNotFound
+	case errors.Is(err, errTokenName), errors.Is(err, errTokenScope), errors.Is(err, errTokenExpiry):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func listAccessTokens(userID uint) []AccessToken {
+	tokens := []AccessToken{}
+	db.Where("user_id = ?", userID).Order("id").Find(&tokens)
+	return tokens
+}
+
+// Tokens handles GET and POST /tokens to list and create personal access
+// tokens and DELETE /tokens/<id> to revoke one. Tokens cannot manage tokens.
+func Tokens(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if isTokenRequest(r) {
+		http.Error(w, "Forbidden: tokens are managed from a login session", http.StatusForbidden)
+		return
+	}
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tokens"), "/")
+	switch {
+	case idStr == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, listAccessTokens(userID))
+	case idStr == "" && r.Method == http.MethodPost:
+		var req AccessTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		nt, err := createAccessToken(userID, req)
+		if err != nil {
+			http.Error(w, err.Error(), tokenErrorStatus(err))
+			return
+		}
+		writeJSON(w, http.StatusCreated, nt)
+	case idStr != "" && r.Method == http.MethodDelete:
+		res := db.Where("id = ? AND user_id = ?", idStr, userID).Delete(&AccessToken{})
+		if res.Error != nil {
+			http.Error(w, "failed to revoke token", http.StatusInternalServerError)
+			return
+		}
+		if res.RowsAffected == 0 {
+			http.Error(w, "token not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// tokenCall sends a request to srv with the access token.
+func tokenCall(t *testing.T, srv *httptest.Server, token, method, path string, body io.Reader) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestUploadTokenKeepsExistingFiles(t *testing.T) {
+	newTestDB(t)
+	srv := newAPIServer(t)
+	user, root := newTestUser(t, "alice")
+	existing := uploadTestFile(t, "a.txt", "old", root.ID, user.ID)
+	nt, err := createAccessToken(user.ID, AccessTokenRequest{Name: "camera", Scope: scopeUpload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := tokenCall(t, srv, nt.Token, "PUT", fmt.Sprintf("%s/nodes/%d/content", apiPrefix, existing), strings.NewReader("new")); code != http.StatusForbidden {
+		t.Fatalf("replacing content: %d, want 403", code)
+	}
+	if code := tokenCall(t, srv, nt.Token, "PUT", apiPrefix+"/fs/a.txt?conflict=overwrite", strings.NewReader("new")); code != http.StatusCreated {
+		t.Fatalf("path upload: %d, want 201", code)
+	}
+
+	// The legacy upload overwrites by default and replaces a file with a
+	// folder of its name.
+	for _, body := range []string{
+		fmt.Sprintf(`{"filename":"a.txt","oya_id":%d,"data_base64":"bmV3"}`, root.ID),
+		fmt.Sprintf(`{"filename":"a.txt","oya_id":%d,"is_dir":true}`, root.ID),
+	} {
+		r := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-User-ID", fmt.Sprint(user.ID))
+		r.Header.Set("X-Token-Scope", scopeUpload)
+		w := httptest.NewRecorder()
+		UpFile(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload %s: %d %s", body, w.Code, w.Body)
+		}
+	}
+
+	want := []string{"a (1).txt=new", "a (2).txt=new", "a.txt (1)/", "a.txt=old"}
+	if got := treeOf(t, root.ID); !slices.Equal(got, want) {
+		t.Fatalf("root holds %q, want %q", got, want)
+	}
+}
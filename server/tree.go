@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Ancestry is the IDs from the root down to the node, e.g. "/1/5/9/", so
+// a subtree is one index range.
+
+func ancestryOf(parent string, id uint) string {
+	if parent == "" {
+		parent = "/"
+	}
+	return parent + strconv.FormatUint(uint64(id), 10) + "/"
+}
+
+// subtree limits a query to the node with the given ancestry and everything
+// below it. "/" sorts right before "0", so the range ends there.
+func subtree(tx *gorm.DB, ancestry string) *gorm.DB {
+	return tx.Where("ancestry >= ? AND ancestry < ?", ancestry, strings.TrimSuffix(ancestry, "/")+"0")
+}
+
+// ancestorIDs lists the IDs in an ancestry from the root down, without the
+// node itself.
+func ancestorIDs(ancestry string) []uint {
+	parts := strings.Split(strings.Trim(ancestry, "/"), "/")
+	var ids []uint
+	for _, p := range parts[:max(len(parts)-1, 0)] {
+		if id, err := strconv.ParseUint(p, 10, 64); err == nil {
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids
+}
+
+// AfterCreate fills in the ancestry once the node has its ID and adds the
+// node to the folder totals.
+func (n *Node) AfterCreate(tx *gorm.DB) error {
+	parent := ""
+	if n.OyaID != nil {
+		var parents []Node
+		if err := tx.Select("ancestry").Where("id = ?", *n.OyaID).Limit(1).Find(&parents).Error; err != nil {
+			return err
+		}
+		if len(parents) == 0 || parents[0].Ancestry == "" {
+			// Leave it empty; fillAncestry or fsck picks it up once the
+			// parent is known.
+			return nil
+		}
+		parent = parents[0].Ancestry
+	}
+	n.Ancestry = ancestryOf(parent, n.ID)
+	if err := tx.Model(&Node{}).Where("id = ?", n.ID).UpdateColumn("ancestry", n.Ancestry).Error; err != nil {
+		return err
+	}
+	size, stored, files := totals(*n)
+	return addToAncestors(tx, n.Ancestry, size, stored, files)
+}
+
+// reparent moves the ancestry of src and its subtree under the new parent,
+// and its totals from the old folders to the new ones.
+func reparent(tx *gorm.DB, src Node, newOyaID uint) error {
+	var parent Node
+	if err := tx.Select("ancestry").First(&parent, newOyaID).Error; err != nil {
+		return err
+	}
+	if src.Ancestry == "" || parent.Ancestry == "" {
+		if err := tx.Model(&Node{}).Where("id = ?", src.ID).UpdateColumn("ancestry", "").Error; err != nil {
+			return err
+		}
+		return fillAncestry(tx)
+	}
+	moved := ancestryOf(parent.Ancestry, src.ID)
+	err := subtree(tx.Model(&Node{}), src.Ancestry).
+		UpdateColumn("ancestry", gorm.Expr("? || substr(ancestry, ?)", moved, len(src.Ancestry)+1)).Error
+	if err != nil {
+		return err
+	}
+	if err := removeFromAncestors(tx, src); err != nil {
+		return err
+	}
+	size, stored, files := totals(src)
+	return addToAncestors(tx, moved, size, stored, files)
+}
+
+// fillAncestry fills missing ancestries one tree level per statement.
+func fillAncestry(tx *gorm.DB) error {
+	// Nodes whose parent is gone start a tree of their own until fsck
+	// moves them to lost+found.
+	res := tx.Model(&Node{}).Where("ancestry = '' AND (oya_id IS NULL OR oya_id NOT IN (SELECT id FROM nodes))").
+		UpdateColumn("ancestry", gorm.Expr("'/' || id || '/'"))
+	if res.Error != nil {
+		return res.Error
+	}
+	filled := res.RowsAffected
+	for {
+		res := tx.Exec(`UPDATE nodes SET ancestry = (SELECT p.ancestry FROM nodes p WHERE p.id = nodes.oya_id) || id || '/'
+			WHERE ancestry = '' AND oya_id IN (SELECT id FROM nodes WHERE ancestry != '')`)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			break
+		}
+		filled += res.RowsAffected
+	}
+	if filled > 0 {
+		fmt.Printf("Computed the tree path of %d nodes\n", filled)
+	}
+	return nil
+}
+
+// subtreeNodes loads a node and all of its descendants, parents before
+// children.
+func subtreeNodes(tx *gorm.DB, n Node) ([]Node, error) {
+	if n.Ancestry == "" {
+		return nil, fmt.Errorf("node %d has no tree path; run fsck -repair", n.ID)
+	}
+	var nodes []Node
+	err := subtree(tx, n.Ancestry).Where("user_id = ?", n.UserID).Order("ancestry").Find(&nodes).Error
+	return nodes, err
+}
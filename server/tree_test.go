@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAncestorIDs(t *testing.T) {
+	for ancestry, want := range map[string][]uint{
+		"/1/5/9/": {1, 5},
+		"/1/5/":   {1},
+		"/1/":     nil,
+		"":        nil,
+	} {
+		if got := ancestorIDs(ancestry); !slices.Equal(got, want) {
+			t.Errorf("%q: %v, want %v", ancestry, got, want)
+		}
+	}
+}
+
+func subtreeNames(t *testing.T, id uint) []string {
+	t.Helper()
+	nodes, err := subtreeNodes(db, nodeByID(t, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+func TestSubtreeRange(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	a := newFolder(t, "a", root.ID, user.ID)
+	// Make siblings until one's ID starts with a's, e.g. 3 and 30.
+	var b uint
+	for i := 0; b == 0; i++ {
+		if i > 1000 {
+			t.Fatal("no sibling with a longer ID")
+		}
+		if id := newFolder(t, fmt.Sprintf("s%d", i), root.ID, user.ID); strings.HasPrefix(fmt.Sprint(id), fmt.Sprint(a)) {
+			b = id
+		}
+	}
+	a1 := newFolder(t, "a1", a, user.ID)
+	uploadTestFile(t, "a1.txt", "x", a1, user.ID)
+	uploadTestFile(t, "b.txt", "x", b, user.ID)
+
+	if got := subtreeNames(t, a); !slices.Equal(got, []string{"a", "a1", "a1.txt"}) {
+		t.Fatalf("subtree of a (%d) is %q", a, got)
+	}
+	if got := subtreeNames(t, b); len(got) != 2 || got[1] != "b.txt" {
+		t.Fatalf("subtree of %d is %q", b, got)
+	}
+
+	// Moving a below b carries its subtree along.
+	if _, err := moveNodeAs(nodeByID(t, a), b, "a", user.ID, conflictFail); err != nil {
+		t.Fatal(err)
+	}
+	if got := nodeByID(t, a1).Ancestry; got != fmt.Sprintf("/%d/%d/%d/%d/", root.ID, b, a, a1) {
+		t.Fatalf("ancestry after the move: %s", got)
+	}
+	if got := subtreeNames(t, b); len(got) != 5 {
+		t.Fatalf("subtree of %d after the move: %q", b, got)
+	}
+}
+
+func TestFillAncestry(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	a := newFolder(t, "a", root.ID, user.ID)
+	file := uploadTestFile(t, "f.txt", "x", a, user.ID)
+	want := nodeByID(t, file).Ancestry
+	orphanParent := uint(999999)
+	orphan := Node{UserID: user.ID, Name: "orphan", IsDir: true, OyaID: &orphanParent}
+	if err := db.Create(&orphan).Error; err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&Node{}).Where("id IN ?", []uint{root.ID, a, file, orphan.ID}).UpdateColumn("ancestry", "")
+	if err := fillAncestry(db); err != nil {
+		t.Fatal(err)
+	}
+	if got := nodeByID(t, file).Ancestry; got != want {
+		t.Fatalf("ancestry is %q, want %q", got, want)
+	}
+	if got := nodeByID(t, orphan.ID).Ancestry; got != fmt.Sprintf("/%d/", orphan.ID) {
+		t.Fatalf("orphan ancestry is %q", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+
+	"gorm.io/gorm"
+)
+
+// A unitOfWork is one node mutation: a transaction plus blobs staged before
+// it and removed after commit, or on rollback.
+type unitOfWork struct {
+	staged []uint
+	doomed []uint
+}
+
+// upload stages a new blob with the reader's content.
+func (u *unitOfWork) upload(r io.Reader) (uint, string, error) {
+	fid, hash, err := UploadFile(r)
+	if err == nil {
+		u.staged = append(u.staged, fid)
+	}
+	return fid, hash, err
+}
+
+// copyBlob stages a copy of an existing blob.
+func (u *unitOfWork) copyBlob(fid uint, hash string) (uint, string, error) {
+	newFid, newHash, err := copyBlob(fid, hash)
+	if err == nil {
+		u.staged = append(u.staged, newFid)
+	}
+	return newFid, newHash, err
+}
+
+// discard removes a blob once the unit commits.
+func (u *unitOfWork) discard(fid uint) {
+	u.doomed = append(u.doomed, fid)
+}
+
+// commit runs fn in a transaction. Staged blobs are removed if it fails and
+// discarded ones if it succeeds. A name taken in the meantime is a conflict.
+func (u *unitOfWork) commit(fn func(tx *gorm.DB) error) error {
+	if err := db.Transaction(fn); err != nil {
+		u.abort()
+		if isNameTaken(err) {
+			return errConflict
+		}
+		return err
+	}
+	for _, fid := range u.doomed {
+		removeBlob(fid)
+	}
+	u.staged, u.doomed = nil, nil
+	return nil
+}
+
+// abort removes the staged blobs of a unit that is given up before commit.
+func (u *unitOfWork) abort() {
+	for _, fid := range u.staged {
+		removeBlob(fid)
+	}
+	u.staged, u.doomed = nil, nil
+}
+
+// childByName looks up an entry of a folder within the transaction.
+func childByName(tx *gorm.DB, oyaID *uint, name string, userID uint) (Node, bool, error) {
+	var nodes []Node
+	err := tx.Where("oya_id = ? AND name = ? AND user_id = ?", oyaID, name, userID).Limit(1).Find(&nodes).Error
+	if err != nil || len(nodes) == 0 {
+		return Node{}, false, err
+	}
+	return nodes[0], true, nil
+}
+
+// claimName picks the name under a conflict policy. With skip it returns
+// errSkipped and the existing ID; keep never conflicts with itself.
+func claimName(u *unitOfWork, tx *gorm.DB, oyaID uint, name string, isDir bool, userID uint, policy string, keep uint) (string, uint, error) {
+	existing, ok, err := childByName(tx, &oyaID, name, userID)
+	if err != nil || !ok || existing.ID == keep {
+		return name, 0, err
+	}
+	switch policy {
+	case conflictRename:
+		name, err = freeName(tx, oyaID, name, isDir, userID)
+		return name, 0, err
+	case conflictSkip:
+		return name, existing.ID, errSkipped
+	case conflictOverwrite:
+	default:
+		return name, 0, errConflict
+	}
+	if keep != 0 && existing.Ancestry != "" {
+		var inside int64
+		if err := subtree(tx.Model(&Node{}), existing.Ancestry).Where("id = ?", keep).Count(&inside).Error; err != nil {
+			return name, 0, err
+		}
+		if inside > 0 {
+			return name, 0, errIntoSelf
+		}
+	}
+	return name, 0, deleteTree(u, tx, existing)
+}
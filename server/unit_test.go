@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestUnitRollbackRemovesStagedBlobs(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	var u unitOfWork
+	content, err := stageContent(&u, "a.txt", strings.NewReader("staged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blobExists(t, *content.Fid) {
+		t.Fatal("staged blob was not written")
+	}
+	failure := errors.New("failed")
+	err = u.commit(func(tx *gorm.DB) error {
+		if _, _, err := putFile(&u, tx, &root.ID, "a.txt", user.ID, content, conflictFail, ""); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("commit = %v, want %v", err, failure)
+	}
+	if blobExists(t, *content.Fid) {
+		t.Fatal("staged blob is left after the rollback")
+	}
+	if _, ok, _ := childByName(db, &root.ID, "a.txt", user.ID); ok {
+		t.Fatal("node is left after the rollback")
+	}
+}
+
+func TestUnitRollbackKeepsDiscardedBlobs(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	id, err := UploadNode("a.txt", strings.NewReader("old"), false, &root.ID, user.ID, conflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var old Node
+	db.First(&old, id)
+
+	// A failed overwrite keeps the old content and drops the new.
+	var u unitOfWork
+	content, _ := stageContent(&u, "a.txt", strings.NewReader("new"))
+	err = u.commit(func(tx *gorm.DB) error {
+		if _, _, err := putFile(&u, tx, &root.ID, "a.txt", user.ID, content, conflictOverwrite, ""); err != nil {
+			return err
+		}
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("commit succeeded")
+	}
+	if !blobExists(t, *old.Fid) || blobExists(t, *content.Fid) {
+		t.Fatal("rollback removed the old blob or kept the new one")
+	}
+
+	// A successful one removes the old blob only after the commit.
+	if _, err := UploadNode("a.txt", strings.NewReader("new"), false, &root.ID, user.ID, conflictOverwrite); err != nil {
+		t.Fatal(err)
+	}
+	var current Node
+	db.First(&current, id)
+	if blobExists(t, *old.Fid) || !blobExists(t, *current.Fid) {
+		t.Fatal("commit kept the old blob or lost the new one")
+	}
+}
+
+func TestMoveRereadsTheNode(t *testing.T) {
+	newTestDB(t)
+	user, root := newTestUser(t, "alice")
+	a := newFolder(t, "a", root.ID, user.ID)
+	b := newFolder(t, "b", root.ID, user.ID)
+	c := newFolder(t, "c", root.ID, user.ID)
+	f := uploadTestFile(t, "f.txt", "12345", a, user.ID)
+
+	// A rename with a copy read before an overwrite keeps the new content.
+	stale := nodeByID(t, f)
+	current := nodeByID(t, f)
+	if err := replaceContent(&current, strings.NewReader("changed"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := moveNodeAs(stale, a, "g.txt", user.ID, conflictFail); err != nil {
+		t.Fatal(err)
+	}
+	renamed := nodeByID(t, f)
+	if renamed.Name != "g.txt" || *renamed.Fid != *nodeByID(t, current.ID).Fid || readBlob(t, *renamed.Fid) != "changed" {
+		t.Fatalf("after the rename: %q on fid %d", renamed.Name, *renamed.Fid)
+	}
+
+	// A move with a copy read before another move is refused: the lock it
+	// took is no longer the node's folder's.
+	stale = nodeByID(t, f)
+	if _, err := moveNodeAs(nodeByID(t, f), b, "g.txt", user.ID, conflictFail); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := moveNodeAs(stale, c, "g.txt", user.ID, conflictFail); !errors.Is(err, errMoved) {
+		t.Fatalf("second move: %v, want %v", err, errMoved)
+	}
+	if _, err := moveNodeAs(nodeByID(t, f), c, "g.txt", user.ID, conflictFail); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nodeByID(t, f).Ancestry, fmt.Sprintf("/%d/%d/%d/", root.ID, c, f); got != want {
+		t.Fatalf("ancestry is %s, want %s", got, want)
+	}
+	checkTotals(t, "a", a, 0, 0)
+	checkTotals(t, "b", b, 0, 0)
+	checkTotals(t, "c", c, 7, 1)
+}